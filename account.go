@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+const maxKeyNameLength = 64
+
+var errKeyNotFound = errors.New("api key not found")
+
+// accountKey is an API key as listed on the account page
+type accountKey struct {
+	KeyHash      string
+	KeyPrefix    string
+	Name         string
+	Tier         string
+	MonthlyLimit int
+	Used         int
+	CreatedAt    time.Time
+	Revoked      bool
+	Suspended    bool
+}
+
+// Status describes whether the key can currently be used
+func (k accountKey) Status() string {
+	switch {
+	case k.Revoked:
+		return "Revoked"
+	case k.Suspended:
+		return "Suspended"
+	}
+	return "Active"
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	keys, err := s.store.ListAccountKeys(r.Context(), user.Email)
+	if err != nil {
+		s.logger.Error("failed to list api keys", "error", err)
+		http.Error(w, "Failed to load account", http.StatusInternalServerError)
+		return
+	}
+
+	component := AccountPage(user.Email, s.csrfToken(r), keys)
+	s.renderTemplate(w, r, component, "account")
+}
+
+func (s *Server) handleKeyRotate(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	prefix := chi.URLParam(r, "prefix")
+	key, ck, err := s.store.RotateAccountKey(r.Context(), user.Email, prefix)
+	if errors.Is(err, errKeyNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to rotate api key", "error", err)
+		http.Error(w, "Failed to rotate API key", http.StatusInternalServerError)
+		return
+	}
+
+	// Don't let this instance keep accepting the old key until the cache expires
+	s.apiKeys.forget(ck.KeyHash)
+
+	s.logger.Info("api key rotated", "old_prefix", prefix, "new_prefix", key[:10])
+	component := KeyRotatedPage(key, planName(ck.Tier), ck.MonthlyLimit, user.Email)
+	s.renderTemplate(w, r, component, "key-rotated")
+}
+
+func (s *Server) handleKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	prefix := chi.URLParam(r, "prefix")
+	keyHash, err := s.store.RevokeAccountKey(r.Context(), user.Email, prefix)
+	if errors.Is(err, errKeyNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to revoke api key", "error", err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	s.apiKeys.forget(keyHash)
+
+	s.logger.Info("api key revoked", "prefix", prefix)
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+func (s *Server) handleKeyRename(w http.ResponseWriter, r *http.Request) {
+	user, _ := userFromContext(r.Context())
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > maxKeyNameLength {
+		http.Error(w, "Key name must be between 1 and 64 characters", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.store.RenameAccountKey(r.Context(), user.Email, chi.URLParam(r, "prefix"), name); err != nil {
+		if errors.Is(err, errKeyNotFound) {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		s.logger.Error("failed to rename api key", "error", err)
+		http.Error(w, "Failed to rename API key", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// ListAccountKeys returns every key issued to email, newest first, with each
+// active key's usage this period
+func (pg *pgStore) ListAccountKeys(ctx context.Context, email string) ([]accountKey, error) {
+	query := `
+		SELECT key_hash, key_prefix, name, tier, monthly_limit, created_at,
+			revoked_at IS NOT NULL, suspended_at IS NOT NULL
+		FROM api_keys
+		WHERE user_email = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := pg.pool.Query(ctx, query, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []accountKey
+	for rows.Next() {
+		var k accountKey
+		if err := rows.Scan(&k.KeyHash, &k.KeyPrefix, &k.Name, &k.Tier, &k.MonthlyLimit, &k.CreatedAt, &k.Revoked, &k.Suspended); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range keys {
+		if keys[i].Revoked {
+			continue
+		}
+		usage, err := getUsage(ctx, pg.pool, keys[i].KeyHash, false)
+		if err != nil {
+			return nil, err
+		}
+		keys[i].Used = usage.Used
+	}
+	return keys, nil
+}
+
+// RotateAccountKey issues a replacement for an active key and revokes the old
+// one. The new key keeps the old key's name, plan, subscription, usage,
+// webhooks and running batches.
+func (pg *pgStore) RotateAccountKey(ctx context.Context, email, prefix string) (string, accountKey, error) {
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return "", accountKey{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var oldHash string
+	var old accountKey
+	err = tx.QueryRow(ctx, `
+		SELECT key_hash, name, tier, monthly_limit
+		FROM api_keys
+		WHERE user_email = $1 AND key_prefix = $2 AND revoked_at IS NULL
+		LIMIT 1
+		FOR UPDATE
+	`, email, prefix).Scan(&oldHash, &old.Name, &old.Tier, &old.MonthlyLimit)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", accountKey{}, errKeyNotFound
+	}
+	if err != nil {
+		return "", accountKey{}, err
+	}
+
+	key, err := generateAPIKey(ctx, tx, email, Plan{ID: old.Tier, Name: old.Name, Credits: old.MonthlyLimit})
+	if err != nil {
+		return "", accountKey{}, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE api_keys AS n
+		SET name = o.name,
+			stripe_subscription_id = o.stripe_subscription_id,
+			period_start = o.period_start,
+			suspended_at = o.suspended_at,
+			subscription_event_at = o.subscription_event_at,
+			subscription_ended_at = o.subscription_ended_at,
+			webhook_secret = o.webhook_secret
+		FROM api_keys AS o
+		WHERE n.key_hash = $1 AND o.key_hash = $2
+	`, hashToken(key), oldHash)
+	if err != nil {
+		return "", accountKey{}, err
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE api_keys SET revoked_at = now(), stripe_subscription_id = NULL
+		WHERE key_hash = $1
+	`, oldHash)
+	if err != nil {
+		return "", accountKey{}, err
+	}
+
+	// Usage follows the key, so rotating doesn't reset the quota
+	_, err = tx.Exec(ctx, `UPDATE usage_ledger SET key_hash = $1 WHERE key_hash = $2`, hashToken(key), oldHash)
+	if err != nil {
+		return "", accountKey{}, err
+	}
+
+	// So do webhooks: the signing secret was copied above, so receivers
+	// don't need to change anything
+	_, err = tx.Exec(ctx, `UPDATE webhook_endpoints SET key_hash = $1 WHERE key_hash = $2`, hashToken(key), oldHash)
+	if err != nil {
+		return "", accountKey{}, err
+	}
+
+	// And batches still running, since FinishBatch finds their endpoints by key
+	_, err = tx.Exec(ctx, `UPDATE batches SET key_hash = $1 WHERE key_hash = $2 AND finished_at IS NULL`, hashToken(key), oldHash)
+	if err != nil {
+		return "", accountKey{}, err
+	}
+
+	old.KeyHash = oldHash
+	return key, old, tx.Commit(ctx)
+}
+
+// RevokeAccountKey permanently disables one of the user's keys and returns
+// its hash
+func (pg *pgStore) RevokeAccountKey(ctx context.Context, email, prefix string) (string, error) {
+	query := `
+		UPDATE api_keys SET revoked_at = now()
+		WHERE user_email = $1 AND key_prefix = $2 AND revoked_at IS NULL
+		RETURNING key_hash
+	`
+
+	var keyHash string
+	err := pg.pool.QueryRow(ctx, query, email, prefix).Scan(&keyHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errKeyNotFound
+	}
+	return keyHash, err
+}
+
+// RenameAccountKey sets the display name of one of the user's keys
+func (pg *pgStore) RenameAccountKey(ctx context.Context, email, prefix, name string) error {
+	query := `
+		UPDATE api_keys SET name = $3
+		WHERE user_email = $1 AND key_prefix = $2
+	`
+
+	tag, err := pg.pool.Exec(ctx, query, email, prefix, name)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// signIn returns a session cookie for email issued by server
+func signIn(t *testing.T, server *Server, email string) *http.Cookie {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	server.setSession(w, httptest.NewRequest("GET", "/", nil), email)
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected one session cookie, got %d", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestAccountRequiresSignIn(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("GET", "/account", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("Expected status %d, got %d", http.StatusSeeOther, w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "/login?next=%2Faccount" {
+		t.Errorf("Expected redirect to the login page, got %q", loc)
+	}
+}
+
+func TestAccountActionsRequireCSRF(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	cookie := signIn(t, server, "chris@example.com")
+
+	paths := []string{
+		"/logout",
+		"/account/keys/ic_abcdefg/rotate",
+		"/account/keys/ic_abcdefg/revoke",
+		"/account/keys/ic_abcdefg/name",
+	}
+
+	for _, path := range paths {
+		t.Run(path, func(t *testing.T) {
+			form := url.Values{"csrf_token": {"forged"}, "name": {"Production"}}
+			req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(cookie)
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusForbidden {
+				t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+			}
+		})
+	}
+}
+
+func TestKeyRenameValidatesName(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	cookie := signIn(t, server, "chris@example.com")
+
+	csrfReq := httptest.NewRequest("GET", "/", nil)
+	csrfReq.AddCookie(cookie)
+	csrf := server.csrfToken(csrfReq)
+
+	for _, name := range []string{"", "   ", strings.Repeat("x", maxKeyNameLength+1)} {
+		form := url.Values{"csrf_token": {csrf}, "name": {name}}
+		req := httptest.NewRequest("POST", "/account/keys/ic_abcdefg/name", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+
+		server.router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for name %q, got %d", http.StatusBadRequest, name, w.Code)
+		}
+	}
+}
+
+func TestKeyRotateReplacesKey(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	old := storeAPIKey(t, store, "chris@example.com", "starter")
+	if _, err := store.ChargeCredit(context.Background(), hashToken(old)); err != nil {
+		t.Fatal(err)
+	}
+
+	cookie := signIn(t, server, "chris@example.com")
+	csrfReq := httptest.NewRequest("GET", "/", nil)
+	csrfReq.AddCookie(cookie)
+
+	form := url.Values{"csrf_token": {server.csrfToken(csrfReq)}}
+	req := httptest.NewRequest("POST", "/account/keys/"+old[:10]+"/rotate", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	keys, err := store.ListAccountKeys(context.Background(), "chris@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Expected 2 keys, got %d", len(keys))
+	}
+	for _, k := range keys {
+		if k.KeyPrefix == old[:10] {
+			if !k.Revoked {
+				t.Error("Expected the old key to be revoked")
+			}
+			continue
+		}
+		if !strings.Contains(w.Body.String(), k.KeyPrefix) {
+			t.Error("Expected the page to show the new key")
+		}
+		if k.Used != 1 {
+			t.Errorf("Expected usage to follow the key, got %d used", k.Used)
+		}
+	}
+}
+
+func TestKeyRotateKeepsBatchWebhooks(t *testing.T) {
+	store := newMemoryStore()
+	ctx := context.Background()
+	old := storeAPIKey(t, store, "chris@example.com", "starter")
+	oldKey, _ := store.LoadAPIKey(ctx, hashToken(old))
+
+	if _, err := store.CreateWebhookEndpoint(ctx, oldKey.KeyHash, "https://hooks.example.com/gotiny"); err != nil {
+		t.Fatal(err)
+	}
+	batchID, err := store.CreateBatch(ctx, oldKey, []string{"https://example.com/a.jpg"}, BatchSettings{Quality: 80, Format: "webp"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := store.RotateAccountKey(ctx, "chris@example.com", old[:10]); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch started with the old key finishes after the rotation
+	store.images[0].Status = statusCompleted
+	if _, err := store.FinishBatch(ctx, batchID); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(store.deliveries) != 1 || store.deliveries[0].URL != "https://hooks.example.com/gotiny" {
+		t.Errorf("Expected the completion webhook to reach the moved endpoint, got %d deliveries", len(store.deliveries))
+	}
+}
+
+func TestKeyRevokeAndRotateEvictCachedKey(t *testing.T) {
+	for _, action := range []string{"revoke", "rotate"} {
+		t.Run(action, func(t *testing.T) {
+			store := newMemoryStore()
+			server := NewServer(":8080", WithStore(store))
+			old := storeAPIKey(t, store, "chris@example.com", "starter")
+
+			// Cache the key as active, as an API request would
+			if _, err := server.apiKeys.lookup(context.Background(), hashToken(old)); err != nil {
+				t.Fatal(err)
+			}
+
+			cookie := signIn(t, server, "chris@example.com")
+			csrfReq := httptest.NewRequest("GET", "/", nil)
+			csrfReq.AddCookie(cookie)
+
+			form := url.Values{"csrf_token": {server.csrfToken(csrfReq)}}
+			req := httptest.NewRequest("POST", "/account/keys/"+old[:10]+"/"+action, strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.AddCookie(cookie)
+			server.router.ServeHTTP(httptest.NewRecorder(), req)
+
+			key, err := server.apiKeys.lookup(context.Background(), hashToken(old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !key.Revoked {
+				t.Error("Expected the old key to be rejected straight away")
+			}
+		})
+	}
+}
+
+func TestLogoutClearsSession(t *testing.T) {
+	server := NewServer(":8080")
+	cookie := signIn(t, server, "chris@example.com")
+
+	csrfReq := httptest.NewRequest("GET", "/", nil)
+	csrfReq.AddCookie(cookie)
+
+	form := url.Values{"csrf_token": {server.csrfToken(csrfReq)}}
+	req := httptest.NewRequest("POST", "/logout", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, w.Code)
+	}
+
+	cleared := false
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("Expected session cookie to be cleared")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// apiError is the JSON body of every /api error response
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// setupAPIRoutes mounts the GoTiny REST API
+func (s *Server) setupAPIRoutes(r chi.Router) {
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "Not found")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(s.requireDB(apiUnavailable))
+		r.Use(s.requireAPIKey)
+		r.Use(s.rateLimitAPIKey)
+
+		r.Group(func(r chi.Router) {
+			r.Use(s.apiBuffered...)
+
+			r.Post("/batches", s.handleCreateBatch)
+			r.Get("/batches/{batchID}/status", s.handleBatchStatus)
+			r.Get("/images/{imageID}/download", s.handleImageDownload)
+			r.Get("/usage", s.handleUsage)
+
+			r.Get("/webhooks", s.handleListWebhooks)
+			r.Post("/webhooks", s.handleCreateWebhook)
+			r.Delete("/webhooks/{endpointID}", s.handleDeleteWebhook)
+			r.Get("/webhooks/deliveries", s.handleListDeliveries)
+			r.Post("/webhooks/deliveries/{deliveryID}/redeliver", s.handleRedeliver)
+		})
+
+		// Uploads can take longer than the request timeout, their output is
+		// already compressed, and the upload slots cap them instead of the
+		// global throttle
+		r.Post("/compress", s.handleCompressImage)
+
+		// Streams skip compression, the request timeout and the global
+		// throttle, and have a cap of their own
+		r.Group(func(r chi.Router) {
+			r.Use(throttle(make(chan struct{}, maxEventStreams), func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", eventStreamRetryAfter)
+				writeAPIError(w, http.StatusTooManyRequests, "Too many event streams are open. Retry after the time in the Retry-After header")
+			}))
+
+			r.Get("/batches/{batchID}/events", s.handleBatchEvents)
+		})
+	})
+}
+
+// throttle caps the requests in flight at cap(slots) and answers the rest
+// with busy straight away. Routes given the same slots share the cap.
+func throttle(slots chan struct{}, busy http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				busy(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiTimeout cancels a request's context after d, like middleware.Timeout,
+// and answers with the API's JSON error if the handler hadn't responded
+func apiTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) && ww.Status() == 0 {
+				writeAPIError(w, http.StatusServiceUnavailable, "The request timed out. Please retry")
+			}
+		})
+	}
+}
+
+// apiUnavailable is the API's answer while the database is down
+func apiUnavailable(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusServiceUnavailable, "GoTiny is temporarily unavailable. Please retry shortly")
+}
+
+// writeJSON encodes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError writes the documented {"error": ...} response
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	slots := make(chan struct{}, 1)
+	busy := func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusTooManyRequests, "Busy")
+	}
+	handler := throttle(slots, busy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w
+	}
+
+	if w := serve(); w.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d with a free slot, got %d", http.StatusNoContent, w.Code)
+	}
+
+	slots <- struct{}{}
+	w := serve()
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d with every slot taken, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected the busy handler's JSON, got %q", ct)
+	}
+
+	<-slots
+	if w := serve(); w.Code != http.StatusNoContent {
+		t.Errorf("Expected the slot to be released, got status %d", w.Code)
+	}
+}
+
+func TestAPITimeoutReturnsJSON(t *testing.T) {
+	handler := apiTimeout(time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+}
+
+func TestAPIBusyReturnsJSON(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	apiKey := testAPIKey(t, server, "starter", nil)
+
+	// Take every slot of the shared cap with requests to a page
+	hold := make(chan struct{})
+	started := make(chan struct{}, maxConcurrentRequests)
+	slow := server.buffered.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-hold
+	})
+	for range maxConcurrentRequests {
+		go slow.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	for range maxConcurrentRequests {
+		<-started
+	}
+	defer close(hold)
+
+	req := httptest.NewRequest("GET", "/api/v1/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+	for _, h := range []string{"Retry-After", "RateLimit-Limit"} {
+		if w.Header().Get(h) == "" {
+			t.Errorf("Expected a %s header", h)
+		}
+	}
+}
+
+func TestAPIUnknownRouteReturnsJSON(t *testing.T) {
+	server := NewServer(":8080")
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/api/v1/nope", http.StatusNotFound},
+		{"DELETE", "/api/v1/batches", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+
+		server.router.ServeHTTP(w, req)
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.path, tt.status, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s: expected JSON content type, got %q", tt.method, tt.path, ct)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// apiKeyCacheTTL bounds how long a revoked or suspended key keeps working
+	apiKeyCacheTTL = 30 * time.Second
+
+	// unknownKeyCacheTTL is shorter so a freshly issued key works almost immediately
+	unknownKeyCacheTTL = 5 * time.Second
+
+	maxCachedAPIKeys = 10000
+)
+
+var errUnknownAPIKey = errors.New("unknown api key")
+
+// APIKey is the authenticated key behind an API request
+type APIKey struct {
+	KeyHash      string
+	KeyPrefix    string
+	Email        string
+	Tier         string
+	MonthlyLimit int
+	BatchLimit   int
+	RateLimit    int
+	PeriodStart  *time.Time
+	Revoked      bool
+	Suspended    bool
+}
+
+type apiKeyContextKey struct{}
+
+// apiKeyFromContext returns the key placed on the context by requireAPIKey
+func apiKeyFromContext(ctx context.Context) (*APIKey, bool) {
+	key, ok := ctx.Value(apiKeyContextKey{}).(*APIKey)
+	return key, ok
+}
+
+// requireAPIKey authenticates /api requests with an "Authorization: Bearer ic_..." header
+func (s *Server) requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			unauthorized(w, "Missing API key. Send it as 'Authorization: Bearer YOUR_API_KEY'")
+			return
+		}
+		if !validAPIKeyFormat(token) {
+			unauthorized(w, "Invalid API key")
+			return
+		}
+
+		key, err := s.apiKeys.lookup(r.Context(), hashToken(token))
+		if errors.Is(err, errUnknownAPIKey) {
+			unauthorized(w, "Invalid API key")
+			return
+		}
+		if err != nil {
+			s.logger.Error("failed to look up api key", "error", err)
+			writeAPIError(w, http.StatusServiceUnavailable, "Service temporarily unavailable")
+			return
+		}
+
+		switch {
+		case key.Revoked:
+			unauthorized(w, "API key has been revoked")
+			return
+		case key.Suspended:
+			unauthorized(w, "API key is suspended because its subscription is inactive")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiKeyContextKey{}, key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	writeAPIError(w, http.StatusUnauthorized, message)
+}
+
+// bearerToken returns the credentials of a Bearer Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// validAPIKeyFormat reports whether token looks like a key from generateAPIKey
+func validAPIKeyFormat(token string) bool {
+	if len(token) != 67 || !strings.HasPrefix(token, "ic_") {
+		return false
+	}
+	_, err := hex.DecodeString(token[3:])
+	return err == nil
+}
+
+type cachedAPIKey struct {
+	key     *APIKey
+	expires time.Time
+}
+
+// apiKeyCache keeps recent key lookups in memory. Unknown keys are cached too,
+// as a nil key, so a client retrying a bad key doesn't reach the database.
+type apiKeyCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedAPIKey
+	load    func(ctx context.Context, keyHash string) (*APIKey, error)
+	now     func() time.Time
+}
+
+func newAPIKeyCache(load func(ctx context.Context, keyHash string) (*APIKey, error)) *apiKeyCache {
+	return &apiKeyCache{
+		entries: make(map[string]cachedAPIKey),
+		load:    load,
+		now:     time.Now,
+	}
+}
+
+// lookup returns the key with keyHash, from the cache when it is fresh
+func (c *apiKeyCache) lookup(ctx context.Context, keyHash string) (*APIKey, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[keyHash]
+	c.mu.Unlock()
+
+	if !ok || c.now().After(entry.expires) {
+		key, err := c.load(ctx, keyHash)
+		if err != nil && !errors.Is(err, errUnknownAPIKey) {
+			return nil, err
+		}
+		entry = c.put(keyHash, key)
+	}
+
+	if entry.key == nil {
+		return nil, errUnknownAPIKey
+	}
+	return entry.key, nil
+}
+
+// forget drops keyHash from the cache so the next lookup reads it again
+func (c *apiKeyCache) forget(keyHash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, keyHash)
+}
+
+// put caches key, which is nil for a key that doesn't exist
+func (c *apiKeyCache) put(keyHash string, key *APIKey) cachedAPIKey {
+	ttl := apiKeyCacheTTL
+	if key == nil {
+		ttl = unknownKeyCacheTTL
+	}
+
+	now := c.now()
+	entry := cachedAPIKey{key: key, expires: now.Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCachedAPIKeys {
+		for hash, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, hash)
+			}
+		}
+		// Still full of live entries: start over rather than grow without bound
+		if len(c.entries) >= maxCachedAPIKeys {
+			clear(c.entries)
+		}
+	}
+	c.entries[keyHash] = entry
+	return entry
+}
+
+// LoadAPIKey reads a key and its plan limits from the database
+func (pg *pgStore) LoadAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	query := `
+		SELECT key_prefix, user_email, tier, monthly_limit, period_start,
+			revoked_at IS NOT NULL, suspended_at IS NOT NULL
+		FROM api_keys
+		WHERE key_hash = $1
+	`
+
+	key := &APIKey{KeyHash: keyHash}
+	err := pg.pool.QueryRow(ctx, query, keyHash).Scan(
+		&key.KeyPrefix, &key.Email, &key.Tier, &key.MonthlyLimit, &key.PeriodStart,
+		&key.Revoked, &key.Suspended,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errUnknownAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key.BatchLimit = maxBatchImages
+	key.RateLimit = defaultRateLimit
+	if plan, ok := planByID(key.Tier); ok {
+		key.BatchLimit = plan.BatchLimit
+		key.RateLimit = plan.RateLimit
+	}
+	return key, nil
+}
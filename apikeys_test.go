@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAPIKey seeds server's key cache with a new key on the given plan and
+// returns it, so API handlers can be exercised without a database. The key is
+// stored and loaded back the way checkout and free signup do, so its limits
+// come from the stored tier.
+func testAPIKey(t *testing.T, server *Server, tier string, edit func(*APIKey)) string {
+	t.Helper()
+
+	store := newMemoryStore()
+	token := storeAPIKey(t, store, "customer@example.com", tier)
+	key, err := store.LoadAPIKey(context.Background(), hashToken(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edit != nil {
+		edit(key)
+	}
+	server.apiKeys.put(key.KeyHash, key)
+	return token
+}
+
+// storeAPIKey adds a key on the given plan to store and returns it, for
+// handlers that charge credits or look the key up again
+func storeAPIKey(t *testing.T, store *memoryStore, email, tier string) string {
+	t.Helper()
+
+	plan, ok := planByID(tier)
+	if !ok {
+		t.Fatalf("Unknown plan %q", tier)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	key, _, err := store.addKey(email, plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestRequireAPIKeyRejectsBadCredentials(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	revoked := testAPIKey(t, server, "starter", func(k *APIKey) { k.Revoked = true })
+	suspended := testAPIKey(t, server, "starter", func(k *APIKey) { k.Suspended = true })
+
+	tests := []struct {
+		name    string
+		header  string
+		wantErr string
+	}{
+		{"missing", "", "Missing API key"},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", "Missing API key"},
+		{"malformed", "Bearer ic_nothex", "Invalid API key"},
+		{"revoked", "Bearer " + revoked, "API key has been revoked"},
+		{"suspended", "Bearer " + suspended, "API key is suspended"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/batches/a27dcd6c-a701-43e9-9376-6a702d715426/status", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), `"error":"`+tt.wantErr) {
+				t.Errorf("Expected error %q, got %q", tt.wantErr, w.Body.String())
+			}
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("Expected a WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestAPIKeyCacheExpires(t *testing.T) {
+	now := time.Now()
+	loads := 0
+
+	cache := newAPIKeyCache(nil)
+	cache.now = func() time.Time { return now }
+	cache.load = func(ctx context.Context, keyHash string) (*APIKey, error) {
+		loads++
+		if keyHash == "unknown" {
+			return nil, errUnknownAPIKey
+		}
+		return &APIKey{KeyHash: keyHash}, nil
+	}
+
+	for range 3 {
+		if _, err := cache.lookup(context.Background(), "known"); err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if _, err := cache.lookup(context.Background(), "unknown"); err != errUnknownAPIKey {
+			t.Fatalf("Expected errUnknownAPIKey, got %v", err)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("Expected 2 database loads, got %d", loads)
+	}
+
+	now = now.Add(unknownKeyCacheTTL + time.Second)
+	cache.lookup(context.Background(), "known")
+	cache.lookup(context.Background(), "unknown")
+	if loads != 3 {
+		t.Errorf("Expected only the unknown key to be reloaded, got %d loads", loads)
+	}
+
+	now = now.Add(apiKeyCacheTTL)
+	cache.lookup(context.Background(), "known")
+	if loads != 4 {
+		t.Errorf("Expected the known key to be reloaded, got %d loads", loads)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		ok     bool
+	}{
+		{"Bearer ic_abc", "ic_abc", true},
+		{"bearer ic_abc", "ic_abc", true},
+		{"Bearer ", "", false},
+		{"Token ic_abc", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", tt.header)
+
+		got, ok := bearerToken(req)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("bearerToken(%q): expected (%q, %v), got (%q, %v)", tt.header, tt.want, tt.ok, got, ok)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// loginTokenTTL is how long an emailed sign-in link stays valid
+const loginTokenTTL = 15 * time.Minute
+
+// crossOrigin rejects form posts browsers send from other sites. There is no
+// session to tie a CSRF token to before sign-in.
+var crossOrigin = http.NewCrossOriginProtection()
+
+// User is a customer signed in through a magic link. Customers are
+// identified by the email their API keys were issued to.
+type User struct {
+	Email string
+}
+
+type userContextKey struct{}
+
+// userFromContext returns the signed-in user placed on the context by sessionMiddleware
+func userFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(*User)
+	return user, ok
+}
+
+// sessionMiddleware puts the signed-in user, if any, on the request context
+func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if email, ok := s.sessionEmail(r); ok {
+			ctx := context.WithValue(r.Context(), userContextKey{}, &User{Email: email})
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireUser sends visitors who aren't signed in to the login page. Unsafe
+// methods must also carry the session's CSRF token.
+func (s *Server) requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := userFromContext(r.Context()); !ok {
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !s.validCSRF(r) {
+			http.Error(w, "Invalid form submission", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// safeRedirect returns next if it is a local path, otherwise the account page.
+// Browsers drop tabs and newlines and treat backslashes as slashes, so
+// "/\t/evil.com" would leave the site; any of them, encoded or not, is refused.
+func safeRedirect(next string) string {
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil ||
+		!strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") ||
+		strings.ContainsFunc(next, unsafeRedirectRune) || strings.ContainsFunc(u.Path, unsafeRedirectRune) {
+		return "/account"
+	}
+	return next
+}
+
+func unsafeRedirectRune(r rune) bool {
+	return r == '\\' || unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	next := safeRedirect(r.URL.Query().Get("next"))
+	if _, ok := userFromContext(r.Context()); ok {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	component := LoginPage("", next, "")
+	s.renderTemplate(w, r, component, "login")
+}
+
+func (s *Server) handleLoginSubmit(w http.ResponseWriter, r *http.Request) {
+	next := safeRedirect(r.FormValue("next"))
+
+	email, err := normalizeEmail(r.FormValue("email"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		component := LoginPage(r.FormValue("email"), next, "Please enter a valid email address.")
+		s.renderTemplate(w, r, component, "login")
+		return
+	}
+
+	if wait := s.limitEmail(r, "login", email); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		component := LoginPage(email, next, "Too many sign-in links requested. "+retryMessage(wait))
+		s.renderTemplate(w, r, component, "login")
+		return
+	}
+
+	token, err := s.store.CreateLoginToken(r.Context(), email)
+	if err != nil {
+		s.logger.Error("failed to create login token", "error", err)
+		http.Error(w, "Failed to start sign-in", http.StatusInternalServerError)
+		return
+	}
+
+	// The link is sent whether or not the email has keys, so the form can't
+	// be used to find out who is a customer
+	link := baseURL() + "/login/verify?" + url.Values{"token": {token}, "next": {next}}.Encode()
+	msg := Message{
+		To:      email,
+		Subject: "Your GoTiny sign-in link",
+		Body: "Use this link to sign in to your GoTiny account:\n\n" +
+			link + "\n\n" +
+			"This link expires in 15 minutes and can only be used once. If you didn't request it, you can ignore this email.\n",
+	}
+	if err := s.mailer.Send(r.Context(), msg); err != nil {
+		s.logger.Error("failed to send login email", "error", err)
+		http.Error(w, "Failed to send sign-in email", http.StatusInternalServerError)
+		return
+	}
+
+	component := LoginLinkSentPage(email)
+	s.renderTemplate(w, r, component, "login-sent")
+}
+
+// handleLoginVerify shows the button that signs in. Opening the emailed link
+// doesn't use it up, since mail scanners open links too.
+func (s *Server) handleLoginVerify(w http.ResponseWriter, r *http.Request) {
+	next := safeRedirect(r.URL.Query().Get("next"))
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		component := LoginPage("", next, "That sign-in link is invalid or has expired. Please request a new one.")
+		s.renderTemplate(w, r, component, "login")
+		return
+	}
+
+	component := LoginVerifyPage(token, next)
+	s.renderTemplate(w, r, component, "login-verify")
+}
+
+// handleLoginVerifySubmit consumes the sign-in token and starts a session.
+// Another site could otherwise post a token for the attacker's own email and
+// sign the visitor in to the attacker's account.
+func (s *Server) handleLoginVerifySubmit(w http.ResponseWriter, r *http.Request) {
+	if err := crossOrigin.Check(r); err != nil {
+		http.Error(w, "Invalid form submission", http.StatusForbidden)
+		return
+	}
+
+	next := safeRedirect(r.FormValue("next"))
+
+	email, err := s.store.ConsumeLoginToken(r.Context(), r.FormValue("token"))
+	if errors.Is(err, errInvalidToken) {
+		w.WriteHeader(http.StatusBadRequest)
+		component := LoginPage("", next, "That sign-in link is invalid or has expired. Please request a new one.")
+		s.renderTemplate(w, r, component, "login")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to verify login token", "error", err)
+		http.Error(w, "Failed to sign in", http.StatusInternalServerError)
+		return
+	}
+
+	s.setSession(w, r, email)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	s.clearSession(w, r)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// CreateLoginToken stores a hashed single-use sign-in token for email and returns the token
+func (pg *pgStore) CreateLoginToken(ctx context.Context, email string) (string, error) {
+	token, tokenHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO login_tokens (token_hash, email, expires_at)
+		VALUES ($1, $2, $3)
+	`
+
+	if _, err := pg.pool.Exec(ctx, query, tokenHash, email, time.Now().Add(loginTokenTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumeLoginToken marks a sign-in token as used and returns its email
+func (pg *pgStore) ConsumeLoginToken(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", errInvalidToken
+	}
+
+	query := `
+		UPDATE login_tokens SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING email
+	`
+
+	var email string
+	err := pg.pool.QueryRow(ctx, query, hashToken(token)).Scan(&email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errInvalidToken
+	}
+	return email, err
+}
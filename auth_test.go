@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLoginPage(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("GET", "/login?next=/account", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `action="/login"`) {
+		t.Error("Expected sign-in form posting to /login")
+	}
+	if !strings.Contains(body, `name="next" value="/account"`) {
+		t.Error("Expected sign-in form to carry the next path")
+	}
+
+	// Signed-in users skip the form
+	req = httptest.NewRequest("GET", "/login", nil)
+	req.AddCookie(signIn(t, server, "chris@example.com"))
+	w = httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("Expected signed-in user to be redirected, got %d", w.Code)
+	}
+}
+
+func TestLoginRejectsInvalidEmail(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader("email=nope"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestLoginLimitsEmails(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	var w *httptest.ResponseRecorder
+	for range emailsPerAddress + 1 {
+		req := httptest.NewRequest("POST", "/login", strings.NewReader("email=chris@example.com"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w = httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+	}
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+	if !strings.Contains(w.Body.String(), "Too many sign-in links") {
+		t.Error("Expected the page to explain the limit")
+	}
+
+	// Signup has its own budget
+	req := httptest.NewRequest("POST", "/compress/free", strings.NewReader("email=chris@example.com"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestLoginVerifyRejectsMissingToken(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("GET", "/login/verify", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// postLoginVerify submits the sign-in confirmation form
+func postLoginVerify(server *Server, token, next string) *httptest.ResponseRecorder {
+	form := url.Values{"token": {token}, "next": {next}}
+	req := httptest.NewRequest("POST", "/login/verify", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestLoginVerifySignsInOnce(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	token, err := store.CreateLoginToken(context.Background(), "chris@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := postLoginVerify(server, token, "/account")
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("Expected status %d, got %d", http.StatusSeeOther, w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "/account" {
+		t.Errorf("Expected redirect to /account, got %q", loc)
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Error("Expected a session cookie")
+	}
+
+	// Sign-in links work once
+	w = postLoginVerify(server, token, "")
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d on reuse, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestLoginVerifyRejectsCrossSitePosts(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	token, err := store.CreateLoginToken(context.Background(), "attacker@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(header, value string) *httptest.ResponseRecorder {
+		form := url.Values{"token": {token}, "next": {"/account"}}
+		req := httptest.NewRequest("POST", "https://devrewoh.com/login/verify", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(header, value)
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, h := range [][2]string{{"Sec-Fetch-Site", "cross-site"}, {"Origin", "https://evil.example"}} {
+		w := post(h[0], h[1])
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: expected status %d, got %d", h[0], h[1], http.StatusForbidden, w.Code)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Errorf("%s %s: expected no session cookie", h[0], h[1])
+		}
+	}
+
+	// The rejected posts didn't use the token up
+	if w := post("Sec-Fetch-Site", "same-origin"); w.Code != http.StatusSeeOther {
+		t.Errorf("Expected a same-origin post to sign in, got status %d", w.Code)
+	}
+}
+
+func TestLoginVerifyLinkDoesNotUseToken(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	token, err := store.CreateLoginToken(context.Background(), "chris@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A mail scanner opening the link only sees the confirmation form
+	for range 2 {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest("GET", "/login/verify?token="+token+"&next=/account", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatal("Expected opening the link not to sign in")
+		}
+		if !strings.Contains(w.Body.String(), `value="`+token+`"`) {
+			t.Fatal("Expected the page to post the token")
+		}
+	}
+
+	if w := postLoginVerify(server, token, "/account"); w.Code != http.StatusSeeOther {
+		t.Errorf("Expected confirming to sign in, got status %d", w.Code)
+	}
+}
+
+func TestSessionMiddlewareSetsUser(t *testing.T) {
+	server := NewServer(":8080")
+
+	var got *User
+	handler := server.sessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = userFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != nil {
+		t.Errorf("Expected no user without a session, got %+v", got)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(signIn(t, server, "chris@example.com"))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got == nil || got.Email != "chris@example.com" {
+		t.Errorf("Expected user chris@example.com, got %+v", got)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "forged"})
+	got = nil
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if got != nil {
+		t.Errorf("Expected forged session to be ignored, got %+v", got)
+	}
+}
+
+func TestHeaderReflectsSession(t *testing.T) {
+	server := NewServer(":8080")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `href="/login"`) {
+		t.Error("Expected sign-in link for anonymous visitors")
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(signIn(t, server, "chris@example.com"))
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `href="/account"`) {
+		t.Error("Expected account link for signed-in users")
+	}
+}
+
+func TestSafeRedirect(t *testing.T) {
+	tests := map[string]string{
+		"":                      "/account",
+		"/account":              "/account",
+		"/compress/docs?x=1":    "/compress/docs?x=1",
+		"//evil.example.com":    "/account",
+		"https://evil.example":  "/account",
+		"/\\evil.example.com":   "/account",
+		"/%5Cevil.example.com":  "/account",
+		"/\t/evil.example.com":  "/account",
+		"/%09/evil.example.com": "/account",
+		"/\n/evil.example.com":  "/account",
+		"/ /evil.example.com":   "/account",
+		"/%2F/evil.example.com": "/account",
+		"///evil.example.com":   "/account",
+		"javascript:alert(1)":   "/account",
+		"account":               "/account",
+		"/account?tab=keys":     "/account?tab=keys",
+	}
+
+	for next, want := range tests {
+		if got := safeRedirect(next); got != want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	maxBatchImages     = 1000
+	defaultQuality     = 80
+	defaultFormat      = "webp"
+	maxOutputDimension = 16383 // Largest width or height WebP can encode
+
+	// maxBatchBodyBytes leaves room for 1000 long URLs
+	maxBatchBodyBytes = 4 << 20
+)
+
+// Image and batch statuses
+const (
+	statusPending    = "pending"
+	statusProcessing = "processing"
+	statusCompleted  = "completed"
+	statusFailed     = "failed"
+)
+
+var (
+	errBatchNotFound = errors.New("batch not found")
+
+	uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// BatchSettings controls how every image in a batch is compressed
+type BatchSettings struct {
+	Quality   int    `json:"quality"`
+	Format    string `json:"format"`
+	Lossless  bool   `json:"lossless"`
+	MaxWidth  int    `json:"max_width"`
+	MaxHeight int    `json:"max_height"`
+}
+
+// settingsRequest is the compression settings as submitted, before defaults
+type settingsRequest struct {
+	Quality   *int   `json:"quality"`
+	Format    string `json:"format"`
+	Lossless  bool   `json:"lossless"`
+	MaxWidth  int    `json:"max_width"`
+	MaxHeight int    `json:"max_height"`
+}
+
+type createBatchRequest struct {
+	ImageURLs   []string        `json:"image_urls"`
+	Settings    settingsRequest `json:"settings"`
+	CallbackURL string          `json:"callback_url"`
+}
+
+type createBatchResponse struct {
+	BatchID string `json:"batch_id"`
+	Message string `json:"message"`
+}
+
+// batchImage is the status of one image in a batch
+type batchImage struct {
+	ID             string     `json:"id"`
+	Status         string     `json:"status"`
+	OriginalSize   *int64     `json:"original_size,omitempty"`
+	CompressedSize *int64     `json:"compressed_size,omitempty"`
+	DownloadURL    string     `json:"download_url,omitempty"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+type batchStatusResponse struct {
+	BatchID     string       `json:"batch_id"`
+	Status      string       `json:"status"`
+	TotalImages int          `json:"total_images"`
+	Completed   int          `json:"completed"`
+	Failed      int          `json:"failed"`
+	Images      []batchImage `json:"images"`
+}
+
+func (s *Server) handleCreateBatch(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	var req createBatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON request body")
+		return
+	}
+
+	settings, err := validateBatchRequest(&req)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.ImageURLs) > key.BatchLimit {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Your %s plan allows at most %d images per batch", planName(key.Tier), key.BatchLimit))
+		return
+	}
+
+	batchID, err := s.store.CreateBatch(r.Context(), key, req.ImageURLs, settings, req.CallbackURL)
+	var quotaErr *quotaError
+	if errors.As(err, &quotaErr) {
+		writeAPIError(w, http.StatusPaymentRequired, quotaErr.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to create batch", "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to create batch")
+		return
+	}
+
+	s.logger.Info("batch created", "batch_id", batchID, "key_prefix", key.KeyPrefix, "images", len(req.ImageURLs))
+	writeJSON(w, http.StatusOK, createBatchResponse{
+		BatchID: batchID,
+		Message: "Batch created successfully",
+	})
+}
+
+func (s *Server) handleBatchStatus(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	batchID := chi.URLParam(r, "batchID")
+	if !uuidPattern.MatchString(batchID) {
+		writeAPIError(w, http.StatusNotFound, "Batch not found")
+		return
+	}
+
+	status, err := s.store.GetBatchStatus(r.Context(), key.Email, batchID)
+	if errors.Is(err, errBatchNotFound) {
+		writeAPIError(w, http.StatusNotFound, "Batch not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to load batch status", "batch_id", batchID, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load batch status")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// validateBatchRequest checks a batch against the documented parameters and
+// fills in defaults
+func validateBatchRequest(req *createBatchRequest) (BatchSettings, error) {
+	if len(req.ImageURLs) == 0 {
+		return BatchSettings{}, errors.New("image_urls must contain at least one URL")
+	}
+	if len(req.ImageURLs) > maxBatchImages {
+		return BatchSettings{}, fmt.Errorf("image_urls must contain at most %d URLs", maxBatchImages)
+	}
+	for i, raw := range req.ImageURLs {
+		if err := validateImageURL(raw); err != nil {
+			return BatchSettings{}, fmt.Errorf("image_urls[%d]: %w", i, err)
+		}
+	}
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			return BatchSettings{}, fmt.Errorf("callback_url: %w", err)
+		}
+	}
+
+	return validateSettings(req.Settings, "settings.")
+}
+
+// validateSettings checks compression settings and fills in defaults. prefix
+// is prepended to field names in errors.
+func validateSettings(req settingsRequest, prefix string) (BatchSettings, error) {
+	settings := BatchSettings{
+		Quality:   defaultQuality,
+		Format:    defaultFormat,
+		MaxWidth:  req.MaxWidth,
+		MaxHeight: req.MaxHeight,
+	}
+
+	if q := req.Quality; q != nil {
+		if *q < 1 || *q > 100 {
+			return BatchSettings{}, errors.New(prefix + "quality must be between 1 and 100")
+		}
+		settings.Quality = *q
+	}
+
+	switch req.Format {
+	case "":
+	case "webp", "jpeg":
+		settings.Format = req.Format
+	default:
+		return BatchSettings{}, fmt.Errorf("Unsupported output format: '%s'. Supported formats: jpeg, webp", req.Format)
+	}
+	if req.Lossless && settings.Format != "webp" {
+		return BatchSettings{}, errors.New(prefix + "lossless is only supported for webp output")
+	}
+	settings.Lossless = req.Lossless
+
+	// Zero or omitted means no limit
+	if settings.MaxWidth < 0 || settings.MaxWidth > maxOutputDimension {
+		return BatchSettings{}, fmt.Errorf("%smax_width must be between 0 and %d", prefix, maxOutputDimension)
+	}
+	if settings.MaxHeight < 0 || settings.MaxHeight > maxOutputDimension {
+		return BatchSettings{}, fmt.Errorf("%smax_height must be between 0 and %d", prefix, maxOutputDimension)
+	}
+
+	return settings, nil
+}
+
+// validateImageURL requires an absolute http or https URL
+func validateImageURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// batchStatus summarises a batch from its image counts
+func batchStatus(total, completed, failed int) string {
+	switch {
+	case completed+failed < total && completed+failed > 0:
+		return statusProcessing
+	case completed+failed < total:
+		return statusPending
+	case failed == total:
+		return statusFailed
+	}
+	return statusCompleted
+}
+
+// CreateBatch stores a batch submitted with key and one pending row per image
+// URL, charging a credit for each image. callbackURL may be empty.
+func (pg *pgStore) CreateBatch(ctx context.Context, key *APIKey, imageURLs []string, settings BatchSettings, callbackURL string) (string, error) {
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := reserveCredits(ctx, tx, key.KeyHash, len(imageURLs)); err != nil {
+		return "", err
+	}
+
+	var callback *string
+	if callbackURL != "" {
+		callback = &callbackURL
+		// Create the signing secret now so it can be fetched before the
+		// first delivery arrives
+		if _, err := ensureWebhookSecret(ctx, tx, key.KeyHash); err != nil {
+			return "", err
+		}
+	}
+
+	var batchID string
+	err = tx.QueryRow(ctx, `
+		INSERT INTO batches (key_hash, user_email, quality, format, lossless, max_width, max_height, callback_url)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, key.KeyHash, key.Email, settings.Quality, settings.Format, settings.Lossless, settings.MaxWidth, settings.MaxHeight, callback).Scan(&batchID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO batch_images (batch_id, position, source_url)
+		SELECT $1, u.ord, u.url
+		FROM unnest($2::text[]) WITH ORDINALITY AS u(url, ord)
+	`, batchID, imageURLs)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO usage_ledger (key_hash, batch_id, image_id)
+		SELECT $1, batch_id, id FROM batch_images WHERE batch_id = $2
+	`, key.KeyHash, batchID)
+	if err != nil {
+		return "", err
+	}
+
+	return batchID, tx.Commit(ctx)
+}
+
+// GetBatchStatus loads one of email's batches and the status of each of its
+// images. Batches belong to the account rather than the key, so they stay
+// visible after the key is rotated.
+func (pg *pgStore) GetBatchStatus(ctx context.Context, email, batchID string) (batchStatusResponse, error) {
+	var exists bool
+	err := pg.pool.QueryRow(ctx, `SELECT true FROM batches WHERE id = $1 AND user_email = $2`, batchID, email).Scan(&exists)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return batchStatusResponse{}, errBatchNotFound
+	}
+	if err != nil {
+		return batchStatusResponse{}, err
+	}
+
+	return loadBatchStatus(ctx, pg.pool, batchID)
+}
+
+// dbRowsQuerier is a dbQuerier that can also return several rows
+type dbRowsQuerier interface {
+	dbQuerier
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// loadBatchStatus summarises a batch from the status of each of its images
+func loadBatchStatus(ctx context.Context, db dbRowsQuerier, batchID string) (batchStatusResponse, error) {
+	rows, err := db.Query(ctx, `
+		SELECT id, status, original_size, compressed_size, COALESCE(error, ''),
+			CASE WHEN output_key IS NOT NULL AND expires_at > now() THEN expires_at END
+		FROM batch_images
+		WHERE batch_id = $1
+		ORDER BY position
+	`, batchID)
+	if err != nil {
+		return batchStatusResponse{}, err
+	}
+	defer rows.Close()
+
+	resp := batchStatusResponse{BatchID: batchID, Images: []batchImage{}}
+	for rows.Next() {
+		var img batchImage
+		if err := rows.Scan(&img.ID, &img.Status, &img.OriginalSize, &img.CompressedSize, &img.Error, &img.ExpiresAt); err != nil {
+			return batchStatusResponse{}, err
+		}
+		if img.ExpiresAt != nil {
+			img.DownloadURL = downloadPath(img.ID)
+		}
+		switch img.Status {
+		case statusCompleted:
+			resp.Completed++
+		case statusFailed:
+			resp.Failed++
+		}
+		resp.Images = append(resp.Images, img)
+	}
+	if err := rows.Err(); err != nil {
+		return batchStatusResponse{}, err
+	}
+
+	resp.TotalImages = len(resp.Images)
+	resp.Status = batchStatus(resp.TotalImages, resp.Completed, resp.Failed)
+	return resp, nil
+}
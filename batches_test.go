@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateBatchRequest(t *testing.T) {
+	tooMany := make([]string, maxBatchImages+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("https://example.com/%d.jpg", i)
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		urls    []string
+		wantErr string
+	}{
+		{"no urls", `{"image_urls": []}`, nil, "image_urls must contain at least one URL"},
+		{"relative url", `{"image_urls": ["/photo.jpg"]}`, nil, "image_urls[0]: must be an absolute http or https URL"},
+		{"ftp url", `{"image_urls": ["ftp://example.com/a.jpg"]}`, nil, "image_urls[0]: must be an absolute http or https URL"},
+		{"quality too low", `{"image_urls": ["https://example.com/a.jpg"], "settings": {"quality": 0}}`, nil, "settings.quality must be between 1 and 100"},
+		{"quality too high", `{"image_urls": ["https://example.com/a.jpg"], "settings": {"quality": 101}}`, nil, "settings.quality must be between 1 and 100"},
+		{"unsupported format", `{"image_urls": ["https://example.com/a.jpg"], "settings": {"format": "png"}}`, nil, "Unsupported output format: 'png'. Supported formats: jpeg, webp"},
+		{"negative width", `{"image_urls": ["https://example.com/a.jpg"], "settings": {"max_width": -1}}`, nil, "settings.max_width must be between 0 and 16383"},
+		{"lossless jpeg", `{"image_urls": ["https://example.com/a.jpg"], "settings": {"format": "jpeg", "lossless": true}}`, nil, "settings.lossless is only supported for webp output"},
+		{"height too large", `{"image_urls": ["https://example.com/a.jpg"], "settings": {"max_height": 20000}}`, nil, "settings.max_height must be between 0 and 16383"},
+		{"too many urls", `{}`, tooMany, "image_urls must contain at most 1000 URLs"},
+		{"relative callback", `{"image_urls": ["https://example.com/a.jpg"], "callback_url": "/hooks"}`, nil, "callback_url: must be an absolute http or https URL"},
+		{"long callback", `{"image_urls": ["https://example.com/a.jpg"], "callback_url": "https://example.com/` + strings.Repeat("a", 2048) + `"}`, nil, "callback_url: must be at most 2048 characters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req createBatchRequest
+			if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+				t.Fatalf("Failed to decode test body: %v", err)
+			}
+			if tt.urls != nil {
+				req.ImageURLs = tt.urls
+			}
+
+			_, err := validateBatchRequest(&req)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateBatchRequestDefaults(t *testing.T) {
+	req := createBatchRequest{ImageURLs: []string{"https://example.com/a.jpg"}}
+
+	settings, err := validateBatchRequest(&req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	want := BatchSettings{Quality: 80, Format: "webp"}
+	if settings != want {
+		t.Errorf("Expected %+v, got %+v", want, settings)
+	}
+}
+
+func TestBatchStatusSummary(t *testing.T) {
+	tests := []struct {
+		total, completed, failed int
+		want                     string
+	}{
+		{3, 0, 0, "pending"},
+		{3, 1, 0, "processing"},
+		{3, 2, 1, "completed"},
+		{3, 3, 0, "completed"},
+		{3, 0, 3, "failed"},
+	}
+
+	for _, tt := range tests {
+		if got := batchStatus(tt.total, tt.completed, tt.failed); got != tt.want {
+			t.Errorf("batchStatus(%d, %d, %d): expected %q, got %q", tt.total, tt.completed, tt.failed, tt.want, got)
+		}
+	}
+}
+
+func TestCreateBatchRejectsInvalidRequests(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	apiKey := testAPIKey(t, server, "free", nil)
+
+	tooMany := make([]string, 101)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%q", fmt.Sprintf("https://example.com/%d.jpg", i))
+	}
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"malformed json", `{"image_urls": [`, "Invalid JSON request body"},
+		{"unsupported format", `{"image_urls": ["https://example.com/a.jpg"], "settings": {"format": "gif"}}`, "Unsupported output format: 'gif'. Supported formats: jpeg, webp"},
+		{"over plan batch limit", `{"image_urls": [` + strings.Join(tooMany, ",") + `]}`, "Your Free plan allows at most 100 images per batch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api/v1/batches", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+			var body apiError
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("Expected a JSON error body, got %q", w.Body.String())
+			}
+			if body.Error != tt.wantErr {
+				t.Errorf("Expected error %q, got %q", tt.wantErr, body.Error)
+			}
+		})
+	}
+}
+
+func TestBatchStatusRejectsInvalidID(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	apiKey := testAPIKey(t, server, "starter", nil)
+
+	req := httptest.NewRequest("GET", "/api/v1/batches/not-a-uuid/status", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"error":"Batch not found"`) {
+		t.Errorf("Expected batch not found error, got %q", w.Body.String())
+	}
+}
+
+func TestCreateBatchAndStatus(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	apiKey := storeAPIKey(t, store, "customer@example.com", "free")
+
+	body := `{"image_urls": ["https://example.com/a.jpg", "https://example.com/b.jpg"]}`
+	req := httptest.NewRequest("POST", "/api/v1/batches", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var created createBatchResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/batches/"+created.BatchID+"/status", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w = httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var status batchStatusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != statusPending || status.TotalImages != 2 {
+		t.Errorf("Expected 2 pending images, got %d %s", status.TotalImages, status.Status)
+	}
+
+	// Batches belong to the account that created them
+	other := storeAPIKey(t, store, "someone@example.com", "free")
+	req = httptest.NewRequest("GET", "/api/v1/batches/"+created.BatchID+"/status", nil)
+	req.Header.Set("Authorization", "Bearer "+other)
+	w = httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for another account, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestCreateBatchRejectsOverQuota(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	apiKey := storeAPIKey(t, store, "customer@example.com", "free")
+
+	free, _ := planByID("free")
+	for range free.Credits {
+		if _, err := store.ChargeCredit(context.Background(), hashToken(apiKey)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/batches", strings.NewReader(`{"image_urls": ["https://example.com/a.jpg"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPaymentRequired {
+		t.Errorf("Expected status %d, got %d", http.StatusPaymentRequired, w.Code)
+	}
+}
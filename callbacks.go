@@ -0,0 +1,717 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+
+	"github.com/devrewoh/devrewoh-portfolio/internal/fetch"
+)
+
+const (
+	// maxWebhookEndpoints is how many default endpoints a key can register
+	maxWebhookEndpoints = 5
+
+	maxWebhookAttempts  = 8
+	webhookTimeout      = 10 * time.Second
+	webhookPollInterval = 2 * time.Second
+	webhookWorkers      = 2
+
+	// webhookLease is how long a claimed delivery is hidden from other
+	// dispatchers; if its instance dies it is retried after this
+	webhookLease = time.Minute
+
+	webhookUserAgent = "GoTiny-Webhooks/1.0 (+https://devrewoh.com/compress/docs)"
+)
+
+// Batch webhook event types
+const (
+	eventBatchCompleted = "batch.completed"
+	eventBatchFailed    = "batch.failed"
+)
+
+// Delivery statuses; a pending delivery is waiting for its next attempt
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+var (
+	errEndpointNotFound = errors.New("webhook endpoint not found")
+	errDeliveryNotFound = errors.New("webhook delivery not found")
+	errTooManyEndpoints = fmt.Errorf("a key can have at most %d webhook endpoints", maxWebhookEndpoints)
+)
+
+// batchEvent is the JSON body POSTed to webhook endpoints
+type batchEvent struct {
+	ID        string              `json:"id"`
+	Type      string              `json:"type"`
+	CreatedAt time.Time           `json:"created_at"`
+	Data      batchStatusResponse `json:"data"`
+}
+
+// webhookEndpoint is a URL that receives events for every batch created with a key
+type webhookEndpoint struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type webhookEndpointsResponse struct {
+	SigningSecret string            `json:"signing_secret"`
+	Endpoints     []webhookEndpoint `json:"endpoints"`
+}
+
+// webhookAttempt is one try at sending a delivery
+type webhookAttempt struct {
+	Attempt    int       `json:"attempt"`
+	StatusCode *int      `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int       `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// webhookDelivery is one event sent to one URL, and its attempts so far
+type webhookDelivery struct {
+	ID             string           `json:"id"`
+	EventID        string           `json:"event_id"`
+	EventType      string           `json:"event_type"`
+	BatchID        string           `json:"batch_id"`
+	URL            string           `json:"url"`
+	Status         string           `json:"status"`
+	Attempts       int              `json:"attempts"`
+	NextAttemptAt  *time.Time       `json:"next_attempt_at,omitempty"`
+	LastStatusCode *int             `json:"last_status_code,omitempty"`
+	LastError      string           `json:"last_error,omitempty"`
+	DeliveredAt    *time.Time       `json:"delivered_at,omitempty"`
+	CreatedAt      time.Time        `json:"created_at"`
+	AttemptLog     []webhookAttempt `json:"attempt_log"`
+}
+
+type webhookDeliveriesResponse struct {
+	Deliveries []webhookDelivery `json:"deliveries"`
+}
+
+// webhookJob is a delivery claimed by a dispatcher
+type webhookJob struct {
+	ID        string
+	EventType string
+	URL       string
+	Payload   []byte
+	Secret    string
+	Attempts  int
+}
+
+// webhookResult is the outcome of one delivery attempt
+type webhookResult struct {
+	StatusCode int
+	Err        error
+	Duration   time.Duration
+}
+
+func (r webhookResult) ok() bool {
+	return r.Err == nil && r.StatusCode >= 200 && r.StatusCode < 300
+}
+
+type createWebhookRequest struct {
+	URL string `json:"url"`
+}
+
+func (s *Server) handleListWebhooks(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	resp, err := s.store.ListWebhookEndpoints(r.Context(), key.KeyHash)
+	if err != nil {
+		s.logger.Error("failed to list webhook endpoints", "key_prefix", key.KeyPrefix, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load webhook endpoints")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	var req createWebhookRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<10)).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Invalid JSON request body")
+		return
+	}
+	if err := validateCallbackURL(req.URL); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "url: "+err.Error())
+		return
+	}
+
+	endpoint, err := s.store.CreateWebhookEndpoint(r.Context(), key.KeyHash, req.URL)
+	if errors.Is(err, errTooManyEndpoints) {
+		writeAPIError(w, http.StatusConflict, "You can register at most "+strconv.Itoa(maxWebhookEndpoints)+" webhook endpoints per API key")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to create webhook endpoint", "key_prefix", key.KeyPrefix, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to create webhook endpoint")
+		return
+	}
+
+	s.logger.Info("webhook endpoint created", "key_prefix", key.KeyPrefix, "endpoint_id", endpoint.ID)
+	writeJSON(w, http.StatusCreated, endpoint)
+}
+
+func (s *Server) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	endpointID := chi.URLParam(r, "endpointID")
+	if !uuidPattern.MatchString(endpointID) {
+		writeAPIError(w, http.StatusNotFound, "Webhook endpoint not found")
+		return
+	}
+
+	err := s.store.DeleteWebhookEndpoint(r.Context(), key.KeyHash, endpointID)
+	if errors.Is(err, errEndpointNotFound) {
+		writeAPIError(w, http.StatusNotFound, "Webhook endpoint not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to delete webhook endpoint", "endpoint_id", endpointID, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to delete webhook endpoint")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	batchID := r.URL.Query().Get("batch_id")
+	if batchID != "" && !uuidPattern.MatchString(batchID) {
+		writeAPIError(w, http.StatusBadRequest, "batch_id must be a batch ID")
+		return
+	}
+
+	deliveries, err := s.store.ListWebhookDeliveries(r.Context(), key.Email, batchID)
+	if err != nil {
+		s.logger.Error("failed to list webhook deliveries", "key_prefix", key.KeyPrefix, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load webhook deliveries")
+		return
+	}
+	writeJSON(w, http.StatusOK, webhookDeliveriesResponse{Deliveries: deliveries})
+}
+
+// handleRedeliver queues a fresh copy of a delivery, so the original keeps
+// its attempt log
+func (s *Server) handleRedeliver(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	deliveryID := chi.URLParam(r, "deliveryID")
+	if !uuidPattern.MatchString(deliveryID) {
+		writeAPIError(w, http.StatusNotFound, "Webhook delivery not found")
+		return
+	}
+
+	delivery, err := s.store.RedeliverWebhook(r.Context(), key.Email, deliveryID)
+	if errors.Is(err, errDeliveryNotFound) {
+		writeAPIError(w, http.StatusNotFound, "Webhook delivery not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to redeliver webhook", "delivery_id", deliveryID, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to redeliver webhook")
+		return
+	}
+
+	s.logger.Info("webhook redelivery queued", "delivery_id", delivery.ID, "original_id", deliveryID)
+	writeJSON(w, http.StatusAccepted, delivery)
+}
+
+// validateCallbackURL requires an absolute http or https URL. Whether it
+// points somewhere we are allowed to send to is checked at delivery time,
+// since DNS can change in between.
+func validateCallbackURL(raw string) error {
+	if len(raw) > 2048 {
+		return errors.New("must be at most 2048 characters")
+	}
+	return validateImageURL(raw)
+}
+
+// newWebhookSecret returns a random signing secret
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// newEventID returns a random event ID, shared by every delivery of one event
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "evt_" + hex.EncodeToString(b), nil
+}
+
+// signWebhook returns the GoTiny-Signature header for payload sent at t: the
+// timestamp and an HMAC-SHA256 of "timestamp.payload". Receivers should
+// reject old timestamps to stop replays.
+func signWebhook(secret string, payload []byte, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is the delay before retrying a delivery that failed on the
+// given attempt: one minute, doubling up to six hours
+func webhookBackoff(attempt int) time.Duration {
+	if attempt > 10 {
+		return 6 * time.Hour
+	}
+	return min(time.Minute<<(attempt-1), 6*time.Hour)
+}
+
+// newWebhookFetcher returns the client for webhook deliveries. Endpoints are
+// customer-controlled, so they get the same address checks as image URLs, and
+// redirects aren't followed.
+func newWebhookFetcher(opts ...fetch.Option) *fetch.Fetcher {
+	return fetch.New(append([]fetch.Option{
+		fetch.WithTimeout(webhookTimeout),
+		fetch.WithMaxRedirects(0),
+		fetch.WithUserAgent(webhookUserAgent),
+	}, opts...)...)
+}
+
+// sendWebhook makes one signed delivery attempt
+func sendWebhook(ctx context.Context, fetcher *fetch.Fetcher, job *webhookJob) webhookResult {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.URL, bytes.NewReader(job.Payload))
+	if err != nil {
+		return webhookResult{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("GoTiny-Event", job.EventType)
+	req.Header.Set("GoTiny-Delivery", job.ID)
+	req.Header.Set("GoTiny-Signature", signWebhook(job.Secret, job.Payload, start))
+
+	resp, err := fetcher.Do(req)
+	if err != nil {
+		return webhookResult{Err: err, Duration: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	res := webhookResult{StatusCode: resp.StatusCode, Duration: time.Since(start)}
+	if !res.ok() {
+		res.Err = fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return res
+}
+
+// runWebhooks sends due deliveries until claimCtx is cancelled. Cancelling
+// sendCtx aborts a send in progress; its lease then expires and it is retried.
+func (p *WorkerPool) runWebhooks(claimCtx, sendCtx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		job, err := p.store.ClaimWebhookDelivery(claimCtx)
+		if claimCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.logger.Error("failed to claim webhook delivery", "error", err)
+		}
+		if job == nil {
+			select {
+			case <-claimCtx.Done():
+				return
+			case <-time.After(webhookPollInterval):
+			}
+			continue
+		}
+
+		res := sendWebhook(sendCtx, p.webhooks, job)
+		if sendCtx.Err() != nil {
+			return
+		}
+
+		dbCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		retry := !res.ok() && job.Attempts < maxWebhookAttempts
+		if err := p.store.RecordWebhookAttempt(dbCtx, job, res, retry, webhookBackoff(job.Attempts)); err != nil {
+			p.logger.Error("failed to record webhook attempt", "delivery_id", job.ID, "error", err)
+		}
+		cancel()
+
+		if res.ok() {
+			p.logger.Info("webhook delivered", "delivery_id", job.ID, "status", res.StatusCode)
+		} else {
+			p.logger.Warn("webhook delivery failed", "delivery_id", job.ID, "attempt", job.Attempts, "retry", retry, "error", res.Err)
+		}
+	}
+}
+
+// FinishBatch marks a batch finished once none of its images are left to
+// process, and queues its webhook deliveries. Only the caller that finishes
+// the batch sees true, so each event is queued once.
+func (pg *pgStore) FinishBatch(ctx context.Context, batchID string) (bool, error) {
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var keyHash string
+	var callbackURL *string
+	err = tx.QueryRow(ctx, `
+		UPDATE batches SET finished_at = now()
+		WHERE id = $1 AND finished_at IS NULL
+			AND NOT EXISTS (
+				SELECT 1 FROM batch_images
+				WHERE batch_id = $1 AND status IN ('pending', 'processing')
+			)
+		RETURNING key_hash, callback_url
+	`, batchID).Scan(&keyHash, &callbackURL)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	var urls []string
+	if callbackURL != nil {
+		urls = append(urls, *callbackURL)
+	}
+	rows, err := tx.Query(ctx, `SELECT url FROM webhook_endpoints WHERE key_hash = $1 ORDER BY created_at`, keyHash)
+	if err != nil {
+		return false, err
+	}
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			rows.Close()
+			return false, err
+		}
+		urls = append(urls, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	if len(urls) > 0 {
+		status, err := loadBatchStatus(ctx, tx, batchID)
+		if err != nil {
+			return false, err
+		}
+		event, payload, err := newBatchEvent(status)
+		if err != nil {
+			return false, err
+		}
+
+		_, err = tx.Exec(ctx, `
+			INSERT INTO webhook_deliveries (event_id, event_type, batch_id, key_hash, url, payload)
+			SELECT $1, $2, $3, $4, u.url, $6
+			FROM unnest($5::text[]) AS u(url)
+		`, event.ID, event.Type, batchID, keyHash, urls, string(payload))
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, tx.Commit(ctx)
+}
+
+// newBatchEvent builds the event for a finished batch and its JSON payload
+func newBatchEvent(status batchStatusResponse) (batchEvent, []byte, error) {
+	eventID, err := newEventID()
+	if err != nil {
+		return batchEvent{}, nil, err
+	}
+	event := batchEvent{ID: eventID, Type: eventBatchCompleted, CreatedAt: time.Now().UTC(), Data: status}
+	if status.Status == statusFailed {
+		event.Type = eventBatchFailed
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return batchEvent{}, nil, err
+	}
+	return event, payload, nil
+}
+
+// ClaimWebhookDelivery leases the next due delivery, or returns nil when
+// none are due
+func (pg *pgStore) ClaimWebhookDelivery(ctx context.Context) (*webhookJob, error) {
+	query := `
+		WITH next AS (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE webhook_deliveries AS d
+		SET attempts = d.attempts + 1, next_attempt_at = now() + $1::interval, updated_at = now()
+		FROM next, api_keys AS k
+		WHERE d.id = next.id AND k.key_hash = d.key_hash
+		RETURNING d.id, d.event_type, d.url, d.payload, COALESCE(k.webhook_secret, ''), d.attempts
+	`
+
+	var job webhookJob
+	var payload string
+	err := pg.pool.QueryRow(ctx, query, webhookLease.String()).Scan(
+		&job.ID, &job.EventType, &job.URL, &payload, &job.Secret, &job.Attempts,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	job.Payload = []byte(payload)
+	return &job, nil
+}
+
+// RecordWebhookAttempt logs an attempt and settles the delivery: succeeded,
+// rescheduled after backoff, or failed for good
+func (pg *pgStore) RecordWebhookAttempt(ctx context.Context, job *webhookJob, res webhookResult, retry bool, backoff time.Duration) error {
+	var statusCode *int
+	if res.StatusCode != 0 {
+		statusCode = &res.StatusCode
+	}
+	var message *string
+	if res.Err != nil {
+		m := res.Err.Error()
+		message = &m
+	}
+
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, duration_ms)
+		VALUES ($1, $2, $3, $4, $5)
+	`, job.ID, job.Attempts, statusCode, message, res.Duration.Milliseconds())
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case res.ok():
+		_, err = tx.Exec(ctx, `
+			UPDATE webhook_deliveries
+			SET status = 'succeeded', last_status_code = $2, last_error = NULL,
+				delivered_at = now(), updated_at = now()
+			WHERE id = $1
+		`, job.ID, statusCode)
+	case retry:
+		_, err = tx.Exec(ctx, `
+			UPDATE webhook_deliveries
+			SET last_status_code = $2, last_error = $3, next_attempt_at = now() + $4::interval, updated_at = now()
+			WHERE id = $1
+		`, job.ID, statusCode, message, backoff.String())
+	default:
+		_, err = tx.Exec(ctx, `
+			UPDATE webhook_deliveries
+			SET status = 'failed', last_status_code = $2, last_error = $3, updated_at = now()
+			WHERE id = $1
+		`, job.ID, statusCode, message)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ensureWebhookSecret returns the key's signing secret, creating it on first use
+func ensureWebhookSecret(ctx context.Context, db dbQuerier, keyHash string) (string, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return "", err
+	}
+	err = db.QueryRow(ctx, `
+		UPDATE api_keys SET webhook_secret = COALESCE(webhook_secret, $2)
+		WHERE key_hash = $1
+		RETURNING webhook_secret
+	`, keyHash, secret).Scan(&secret)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", errUnknownAPIKey
+	}
+	return secret, err
+}
+
+// ListWebhookEndpoints returns the key's signing secret and default endpoints
+func (pg *pgStore) ListWebhookEndpoints(ctx context.Context, keyHash string) (webhookEndpointsResponse, error) {
+	secret, err := ensureWebhookSecret(ctx, pg.pool, keyHash)
+	if err != nil {
+		return webhookEndpointsResponse{}, err
+	}
+
+	rows, err := pg.pool.Query(ctx, `
+		SELECT id, url, created_at FROM webhook_endpoints
+		WHERE key_hash = $1
+		ORDER BY created_at
+	`, keyHash)
+	if err != nil {
+		return webhookEndpointsResponse{}, err
+	}
+	defer rows.Close()
+
+	resp := webhookEndpointsResponse{SigningSecret: secret, Endpoints: []webhookEndpoint{}}
+	for rows.Next() {
+		var e webhookEndpoint
+		if err := rows.Scan(&e.ID, &e.URL, &e.CreatedAt); err != nil {
+			return webhookEndpointsResponse{}, err
+		}
+		resp.Endpoints = append(resp.Endpoints, e)
+	}
+	return resp, rows.Err()
+}
+
+// CreateWebhookEndpoint registers a default endpoint for the key
+func (pg *pgStore) CreateWebhookEndpoint(ctx context.Context, keyHash, url string) (webhookEndpoint, error) {
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return webhookEndpoint{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Locks the key row, so concurrent requests can't both pass the limit
+	if _, err := ensureWebhookSecret(ctx, tx, keyHash); err != nil {
+		return webhookEndpoint{}, err
+	}
+
+	var count int
+	if err := tx.QueryRow(ctx, `SELECT count(*) FROM webhook_endpoints WHERE key_hash = $1`, keyHash).Scan(&count); err != nil {
+		return webhookEndpoint{}, err
+	}
+	if count >= maxWebhookEndpoints {
+		return webhookEndpoint{}, errTooManyEndpoints
+	}
+
+	e := webhookEndpoint{URL: url}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO webhook_endpoints (key_hash, url) VALUES ($1, $2)
+		RETURNING id, created_at
+	`, keyHash, url).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		return webhookEndpoint{}, err
+	}
+	return e, tx.Commit(ctx)
+}
+
+// DeleteWebhookEndpoint removes one of the key's default endpoints
+func (pg *pgStore) DeleteWebhookEndpoint(ctx context.Context, keyHash, id string) error {
+	tag, err := pg.pool.Exec(ctx, `DELETE FROM webhook_endpoints WHERE id = $1 AND key_hash = $2`, id, keyHash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errEndpointNotFound
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns the account's 50 most recent deliveries, or
+// those of one batch, with their attempts
+func (pg *pgStore) ListWebhookDeliveries(ctx context.Context, email, batchID string) ([]webhookDelivery, error) {
+	rows, err := pg.pool.Query(ctx, `
+		SELECT d.id, d.event_id, d.event_type, d.batch_id, d.url, d.status, d.attempts,
+			CASE WHEN d.status = 'pending' THEN d.next_attempt_at END,
+			d.last_status_code, COALESCE(d.last_error, ''), d.delivered_at, d.created_at
+		FROM webhook_deliveries AS d
+		JOIN batches AS b ON b.id = d.batch_id
+		WHERE b.user_email = $1 AND ($2 = '' OR d.batch_id::text = $2)
+		ORDER BY d.created_at DESC
+		LIMIT 50
+	`, email, batchID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []webhookDelivery{}
+	index := make(map[string]int)
+	var ids []string
+	for rows.Next() {
+		var d webhookDelivery
+		err := rows.Scan(&d.ID, &d.EventID, &d.EventType, &d.BatchID, &d.URL, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.DeliveredAt, &d.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		d.AttemptLog = []webhookAttempt{}
+		index[d.ID] = len(deliveries)
+		ids = append(ids, d.ID)
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return deliveries, nil
+	}
+
+	rows, err = pg.pool.Query(ctx, `
+		SELECT delivery_id, attempt, status_code, COALESCE(error, ''), duration_ms, created_at
+		FROM webhook_attempts
+		WHERE delivery_id = ANY($1::uuid[])
+		ORDER BY attempt
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var a webhookAttempt
+		if err := rows.Scan(&id, &a.Attempt, &a.StatusCode, &a.Error, &a.DurationMS, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		d := &deliveries[index[id]]
+		d.AttemptLog = append(d.AttemptLog, a)
+	}
+	return deliveries, rows.Err()
+}
+
+// RedeliverWebhook queues a new delivery with the same event and URL as one
+// of the account's deliveries
+func (pg *pgStore) RedeliverWebhook(ctx context.Context, email, deliveryID string) (webhookDelivery, error) {
+	d := webhookDelivery{Status: deliveryPending, AttemptLog: []webhookAttempt{}}
+	err := pg.pool.QueryRow(ctx, `
+		INSERT INTO webhook_deliveries (event_id, event_type, batch_id, key_hash, url, payload)
+		SELECT d.event_id, d.event_type, d.batch_id, d.key_hash, d.url, d.payload
+		FROM webhook_deliveries AS d
+		JOIN batches AS b ON b.id = d.batch_id
+		WHERE d.id = $1 AND b.user_email = $2
+		RETURNING id, event_id, event_type, batch_id, url, next_attempt_at, created_at
+	`, deliveryID, email).Scan(&d.ID, &d.EventID, &d.EventType, &d.BatchID, &d.URL, &d.NextAttemptAt, &d.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return webhookDelivery{}, errDeliveryNotFound
+	}
+	if err != nil {
+		return webhookDelivery{}, err
+	}
+	return d, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devrewoh/devrewoh-portfolio/internal/fetch"
+)
+
+func TestSignWebhook(t *testing.T) {
+	payload := []byte(`{"id":"evt_1"}`)
+	ts := time.Unix(1760616000, 0)
+
+	got := signWebhook("whsec_test", payload, ts)
+
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(`1760616000.{"id":"evt_1"}`))
+	want := "t=1760616000,v1=" + hex.EncodeToString(mac.Sum(nil))
+	if got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+	if other := signWebhook("whsec_other", payload, ts); other == got {
+		t.Error("Expected a different secret to give a different signature")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{5, 16 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{50, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempt); got != tt.want {
+			t.Errorf("webhookBackoff(%d): expected %s, got %s", tt.attempt, tt.want, got)
+		}
+	}
+}
+
+func TestNewWebhookSecret(t *testing.T) {
+	a, err := newWebhookSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newWebhookSecret()
+	if !strings.HasPrefix(a, "whsec_") || len(a) != len("whsec_")+64 {
+		t.Errorf("Expected a whsec_ secret with 64 hex characters, got %q", a)
+	}
+	if a == b {
+		t.Error("Expected secrets to be random")
+	}
+}
+
+func TestSendWebhook(t *testing.T) {
+	var gotHeader http.Header
+	var gotBody []byte
+	status := http.StatusNoContent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Clone()
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	fetcher := newWebhookFetcher(fetch.AllowLoopback())
+	job := &webhookJob{
+		ID:        "d1",
+		EventType: eventBatchCompleted,
+		URL:       srv.URL + "/hooks",
+		Payload:   []byte(`{"id":"evt_1"}`),
+		Secret:    "whsec_test",
+	}
+
+	res := sendWebhook(context.Background(), fetcher, job)
+	if !res.ok() {
+		t.Fatalf("Expected delivery to succeed, got %d %v", res.StatusCode, res.Err)
+	}
+	if string(gotBody) != `{"id":"evt_1"}` {
+		t.Errorf("Expected the payload as the body, got %q", gotBody)
+	}
+	if gotHeader.Get("GoTiny-Event") != eventBatchCompleted || gotHeader.Get("GoTiny-Delivery") != "d1" {
+		t.Errorf("Expected event and delivery headers, got %v", gotHeader)
+	}
+	if gotHeader.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected Content-Type application/json, got %q", gotHeader.Get("Content-Type"))
+	}
+
+	// The receiver can verify the signature with the shared secret
+	sig := gotHeader.Get("GoTiny-Signature")
+	ts, _, _ := strings.Cut(strings.TrimPrefix(sig, "t="), ",")
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write([]byte(ts + "."))
+	mac.Write(gotBody)
+	if !strings.HasSuffix(sig, ",v1="+hex.EncodeToString(mac.Sum(nil))) {
+		t.Errorf("Expected a verifiable signature, got %q", sig)
+	}
+
+	status = http.StatusInternalServerError
+	res = sendWebhook(context.Background(), fetcher, job)
+	if res.ok() || res.StatusCode != http.StatusInternalServerError || res.Err == nil {
+		t.Errorf("Expected a 500 to fail the attempt, got %d %v", res.StatusCode, res.Err)
+	}
+}
+
+func TestSendWebhookDoesNotFollowRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	}))
+	defer srv.Close()
+
+	job := &webhookJob{ID: "d1", EventType: eventBatchCompleted, URL: srv.URL, Payload: []byte("{}"), Secret: "s"}
+	res := sendWebhook(context.Background(), newWebhookFetcher(fetch.AllowLoopback()), job)
+	if res.ok() {
+		t.Error("Expected a redirect to fail the attempt")
+	}
+}
+
+func TestSendWebhookBlocksInternalAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected no request to reach a loopback address")
+	}))
+	defer srv.Close()
+
+	job := &webhookJob{ID: "d1", EventType: eventBatchCompleted, URL: srv.URL, Payload: []byte("{}"), Secret: "s"}
+	res := sendWebhook(context.Background(), newWebhookFetcher(), job)
+	if !errors.Is(res.Err, fetch.ErrBlockedAddress) {
+		t.Errorf("Expected ErrBlockedAddress, got %v", res.Err)
+	}
+}
+
+func TestWebhookHandlersRejectInvalidRequests(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	apiKey := testAPIKey(t, server, "starter", nil)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		status  int
+		wantErr string
+	}{
+		{"invalid json", "POST", "/api/v1/webhooks", `{`, http.StatusBadRequest, "Invalid JSON request body"},
+		{"missing url", "POST", "/api/v1/webhooks", `{}`, http.StatusBadRequest, "url: must be an absolute http or https URL"},
+		{"ftp url", "POST", "/api/v1/webhooks", `{"url": "ftp://example.com/hooks"}`, http.StatusBadRequest, "url: must be an absolute http or https URL"},
+		{"invalid endpoint id", "DELETE", "/api/v1/webhooks/abc", "", http.StatusNotFound, "Webhook endpoint not found"},
+		{"invalid batch filter", "GET", "/api/v1/webhooks/deliveries?batch_id=abc", "", http.StatusBadRequest, "batch_id must be a batch ID"},
+		{"invalid delivery id", "POST", "/api/v1/webhooks/deliveries/abc/redeliver", "", http.StatusNotFound, "Webhook delivery not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), `"error":"`+tt.wantErr+`"`) {
+				t.Errorf("Expected error %q, got %q", tt.wantErr, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWebhookEndpointLimit(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	apiKey := storeAPIKey(t, store, "customer@example.com", "starter")
+
+	create := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/webhooks", strings.NewReader(`{"url": "https://example.com/hooks"}`))
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+		return w
+	}
+
+	for range maxWebhookEndpoints {
+		if w := create(); w.Code != http.StatusCreated {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+		}
+	}
+	if w := create(); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d past the limit, got %d", http.StatusConflict, w.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/webhooks", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), `"signing_secret":"whsec_`) {
+		t.Errorf("Expected the signing secret, got %q", w.Body.String())
+	}
+}
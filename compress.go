@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devrewoh/devrewoh-portfolio/internal/fetch"
+	"github.com/devrewoh/devrewoh-portfolio/internal/imaging"
+)
+
+const (
+	// maxUploadBodyBytes leaves room for the multipart framing and form
+	// fields around a maximum-size image
+	maxUploadBodyBytes = maxSourceImageBytes + 1<<20
+
+	// uploadMemoryBytes is how much of a multipart upload is buffered in
+	// memory before the rest spills to a temporary file
+	uploadMemoryBytes = 8 << 20
+
+	// uploadRetryAfter is the Retry-After sent when every upload slot is busy
+	uploadRetryAfter = "5"
+
+	// uploadTimeout replaces the server's read and write timeouts for an
+	// upload, which leave too little time to receive 25 MB over a slow
+	// connection and compress it
+	uploadTimeout = 2 * time.Minute
+
+	// uploadWriteTimeout is how long sending the compressed image may take
+	uploadWriteTimeout = time.Minute
+
+	// uploadBudgetWait is how long an upload waits for the pixel budget
+	// shared with the batch workers before it is turned away
+	uploadBudgetWait = 10 * time.Second
+)
+
+// upload is an image submitted directly to /compress
+type upload struct {
+	data     []byte
+	filename string
+}
+
+// uploadError is a rejected upload and the status to report it with
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string { return e.message }
+
+var errUploadTooLarge = &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Image is larger than %d MB", maxSourceImageBytes>>20)}
+
+// handleCompressImage compresses one uploaded image synchronously and returns
+// it as the response body. The image is charged like a batch image and
+// refunded if it can't be processed or sent. A body can be 25 MB, so only as
+// many uploads are read at once as there are workers; the rest are turned
+// away before their body is read rather than queued. Decoding then shares the
+// workers' pixel budget.
+func (s *Server) handleCompressImage(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	select {
+	case s.uploads <- struct{}{}:
+		defer func() { <-s.uploads }()
+	default:
+		w.Header().Set("Retry-After", uploadRetryAfter)
+		writeAPIError(w, http.StatusServiceUnavailable, "Too many images are being compressed. Retry after the time in the Retry-After header")
+		return
+	}
+
+	// Not every ResponseWriter supports deadlines; those that don't have no
+	// server timeouts to extend
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(uploadTimeout))
+	rc.SetWriteDeadline(time.Now().Add(uploadTimeout))
+
+	up, err := readUpload(w, r)
+	var upErr *uploadError
+	if errors.As(err, &upErr) {
+		writeAPIError(w, upErr.status, upErr.message)
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "Failed to read request body")
+		return
+	}
+
+	settings, err := compressSettings(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ledgerID, err := s.store.ChargeCredit(r.Context(), key.KeyHash)
+	var quotaErr *quotaError
+	if errors.As(err, &quotaErr) {
+		writeAPIError(w, http.StatusPaymentRequired, quotaErr.Error())
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to charge credit", "key_prefix", key.KeyPrefix, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to compress image")
+		return
+	}
+
+	refund := func() {
+		// Refund even if the client has gone away
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+		defer cancel()
+		if err := s.store.RefundCredit(ctx, ledgerID); err != nil {
+			s.logger.Error("failed to refund credit", "ledger_id", ledgerID, "error", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), uploadBudgetWait)
+	compressed, err := s.workers.compressImage(ctx, up.data, settings)
+	cancel()
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		refund()
+		w.Header().Set("Retry-After", uploadRetryAfter)
+		writeAPIError(w, http.StatusServiceUnavailable, "Too many images are being compressed. Retry after the time in the Retry-After header")
+		return
+	}
+	if err != nil {
+		refund()
+
+		status, message := http.StatusUnprocessableEntity, "Could not process image: "+err.Error()
+		if errors.Is(err, imaging.ErrUnsupportedFormat) {
+			status, message = http.StatusUnsupportedMediaType, "Unsupported image format. Supported formats: jpeg, png, gif, webp"
+		}
+		writeAPIError(w, status, message)
+		return
+	}
+
+	filename := strings.TrimSuffix(up.filename, path.Ext(up.filename)) + outputExtension(settings.Format)
+
+	w.Header().Set("Content-Type", outputContentType(settings.Format))
+	w.Header().Set("Content-Length", strconv.Itoa(len(compressed)))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Original-Size", strconv.Itoa(len(up.data)))
+	w.Header().Set("X-Compressed-Size", strconv.Itoa(len(compressed)))
+	rc.SetWriteDeadline(time.Now().Add(uploadWriteTimeout))
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(compressed); err != nil {
+		// The client never got the image, so don't charge for it
+		refund()
+		s.logger.Warn("failed to send compressed image", "key_prefix", key.KeyPrefix, "error", err)
+		return
+	}
+
+	s.logger.Info("image compressed", "key_prefix", key.KeyPrefix,
+		"original_size", len(up.data), "compressed_size", len(compressed))
+}
+
+// readUpload reads the image from a multipart "image" field or from a raw
+// image/* request body
+func readUpload(w http.ResponseWriter, r *http.Request) (*upload, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBodyBytes)
+
+	var up upload
+	switch {
+	case mediaType == "multipart/form-data":
+		if err := r.ParseMultipartForm(uploadMemoryBytes); err != nil {
+			if errors.As(err, new(*http.MaxBytesError)) {
+				return nil, errUploadTooLarge
+			}
+			return nil, &uploadError{http.StatusBadRequest, "Invalid multipart request body"}
+		}
+		file, header, err := r.FormFile("image")
+		if err != nil {
+			return nil, &uploadError{http.StatusBadRequest, `Multipart requests must include the image in an "image" file field`}
+		}
+		defer file.Close()
+		if header.Size > maxSourceImageBytes {
+			return nil, errUploadTooLarge
+		}
+		if up.data, err = io.ReadAll(file); err != nil {
+			return nil, err
+		}
+		up.filename = path.Base(header.Filename)
+
+	case strings.HasPrefix(mediaType, "image/"):
+		if r.ContentLength > maxSourceImageBytes {
+			return nil, errUploadTooLarge
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxSourceImageBytes+1))
+		if errors.As(err, new(*http.MaxBytesError)) || len(data) > maxSourceImageBytes {
+			return nil, errUploadTooLarge
+		}
+		if err != nil {
+			return nil, err
+		}
+		up.data = data
+
+	default:
+		return nil, &uploadError{http.StatusUnsupportedMediaType, "Content-Type must be multipart/form-data or image/*"}
+	}
+
+	if len(up.data) == 0 {
+		return nil, &uploadError{http.StatusBadRequest, "Image is empty"}
+	}
+	// Go by the bytes rather than the declared type, as batch downloads do
+	if !slices.Contains(fetch.ImageTypes, http.DetectContentType(up.data)) {
+		return nil, &uploadError{http.StatusUnsupportedMediaType, "Unsupported image format. Supported formats: jpeg, png, gif, webp"}
+	}
+	if up.filename == "" || up.filename == "." || up.filename == "/" {
+		up.filename = "image"
+	}
+	return &up, nil
+}
+
+// compressSettings reads the settings from query parameters or form fields,
+// which take the same names as batch settings
+func compressSettings(r *http.Request) (BatchSettings, error) {
+	var req settingsRequest
+	req.Format = r.FormValue("format")
+
+	if v := r.FormValue("quality"); v != "" {
+		q, err := strconv.Atoi(v)
+		if err != nil {
+			return BatchSettings{}, errors.New("quality must be between 1 and 100")
+		}
+		req.Quality = &q
+	}
+	if v := r.FormValue("lossless"); v != "" {
+		lossless, err := strconv.ParseBool(v)
+		if err != nil {
+			return BatchSettings{}, errors.New("lossless must be true or false")
+		}
+		req.Lossless = lossless
+	}
+	for _, f := range []struct {
+		name string
+		dst  *int
+	}{{"max_width", &req.MaxWidth}, {"max_height", &req.MaxHeight}} {
+		if v := r.FormValue(f.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return BatchSettings{}, fmt.Errorf("%s must be between 0 and %d", f.name, maxOutputDimension)
+			}
+			*f.dst = n
+		}
+	}
+
+	return validateSettings(req, "")
+}
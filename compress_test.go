@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// multipartBody builds a multipart request body with the given fields and,
+// if data is non-nil, an image file field
+func multipartBody(t *testing.T, field string, data []byte, fields map[string]string) (string, *bytes.Buffer) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	if data != nil {
+		fw, err := mw.CreateFormFile(field, "photo.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	mw.Close()
+	return mw.FormDataContentType(), &buf
+}
+
+func TestCompressImageRejectsInvalidRequests(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	apiKey := testAPIKey(t, server, "starter", nil)
+	img := testPNG(t)
+
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		body        func() (string, *bytes.Buffer)
+		status      int
+		wantErr     string
+	}{
+		{
+			name:        "json body",
+			contentType: "application/json",
+			body:        func() (string, *bytes.Buffer) { return "", bytes.NewBufferString(`{}`) },
+			status:      http.StatusUnsupportedMediaType,
+			wantErr:     "Content-Type must be multipart/form-data or image/*",
+		},
+		{
+			name:        "raw body that isn't an image",
+			contentType: "image/png",
+			body:        func() (string, *bytes.Buffer) { return "", bytes.NewBufferString("<html></html>") },
+			status:      http.StatusUnsupportedMediaType,
+			wantErr:     "Unsupported image format. Supported formats: jpeg, png, gif, webp",
+		},
+		{
+			name:        "empty raw body",
+			contentType: "image/png",
+			body:        func() (string, *bytes.Buffer) { return "", &bytes.Buffer{} },
+			status:      http.StatusBadRequest,
+			wantErr:     "Image is empty",
+		},
+		{
+			name:        "raw body too large",
+			contentType: "image/png",
+			body: func() (string, *bytes.Buffer) {
+				return "", bytes.NewBuffer(append(img, make([]byte, maxSourceImageBytes)...))
+			},
+			status:  http.StatusRequestEntityTooLarge,
+			wantErr: "Image is larger than 25 MB",
+		},
+		{
+			name:    "multipart without image field",
+			body:    func() (string, *bytes.Buffer) { return multipartBody(t, "file", img, nil) },
+			status:  http.StatusBadRequest,
+			wantErr: `Multipart requests must include the image in an "image" file field`,
+		},
+		{
+			name:    "bad quality in query",
+			query:   "?quality=high",
+			body:    func() (string, *bytes.Buffer) { return multipartBody(t, "image", img, nil) },
+			status:  http.StatusBadRequest,
+			wantErr: "quality must be between 1 and 100",
+		},
+		{
+			name: "lossless jpeg in form",
+			body: func() (string, *bytes.Buffer) {
+				return multipartBody(t, "image", img, map[string]string{"format": "jpeg", "lossless": "true"})
+			},
+			status:  http.StatusBadRequest,
+			wantErr: "lossless is only supported for webp output",
+		},
+		{
+			name:        "unsupported format in query",
+			query:       "?format=png",
+			contentType: "image/png",
+			body:        func() (string, *bytes.Buffer) { return "", bytes.NewBuffer(img) },
+			status:      http.StatusBadRequest,
+			wantErr:     "Unsupported output format: 'png'. Supported formats: jpeg, webp",
+		},
+		{
+			name:        "width too large",
+			query:       "?max_width=20000",
+			contentType: "image/png",
+			body:        func() (string, *bytes.Buffer) { return "", bytes.NewBuffer(img) },
+			status:      http.StatusBadRequest,
+			wantErr:     "max_width must be between 0 and 16383",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType, body := tt.body()
+			if contentType == "" {
+				contentType = tt.contentType
+			}
+			req := httptest.NewRequest("POST", "/api/v1/compress"+tt.query, body)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Errorf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			var resp apiError
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("Expected a JSON error body, got %q", w.Body.String())
+			}
+			if resp.Error != tt.wantErr {
+				t.Errorf("Expected error %q, got %q", tt.wantErr, resp.Error)
+			}
+		})
+	}
+}
+
+func TestCompressSettings(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/v1/compress?quality=60&max_height=300", strings.NewReader("format=jpeg&max_width=400"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	settings, err := compressSettings(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := BatchSettings{Quality: 60, Format: "jpeg", MaxWidth: 400, MaxHeight: 300}
+	if settings != want {
+		t.Errorf("Expected %+v, got %+v", want, settings)
+	}
+}
+
+func TestReadUploadKeepsFilename(t *testing.T) {
+	contentType, body := multipartBody(t, "image", testPNG(t), nil)
+	req := httptest.NewRequest("POST", "/api/v1/compress", body)
+	req.Header.Set("Content-Type", contentType)
+
+	up, err := readUpload(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if up.filename != "photo.png" {
+		t.Errorf("Expected filename photo.png, got %q", up.filename)
+	}
+	if !bytes.Equal(up.data, testPNG(t)) {
+		t.Error("Expected the uploaded bytes")
+	}
+}
+
+func TestCompressImageTurnsAwayWhenBusy(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	apiKey := storeAPIKey(t, store, "customer@example.com", "starter")
+
+	for range cap(server.uploads) {
+		server.uploads <- struct{}{}
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/compress", bytes.NewReader(testPNG(t)))
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") != uploadRetryAfter {
+		t.Errorf("Expected Retry-After %s, got %q", uploadRetryAfter, w.Header().Get("Retry-After"))
+	}
+	if usage := store.usage(store.keys[hashToken(apiKey)]); usage.Used != 0 {
+		t.Errorf("Expected a turned-away image not to be charged, got %d used", usage.Used)
+	}
+
+	// A slot frees up
+	<-server.uploads
+	req = httptest.NewRequest("POST", "/api/v1/compress", bytes.NewReader(testPNG(t)))
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+}
+
+// countingReader records whether a request body was read
+type countingReader struct {
+	io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestCompressImageTurnsAwayBeforeReadingBody(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	apiKey := storeAPIKey(t, store, "customer@example.com", "starter")
+
+	for range cap(server.uploads) {
+		server.uploads <- struct{}{}
+	}
+
+	body := &countingReader{Reader: bytes.NewReader(testPNG(t))}
+	req := httptest.NewRequest("POST", "/api/v1/compress", body)
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if body.read != 0 {
+		t.Errorf("Expected the body to be left unread, got %d bytes read", body.read)
+	}
+}
+
+// failingWriter is a ResponseWriter whose client has gone away
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (f failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestCompressImageRefundsUnsentImage(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	apiKey := storeAPIKey(t, store, "customer@example.com", "starter")
+
+	req := httptest.NewRequest("POST", "/api/v1/compress", bytes.NewReader(testPNG(t)))
+	req.Header.Set("Content-Type", "image/png")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	server.router.ServeHTTP(failingWriter{httptest.NewRecorder()}, req)
+
+	if usage := store.usage(store.keys[hashToken(apiKey)]); usage.Used != 0 {
+		t.Errorf("Expected the unsent image to be refunded, got %d used", usage.Used)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/devrewoh/devrewoh-portfolio/internal/migrate"
+)
+
+const (
+	// dbCheckInterval is how often watchDB pings the database
+	dbCheckInterval = 10 * time.Second
+
+	// dbPingTimeout bounds each ping, so a hung connection counts as down
+	dbPingTimeout = 5 * time.Second
+
+	// dbRetryAfter is the Retry-After sent with 503s while the database is down
+	dbRetryAfter = "30"
+)
+
+// initDB creates the connection pool for DATABASE_URL. It doesn't connect;
+// watchDB does that in the background, so the server can start without the
+// database.
+func initDB() (*pgxpool.Pool, error) {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return nil, fmt.Errorf("DATABASE_URL not set")
+	}
+
+	pool, err := pgxpool.New(context.Background(), dbURL)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
+	return pool, nil
+}
+
+// migrateDB applies pending migrations. Concurrent instances wait on the
+// migration lock, so only the first to start applies them.
+func migrateDB(ctx context.Context, pool *pgxpool.Pool) error {
+	migrator, err := migrate.New(pool)
+	if err != nil {
+		return fmt.Errorf("load migrations: %w", err)
+	}
+
+	applied, err := migrator.Up(ctx)
+	for _, m := range applied {
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("migrate database: %w", err)
+	}
+	return nil
+}
+
+// watchDB switches the server between full and marketing-only mode as the
+// database comes and goes, checking every dbCheckInterval until ctx ends.
+// The first successful check also applies migrations and starts the workers.
+func (s *Server) watchDB(ctx context.Context) {
+	if s.pool == nil {
+		if s.dbReady.Load() {
+			s.workers.Start()
+		} else {
+			s.logger.Warn("no database configured; serving marketing pages only")
+		}
+		return
+	}
+
+	ticker := time.NewTicker(dbCheckInterval)
+	defer ticker.Stop()
+
+	migrated := false
+	down := false
+	for {
+		err := s.checkDB(ctx, !migrated)
+		switch {
+		case err == nil && !s.dbReady.Load():
+			if !migrated {
+				migrated = true
+				s.workers.Start()
+			}
+			s.dbReady.Store(true)
+			down = false
+			s.logger.Info("database available; serving all routes")
+		case err != nil && ctx.Err() == nil && !down:
+			s.dbReady.Store(false)
+			down = true
+			s.logger.Error("database unavailable; serving marketing pages only", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkDB pings the database and, with migrations set, brings its schema up to date
+func (s *Server) checkDB(ctx context.Context, migrations bool) error {
+	pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+	if err := s.pool.Ping(pingCtx); err != nil {
+		return fmt.Errorf("unable to reach database: %w", err)
+	}
+
+	if migrations {
+		return migrateDB(ctx, s.pool)
+	}
+	return nil
+}
+
+// requireDB answers with unavailable while the database is down, so routes
+// that need it fail fast instead of timing out
+func (s *Server) requireDB(unavailable http.HandlerFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !s.dbReady.Load() {
+				w.Header().Set("Retry-After", dbRetryAfter)
+				unavailable(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *Server) handleUnavailable(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	component := UnavailablePage()
+	s.renderTemplate(w, r, component, "unavailable")
+}
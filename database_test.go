@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMarketingPagesServeWithoutDatabase(t *testing.T) {
+	server := NewServer(":8080")
+
+	for _, path := range []string{"/", "/about", "/contact", "/compress", "/compress/docs", "/health"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", path, nil)
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+		})
+	}
+}
+
+func TestDatabaseRoutesUnavailableWithoutDatabase(t *testing.T) {
+	server := NewServer(":8080")
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"GET", "/login", "Back Shortly"},
+		{"GET", "/compress/free", "Back Shortly"},
+		{"POST", "/checkout", "Back Shortly"},
+		{"GET", "/account", "Back Shortly"},
+		{"POST", "/webhooks/stripe", "Back Shortly"},
+		{"GET", "/api/v1/usage", `"error":"GoTiny is temporarily unavailable. Please retry shortly"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+			}
+			if w.Header().Get("Retry-After") != dbRetryAfter {
+				t.Errorf("Expected Retry-After %s, got %q", dbRetryAfter, w.Header().Get("Retry-After"))
+			}
+			if !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("Expected body to contain %q", tt.want)
+			}
+		})
+	}
+}
+
+func TestDatabaseRoutesResumeWhenAvailable(t *testing.T) {
+	server := NewServer(":8080")
+
+	req := httptest.NewRequest("GET", "/login", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	// What watchDB does once a ping succeeds
+	server.dbReady.Store(true)
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// signedURLTTL is how long a download redirect stays valid
+const signedURLTTL = 15 * time.Minute
+
+var errImageNotFound = errors.New("image not found")
+
+// imageOutput is the stored result of one batch image
+type imageOutput struct {
+	ID             string
+	Status         string
+	Format         string
+	Key            *string
+	ExpiresAt      *time.Time
+	CompressedSize *int64
+}
+
+// downloadPath is the API path that serves an image's output
+func downloadPath(imageID string) string {
+	return "/api/v1/images/" + imageID + "/download"
+}
+
+func (s *Server) handleImageDownload(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	imageID := chi.URLParam(r, "imageID")
+	if !uuidPattern.MatchString(imageID) {
+		writeAPIError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+
+	out, err := s.store.GetImageOutput(r.Context(), key.Email, imageID)
+	if errors.Is(err, errImageNotFound) {
+		writeAPIError(w, http.StatusNotFound, "Image not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to load image", "image_id", imageID, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load image")
+		return
+	}
+
+	s.serveOutput(w, r, out)
+}
+
+// serveOutput redirects to a signed URL when the storage can make one, and
+// otherwise streams the file through the server
+func (s *Server) serveOutput(w http.ResponseWriter, r *http.Request, out imageOutput) {
+	if out.Status != statusCompleted {
+		writeAPIError(w, http.StatusConflict, fmt.Sprintf("Image is not ready: its status is %s", out.Status))
+		return
+	}
+	if out.Key == nil || out.ExpiresAt == nil || !out.ExpiresAt.After(time.Now()) {
+		writeAPIError(w, http.StatusGone, "Image has expired")
+		return
+	}
+
+	if signer, ok := s.storage.(URLSigner); ok {
+		url, err := signer.SignedURL(r.Context(), *out.Key, min(signedURLTTL, time.Until(*out.ExpiresAt)))
+		if err != nil {
+			s.logger.Error("failed to sign download url", "image_id", out.ID, "error", err)
+			writeAPIError(w, http.StatusInternalServerError, "Failed to download image")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, url, http.StatusFound)
+		return
+	}
+
+	body, err := s.storage.Get(r.Context(), *out.Key)
+	if errors.Is(err, errObjectNotFound) {
+		writeAPIError(w, http.StatusGone, "Image has expired")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to read output", "image_id", out.ID, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to download image")
+		return
+	}
+	defer body.Close()
+
+	filename := out.ID + outputExtension(out.Format)
+	w.Header().Set("Content-Type", outputContentType(out.Format))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("Cache-Control", "private, no-store")
+	if out.CompressedSize != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*out.CompressedSize, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, body); err != nil {
+		s.logger.Warn("download interrupted", "image_id", out.ID, "error", err)
+	}
+}
+
+// GetImageOutput loads one of email's batch images. Like batches, images
+// belong to the account rather than the key.
+func (pg *pgStore) GetImageOutput(ctx context.Context, email, imageID string) (imageOutput, error) {
+	query := `
+		SELECT i.id, i.status, b.format, i.output_key, i.expires_at, i.compressed_size
+		FROM batch_images AS i
+		JOIN batches AS b ON b.id = i.batch_id
+		WHERE i.id = $1 AND b.user_email = $2
+	`
+
+	var out imageOutput
+	err := pg.pool.QueryRow(ctx, query, imageID, email).Scan(
+		&out.ID, &out.Status, &out.Format, &out.Key, &out.ExpiresAt, &out.CompressedSize,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return imageOutput{}, errImageNotFound
+	}
+	if err != nil {
+		return imageOutput{}, err
+	}
+	return out, nil
+}
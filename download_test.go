@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImageDownloadRejectsInvalidID(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	apiKey := testAPIKey(t, server, "starter", nil)
+
+	req := httptest.NewRequest("GET", "/api/v1/images/not-a-uuid/download", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `"error":"Image not found"`) {
+		t.Errorf("Expected image not found error, got %q", w.Body.String())
+	}
+}
+
+func TestServeOutputStreamsFromLocalStorage(t *testing.T) {
+	server := NewServer(":8080")
+	storage := localStorage{dir: t.TempDir()}
+	server.storage = storage
+	storage.Put(context.Background(), "b/i.webp", []byte("compressed"), "image/webp")
+
+	key, size := "b/i.webp", int64(len("compressed"))
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Minute)
+	missing := "b/missing.webp"
+
+	tests := []struct {
+		name   string
+		out    imageOutput
+		status int
+	}{
+		{"completed", imageOutput{ID: "i", Status: statusCompleted, Format: "webp", Key: &key, ExpiresAt: &future, CompressedSize: &size}, http.StatusOK},
+		{"pending", imageOutput{ID: "i", Status: statusPending, Format: "webp"}, http.StatusConflict},
+		{"expired", imageOutput{ID: "i", Status: statusCompleted, Format: "webp", Key: &key, ExpiresAt: &past}, http.StatusGone},
+		{"deleted", imageOutput{ID: "i", Status: statusCompleted, Format: "webp", ExpiresAt: &future}, http.StatusGone},
+		{"missing object", imageOutput{ID: "i", Status: statusCompleted, Format: "webp", Key: &missing, ExpiresAt: &future}, http.StatusGone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			server.serveOutput(w, httptest.NewRequest("GET", "/", nil), tt.out)
+
+			if w.Code != tt.status {
+				t.Fatalf("Expected status %d, got %d", tt.status, w.Code)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			if w.Body.String() != "compressed" {
+				t.Errorf("Expected the stored bytes, got %q", w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "image/webp" {
+				t.Errorf("Expected Content-Type image/webp, got %q", ct)
+			}
+			if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename=i.webp` {
+				t.Errorf("Unexpected Content-Disposition %q", cd)
+			}
+		})
+	}
+}
+
+func TestServeOutputRedirectsToSignedURL(t *testing.T) {
+	server := NewServer(":8080")
+	storage, _ := newTestS3Storage(t)
+	server.storage = storage
+
+	key := "b/i.jpg"
+	expires := time.Now().Add(5 * time.Minute)
+	w := httptest.NewRecorder()
+	server.serveOutput(w, httptest.NewRequest("GET", "/", nil),
+		imageOutput{ID: "i", Status: statusCompleted, Format: "jpeg", Key: &key, ExpiresAt: &expires})
+
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusFound, w.Code)
+	}
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || loc.Path != "/outputs/b/i.jpg" {
+		t.Fatalf("Expected a redirect to the object, got %q", w.Header().Get("Location"))
+	}
+	// The link never outlives the image
+	if got := loc.Query().Get("X-Amz-Expires"); got != "299" && got != "300" {
+		t.Errorf("Expected the URL to expire with the image, got X-Amz-Expires=%s", got)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// eventPollInterval is how often a stream checks its batch for changes
+	eventPollInterval = time.Second
+
+	// eventKeepAlive is how long a stream can be quiet before a comment is
+	// sent, so proxies don't close it as idle
+	eventKeepAlive = 15 * time.Second
+
+	// eventWriteTimeout bounds each write; streams outlive the server's
+	// WriteTimeout, so it is extended before every event
+	eventWriteTimeout = 10 * time.Second
+
+	// maxEventStreams caps open streams. They skip the global throttle,
+	// which would otherwise fill up with long-lived connections.
+	maxEventStreams = 200
+
+	// eventStreamRetryAfter is the Retry-After sent when maxEventStreams are open
+	eventStreamRetryAfter = "5"
+)
+
+// batchProgress is a batch's counts without its images
+type batchProgress struct {
+	BatchID     string `json:"batch_id"`
+	Status      string `json:"status"`
+	TotalImages int    `json:"total_images"`
+	Completed   int    `json:"completed"`
+	Failed      int    `json:"failed"`
+}
+
+// handleBatchEvents streams a batch's progress as Server-Sent Events until
+// the batch finishes
+func (s *Server) handleBatchEvents(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	batchID := chi.URLParam(r, "batchID")
+	if !uuidPattern.MatchString(batchID) {
+		writeAPIError(w, http.StatusNotFound, "Batch not found")
+		return
+	}
+
+	load := func(ctx context.Context) (batchStatusResponse, error) {
+		return s.store.GetBatchStatus(ctx, key.Email, batchID)
+	}
+
+	// Check the batch before committing to a stream, so errors are JSON
+	status, err := load(r.Context())
+	if errors.Is(err, errBatchNotFound) {
+		writeAPIError(w, http.StatusNotFound, "Batch not found")
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to load batch status", "batch_id", batchID, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load batch status")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(s.closing, cancel)
+	defer stop()
+
+	if err := streamBatchEvents(ctx, w, status, load); err != nil && ctx.Err() == nil {
+		s.logger.Warn("batch event stream ended", "batch_id", batchID, "error", err)
+	}
+}
+
+// streamBatchEvents writes an "image" event for each image as it changes and
+// a "progress" event with the batch counts, starting from status. When the
+// batch reaches a terminal state it writes a "done" event with the full
+// status and returns.
+func streamBatchEvents(ctx context.Context, w http.ResponseWriter, status batchStatusResponse, load func(context.Context) (batchStatusResponse, error)) error {
+	rc := http.NewResponseController(w)
+	// The server's ReadTimeout would otherwise cancel the request part way
+	// through the stream
+	rc.SetReadDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Stop nginx-style proxies buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, v any) error {
+		// Not every ResponseWriter supports deadlines; those that don't have
+		// no WriteTimeout to extend
+		rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+		if err := writeEvent(w, event, v); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	// Ask clients to wait a little before reconnecting
+	if _, err := fmt.Fprint(w, "retry: 5000\n\n"); err != nil {
+		return err
+	}
+
+	seen := make(map[string]string)
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	lastWrite := time.Now()
+
+	for {
+		changed := false
+		for _, img := range status.Images {
+			if seen[img.ID] == img.Status {
+				continue
+			}
+			seen[img.ID] = img.Status
+			changed = true
+			if err := send("image", img); err != nil {
+				return err
+			}
+		}
+		if changed {
+			progress := batchProgress{
+				BatchID:     status.BatchID,
+				Status:      status.Status,
+				TotalImages: status.TotalImages,
+				Completed:   status.Completed,
+				Failed:      status.Failed,
+			}
+			if err := send("progress", progress); err != nil {
+				return err
+			}
+			lastWrite = time.Now()
+		}
+
+		if status.Status == statusCompleted || status.Status == statusFailed {
+			return send("done", status)
+		}
+
+		if time.Since(lastWrite) >= eventKeepAlive {
+			rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return err
+			}
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+			lastWrite = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll.C:
+		}
+
+		next, err := load(ctx)
+		if err != nil {
+			return err
+		}
+		status = next
+	}
+}
+
+// writeEvent writes one Server-Sent Event with v as its JSON data
+func writeEvent(w http.ResponseWriter, event string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchEventsSkipCompression(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	apiKey := testAPIKey(t, server, "starter", nil)
+
+	tests := []struct {
+		path     string
+		encoding string
+	}{
+		{"/api/v1/batches/not-a-uuid/status", "gzip"},
+		{"/api/v1/batches/not-a-uuid/events", ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		server.router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got %d", tt.path, http.StatusNotFound, w.Code)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+			t.Errorf("%s: expected Content-Encoding %q, got %q", tt.path, tt.encoding, got)
+		}
+	}
+}
+
+func TestBatchEventsRequireAPIKey(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("GET", "/api/v1/batches/a27dcd6c-a701-43e9-9376-6a702d715426/events", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestStreamBatchEvents(t *testing.T) {
+	size := int64(100)
+	running := batchStatusResponse{
+		BatchID: "b", Status: statusProcessing, TotalImages: 2, Completed: 1,
+		Images: []batchImage{
+			{ID: "i1", Status: statusCompleted, CompressedSize: &size},
+			{ID: "i2", Status: statusProcessing},
+		},
+	}
+	finished := batchStatusResponse{
+		BatchID: "b", Status: statusCompleted, TotalImages: 2, Completed: 2,
+		Images: []batchImage{
+			{ID: "i1", Status: statusCompleted, CompressedSize: &size},
+			{ID: "i2", Status: statusCompleted, CompressedSize: &size},
+		},
+	}
+
+	loads := 0
+	load := func(ctx context.Context) (batchStatusResponse, error) {
+		loads++
+		return finished, nil
+	}
+
+	w := httptest.NewRecorder()
+	if err := streamBatchEvents(context.Background(), w, running, load); err != nil {
+		t.Fatalf("Expected the stream to end cleanly, got %v", err)
+	}
+
+	if loads != 1 {
+		t.Errorf("Expected the stream to stop once the batch completed, got %d loads", loads)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Expected Content-Type text/event-stream, got %q", got)
+	}
+
+	body := w.Body.String()
+	want := []string{
+		"event: image\ndata: {\"id\":\"i1\",\"status\":\"completed\"",
+		"event: image\ndata: {\"id\":\"i2\",\"status\":\"processing\"}",
+		"event: progress\ndata: {\"batch_id\":\"b\",\"status\":\"processing\",\"total_images\":2,\"completed\":1,\"failed\":0}",
+		"event: image\ndata: {\"id\":\"i2\",\"status\":\"completed\"",
+		"event: progress\ndata: {\"batch_id\":\"b\",\"status\":\"completed\",\"total_images\":2,\"completed\":2,\"failed\":0}",
+		"event: done\ndata: {\"batch_id\":\"b\",\"status\":\"completed\"",
+	}
+	rest := body
+	for _, w := range want {
+		i := strings.Index(rest, w)
+		if i < 0 {
+			t.Fatalf("Expected %q in order in the stream, got\n%s", w, body)
+		}
+		rest = rest[i+len(w):]
+	}
+	if strings.Count(body, "event: image") != 3 {
+		t.Errorf("Expected unchanged images not to be sent again, got\n%s", body)
+	}
+}
+
+func TestStreamBatchEventsStopsWhenCancelled(t *testing.T) {
+	running := batchStatusResponse{BatchID: "b", Status: statusPending, TotalImages: 1,
+		Images: []batchImage{{ID: "i1", Status: statusPending}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	w := httptest.NewRecorder()
+	err := streamBatchEvents(ctx, w, running, func(context.Context) (batchStatusResponse, error) {
+		t.Error("Expected no reload after the stream was cancelled")
+		return running, nil
+	})
+	if err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// verificationTTL is how long an emailed verification link stays valid
+const verificationTTL = 24 * time.Hour
+
+var (
+	errInvalidToken  = errors.New("invalid or expired token")
+	errFreeKeyExists = errors.New("email already has a free key")
+)
+
+// baseURL is the public origin used when building links for emails
+func baseURL() string {
+	if u := os.Getenv("BASE_URL"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "https://devrewoh.com"
+}
+
+// newSecretToken returns a random URL-safe token and the hash to store for it
+func newSecretToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+// hashToken hashes a secret token for storage and lookup
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// normalizeEmail validates a bare email address and lowercases it
+func normalizeEmail(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw {
+		return "", fmt.Errorf("invalid email address")
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+func (s *Server) handleFreeSignup(w http.ResponseWriter, r *http.Request) {
+	component := FreeSignupPage("", "")
+	s.renderTemplate(w, r, component, "free-signup")
+}
+
+func (s *Server) handleFreeSignupSubmit(w http.ResponseWriter, r *http.Request) {
+	email, err := normalizeEmail(r.FormValue("email"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		component := FreeSignupPage(r.FormValue("email"), "Please enter a valid email address.")
+		s.renderTemplate(w, r, component, "free-signup")
+		return
+	}
+
+	if wait := s.limitEmail(r, "free-signup", email); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+		w.WriteHeader(http.StatusTooManyRequests)
+		component := FreeSignupPage(email, "Too many confirmation emails requested. "+retryMessage(wait))
+		s.renderTemplate(w, r, component, "free-signup")
+		return
+	}
+
+	token, err := s.store.CreateEmailVerification(r.Context(), email)
+	if err != nil {
+		s.logger.Error("failed to create email verification", "error", err)
+		http.Error(w, "Failed to start signup", http.StatusInternalServerError)
+		return
+	}
+
+	link := baseURL() + "/compress/free/verify?token=" + token
+	msg := Message{
+		To:      email,
+		Subject: "Confirm your email for GoTiny",
+		Body: "Confirm your email address to get your free GoTiny API key:\n\n" +
+			link + "\n\n" +
+			"This link expires in 24 hours. If you didn't request it, you can ignore this email.\n",
+	}
+	if err := s.mailer.Send(r.Context(), msg); err != nil {
+		s.logger.Error("failed to send verification email", "error", err)
+		http.Error(w, "Failed to send verification email", http.StatusInternalServerError)
+		return
+	}
+
+	component := FreeSignupSentPage(email)
+	s.renderTemplate(w, r, component, "free-signup-sent")
+}
+
+// handleFreeVerify shows the button that issues the free key. Opening the
+// emailed link doesn't use it up, since mail scanners open links too.
+func (s *Server) handleFreeVerify(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		s.renderIncompleteVerification(w, r)
+		return
+	}
+
+	component := FreeVerifyPage(token)
+	s.renderTemplate(w, r, component, "free-verify")
+}
+
+func (s *Server) renderIncompleteVerification(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusBadRequest)
+	component := FreeSignupPage("", "That verification link is incomplete. Please sign up again.")
+	s.renderTemplate(w, r, component, "free-signup")
+}
+
+// handleFreeVerifySubmit consumes the verification token and shows the free key
+func (s *Server) handleFreeVerifySubmit(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		s.renderIncompleteVerification(w, r)
+		return
+	}
+
+	email, apiKey, err := s.store.IssueFreeKey(r.Context(), token)
+	switch {
+	case errors.Is(err, errInvalidToken):
+		w.WriteHeader(http.StatusBadRequest)
+		component := FreeSignupPage("", "That verification link is invalid or has expired. Please sign up again.")
+		s.renderTemplate(w, r, component, "free-signup")
+		return
+	case errors.Is(err, errFreeKeyExists):
+		w.WriteHeader(http.StatusConflict)
+		component := FreeSignupPage(email, "This email address already has a free API key.")
+		s.renderTemplate(w, r, component, "free-signup")
+		return
+	case err != nil:
+		s.logger.Error("failed to issue free api key", "error", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	s.logger.Info("free api key issued")
+	free, _ := planByID("free")
+	component := FreeKeyPage(apiKey, free.Name, free.Credits, email)
+	s.renderTemplate(w, r, component, "free-key")
+}
+
+// CreateEmailVerification stores a hashed verification token for email and returns the token
+func (pg *pgStore) CreateEmailVerification(ctx context.Context, email string) (string, error) {
+	token, tokenHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO email_verifications (token_hash, email, expires_at)
+		VALUES ($1, $2, $3)
+	`
+
+	if _, err := pg.pool.Exec(ctx, query, tokenHash, email, time.Now().Add(verificationTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// IssueFreeKey consumes a verification token and issues the free key for its
+// email. Each verified email gets at most one free key.
+func (pg *pgStore) IssueFreeKey(ctx context.Context, token string) (string, string, error) {
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var email string
+	err = tx.QueryRow(ctx, `
+		UPDATE email_verifications SET used_at = now()
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING email
+	`, hashToken(token)).Scan(&email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", "", errInvalidToken
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	free, ok := planByID("free")
+	if !ok {
+		return "", "", fmt.Errorf("free plan not configured")
+	}
+
+	key, err := generateAPIKey(ctx, tx, email, free)
+	if err != nil {
+		return "", "", err
+	}
+
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO free_signups (email, key_prefix)
+		VALUES ($1, $2)
+		ON CONFLICT (email) DO NOTHING
+	`, email, key[:10])
+	if err != nil {
+		return "", "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return email, "", errFreeKeyExists
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", "", err
+	}
+	return email, key, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFreeSignupPage(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("GET", "/compress/free", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	body := w.Body.String()
+	if !strings.Contains(body, `action="/compress/free"`) {
+		t.Error("Expected signup form posting to /compress/free")
+	}
+}
+
+func TestFreeSignupRejectsInvalidEmail(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	for _, email := range []string{"", "not-an-email", "Chris <chris@example.com>"} {
+		t.Run(email, func(t *testing.T) {
+			form := "email=" + strings.ReplaceAll(email, " ", "+")
+			req := httptest.NewRequest("POST", "/compress/free", strings.NewReader(form))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+			if !strings.Contains(w.Body.String(), "valid email") {
+				t.Error("Expected validation message in response")
+			}
+		})
+	}
+}
+
+func TestFreeVerifyRequiresToken(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("GET", "/compress/free/verify", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestFreeVerifyIssuesOneKeyPerEmail(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	verify := func() *httptest.ResponseRecorder {
+		token, err := store.CreateEmailVerification(context.Background(), "chris@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/compress/free/verify", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := verify()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "ic_") {
+		t.Error("Expected the page to show the new API key")
+	}
+
+	if w := verify(); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a second free key, got %d", http.StatusConflict, w.Code)
+	}
+}
+
+func TestFreeVerifyLinkDoesNotUseToken(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	token, err := store.CreateEmailVerification(context.Background(), "chris@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A mail scanner opening the link only sees the confirmation form
+	for range 2 {
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, httptest.NewRequest("GET", "/compress/free/verify?token="+token, nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		if shownKey(w.Body.String()) != "" {
+			t.Fatal("Expected opening the link not to show an API key")
+		}
+		if !strings.Contains(w.Body.String(), `value="`+token+`"`) {
+			t.Fatal("Expected the page to post the token")
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/compress/free/verify", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if shownKey(w.Body.String()) == "" {
+		t.Error("Expected confirming to show the API key")
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"chris@example.com", "chris@example.com", false},
+		{"  Chris@Example.COM ", "chris@example.com", false},
+		{"chris", "", true},
+		{"Chris <chris@example.com>", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeEmail(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeEmail(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFreeSignupLimitsEmails(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	submit := func(email, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/compress/free", strings.NewReader("email="+email))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The address is limited however it is capitalised
+	for i, email := range []string{"chris@example.com", "Chris@example.com", "CHRIS@EXAMPLE.COM"} {
+		if w := submit(email, "192.0.2.1"); w.Code != http.StatusOK {
+			t.Fatalf("Expected email %d to be sent, got status %d", i+1, w.Code)
+		}
+	}
+	w := submit("chris@example.com", "192.0.2.2")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected a Retry-After header")
+	}
+	if !strings.Contains(w.Body.String(), "Too many confirmation emails") {
+		t.Error("Expected the page to explain the limit")
+	}
+
+	// So is the client, across addresses
+	for i := range emailsPerIP {
+		email := fmt.Sprintf("user%d@example.com", i)
+		if w := submit(email, "192.0.2.3"); w.Code != http.StatusOK {
+			t.Fatalf("Expected email %d from one IP to be sent, got status %d", i+1, w.Code)
+		}
+	}
+	if w := submit("another@example.com", "192.0.2.3"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d once the IP is limited, got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
@@ -11,6 +11,7 @@ require (
 	github.com/a-h/templ v0.3.960
 	github.com/jackc/pgx/v5 v5.7.6
 	github.com/stripe/stripe-go/v81 v81.4.0
+	golang.org/x/image v0.32.0
 )
 
 require (
@@ -0,0 +1,314 @@
+// Package fetch downloads user-supplied URLs without letting them reach the
+// service's own network. It resolves DNS itself and refuses to connect to
+// private, loopback, link-local and cloud metadata addresses, re-checking
+// every hop of a redirect chain, and it caps the size, duration and redirect
+// count of each request.
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"time"
+)
+
+const (
+	defaultMaxBytes     = 25 << 20
+	defaultTimeout      = time.Minute
+	defaultMaxRedirects = 5
+	dialTimeout         = 10 * time.Second
+)
+
+// ImageTypes are the sniffed content types the imaging package can decode
+var ImageTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+var (
+	// ErrScheme is returned for URLs that aren't http or https
+	ErrScheme = errors.New("only http and https URLs are allowed")
+
+	// ErrBlockedAddress is returned when a host resolves to an address the
+	// fetcher won't connect to
+	ErrBlockedAddress = errors.New("address is not allowed")
+
+	// ErrTooManyRedirects is returned when a redirect chain is too long
+	ErrTooManyRedirects = errors.New("too many redirects")
+
+	// ErrTooLarge is returned when a response body exceeds the size limit
+	ErrTooLarge = errors.New("response is too large")
+
+	// ErrContentType is returned when the sniffed content type isn't allowed
+	ErrContentType = errors.New("unsupported content type")
+)
+
+// StatusError is returned for responses other than 200 OK
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string { return "unexpected status " + e.Status }
+
+// Temporary reports whether the request might succeed if retried: server
+// errors, timeouts and throttling are, other client errors aren't
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout ||
+		e.StatusCode == http.StatusTooManyRequests
+}
+
+// blockedPrefixes are the ranges a user-supplied URL must never reach
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this" network
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT, also Alibaba Cloud metadata
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local, including 169.254.169.254 metadata
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved and broadcast
+	netip.MustParsePrefix("::/128"),          // unspecified
+	netip.MustParsePrefix("::1/128"),         // loopback
+	netip.MustParsePrefix("::/96"),           // IPv4-compatible, which can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64, which can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64 (RFC 8215), which can embed any IPv4 address
+	netip.MustParsePrefix("100::/64"),        // discard
+	netip.MustParsePrefix("2001::/32"),       // Teredo, which can embed any IPv4 address
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4, which can embed any IPv4 address
+	netip.MustParsePrefix("fc00::/7"),        // unique local, including fd00:ec2::254 metadata
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// Fetcher downloads URLs chosen by users. It is safe for concurrent use.
+type Fetcher struct {
+	client        *http.Client
+	resolver      *net.Resolver
+	maxBytes      int64
+	timeout       time.Duration
+	maxRedirects  int
+	userAgent     string
+	contentTypes  []string
+	allowLoopback bool
+}
+
+// Option configures a Fetcher
+type Option func(*Fetcher)
+
+// WithMaxBytes limits the size of a response body
+func WithMaxBytes(n int64) Option {
+	return func(f *Fetcher) { f.maxBytes = n }
+}
+
+// WithTimeout limits how long a request can take, including redirects and
+// reading the body
+func WithTimeout(d time.Duration) Option {
+	return func(f *Fetcher) { f.timeout = d }
+}
+
+// WithMaxRedirects limits how many redirects a request follows
+func WithMaxRedirects(n int) Option {
+	return func(f *Fetcher) { f.maxRedirects = n }
+}
+
+// WithUserAgent sets the User-Agent header sent with each request
+func WithUserAgent(ua string) Option {
+	return func(f *Fetcher) { f.userAgent = ua }
+}
+
+// WithContentTypes sets the sniffed content types Get accepts. The default
+// is ImageTypes.
+func WithContentTypes(types ...string) Option {
+	return func(f *Fetcher) { f.contentTypes = types }
+}
+
+// WithResolver sets the resolver used to look up hosts
+func WithResolver(r *net.Resolver) Option {
+	return func(f *Fetcher) { f.resolver = r }
+}
+
+// AllowLoopback lets the fetcher connect to loopback addresses, so tests can
+// use an httptest server. Never use it in production.
+func AllowLoopback() Option {
+	return func(f *Fetcher) { f.allowLoopback = true }
+}
+
+// New returns a Fetcher with the given options
+func New(opts ...Option) *Fetcher {
+	f := &Fetcher{
+		resolver:     net.DefaultResolver,
+		maxBytes:     defaultMaxBytes,
+		timeout:      defaultTimeout,
+		maxRedirects: defaultMaxRedirects,
+		contentTypes: ImageTypes,
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	transport := &http.Transport{
+		// A proxy would make the connection on our behalf, skipping the
+		// address checks in dial
+		Proxy:                 nil,
+		DialContext:           f.dial,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	f.client = &http.Client{
+		Transport:     transport,
+		Timeout:       f.timeout,
+		CheckRedirect: f.checkRedirect,
+	}
+	return f
+}
+
+// Get downloads rawURL and returns its body and sniffed content type
+func (f *Fetcher) Get(ctx context.Context, rawURL string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch: %w", err)
+	}
+
+	resp, err := f.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+	if resp.ContentLength > f.maxBytes {
+		return nil, "", ErrTooLarge
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("fetch: %w", err)
+	}
+	if int64(len(data)) > f.maxBytes {
+		return nil, "", ErrTooLarge
+	}
+
+	// The server's Content-Type is whatever the user's host says it is, so
+	// go by the bytes instead
+	contentType := http.DetectContentType(data)
+	if !slices.Contains(f.contentTypes, contentType) {
+		return nil, "", fmt.Errorf("%w: %s", ErrContentType, contentType)
+	}
+	return data, contentType, nil
+}
+
+// Do sends req with the fetcher's address, redirect and timeout checks. The
+// caller must close the response body.
+func (f *Fetcher) Do(req *http.Request) (*http.Response, error) {
+	if err := checkScheme(req.URL); err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", req.URL.Redacted(), err)
+	}
+	if f.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// Surface our own errors rather than the *url.Error around them
+		for _, target := range []error{ErrScheme, ErrBlockedAddress, ErrTooManyRedirects} {
+			if errors.Is(err, target) {
+				return nil, fmt.Errorf("fetch %s: %w", req.URL.Redacted(), target)
+			}
+		}
+		return nil, fmt.Errorf("fetch: %w", err)
+	}
+	return resp, nil
+}
+
+func (f *Fetcher) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > f.maxRedirects {
+		return ErrTooManyRedirects
+	}
+	return checkScheme(req.URL)
+}
+
+// dial resolves the host itself and connects only if every address it
+// resolves to is allowed, so a hostname can't smuggle in an internal address
+// alongside a public one
+func (f *Fetcher) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := f.resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses for %s", host)
+	}
+	for _, ip := range ips {
+		if !f.allowed(ip) {
+			return nil, fmt.Errorf("%s resolves to %s: %w", host, ip.Unmap(), ErrBlockedAddress)
+		}
+	}
+
+	// Connect to the checked addresses directly so the dialer can't resolve
+	// the host again and get a different answer
+	dialer := &net.Dialer{Timeout: dialTimeout, KeepAlive: 30 * time.Second}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// allowed reports whether the fetcher may connect to ip
+func (f *Fetcher) allowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if f.allowLoopback && ip.IsLoopback() {
+		return true
+	}
+	return Allowed(ip)
+}
+
+// Allowed reports whether ip is a public unicast address
+func Allowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() {
+		return false
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ErrScheme
+	}
+	if u.Host == "" {
+		return errors.New("fetch: URL has no host")
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pngBytes(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.100.100.200", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::1", false},
+		{"::", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"fd00:ec2::254", false},
+		{"fe80::1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b:1::a00:1", false},
+		{"::a9fe:a9fe", false},
+		{"2001:0:4136:e378:8000:63bf:3fff:fdd2", false},
+		{"2001:4860:4860::8888", true},
+	}
+
+	for _, tt := range tests {
+		if got := Allowed(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("Allowed(%s): expected %v, got %v", tt.ip, tt.want, got)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	img := pngBytes(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(img)
+	})
+	mux.HandleFunc("/lying.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("<html><body>not an image</body></html>"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "2048")
+		w.Write(make([]byte, 2048))
+	})
+	mux.HandleFunc("/large-chunked", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, 2048))
+	})
+	mux.HandleFunc("/redirect/{n}", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.PathValue("n"))
+		if n == 0 {
+			http.Redirect(w, r, "/image.png", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, "/redirect/"+strconv.Itoa(n-1), http.StatusFound)
+	})
+	mux.HandleFunc("/to-metadata", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	})
+	mux.HandleFunc("/to-file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	mux.HandleFunc("/busy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	f := New(AllowLoopback(), WithMaxBytes(1024), WithMaxRedirects(3))
+
+	tests := []struct {
+		name    string
+		url     string
+		wantErr error
+	}{
+		{"image", srv.URL + "/image.png", nil},
+		{"sniffed type wins", srv.URL + "/lying.png", ErrContentType},
+		{"content length too large", srv.URL + "/large", ErrTooLarge},
+		{"body too large", srv.URL + "/large-chunked", ErrTooLarge},
+		{"redirects within limit", srv.URL + "/redirect/2", nil},
+		{"too many redirects", srv.URL + "/redirect/3", ErrTooManyRedirects},
+		{"redirect to metadata", srv.URL + "/to-metadata", ErrBlockedAddress},
+		{"redirect to file", srv.URL + "/to-file", ErrScheme},
+		{"file scheme", "file:///etc/passwd", ErrScheme},
+		{"ftp scheme", "ftp://example.com/image.png", ErrScheme},
+		{"private address", "http://10.0.0.1/image.png", ErrBlockedAddress},
+		{"ipv4-mapped metadata", "http://[::ffff:169.254.169.254]/", ErrBlockedAddress},
+	}
+
+	for _, tt := range tests {
+		data, contentType, err := f.Get(context.Background(), tt.url)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+			continue
+		}
+		if err == nil && (!bytes.Equal(data, img) || contentType != "image/png") {
+			t.Errorf("%s: expected the PNG, got %d bytes of %s", tt.name, len(data), contentType)
+		}
+	}
+
+	_, _, err := f.Get(context.Background(), srv.URL+"/busy")
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable || !statusErr.Temporary() {
+		t.Errorf("Expected a temporary 503 StatusError, got %v", err)
+	}
+
+	_, _, err = f.Get(context.Background(), srv.URL+"/missing")
+	if !errors.As(err, &statusErr) || statusErr.Temporary() {
+		t.Errorf("Expected a permanent 404 StatusError, got %v", err)
+	}
+}
+
+func TestGetBlocksLoopbackByDefault(t *testing.T) {
+	requested := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer srv.Close()
+
+	f := New()
+	port := srv.URL[strings.LastIndex(srv.URL, ":")+1:]
+	for _, url := range []string{srv.URL, "http://localhost:" + port + "/"} {
+		_, _, err := f.Get(context.Background(), url)
+		if !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("%s: expected ErrBlockedAddress, got %v", url, err)
+		}
+	}
+	if requested {
+		t.Error("Expected the server never to be reached")
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	f := New(AllowLoopback(), WithTimeout(50*time.Millisecond))
+	start := time.Now()
+	_, _, err := f.Get(context.Background(), srv.URL)
+	if err == nil {
+		t.Fatal("Expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the request to give up quickly, took %v", elapsed)
+	}
+}
+
+func TestDoSetsUserAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer srv.Close()
+
+	f := New(AllowLoopback(), WithUserAgent("GoTiny/1.0"))
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, nil)
+	resp, err := f.Do(req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	resp.Body.Close()
+	if got != "GoTiny/1.0" {
+		t.Errorf("Expected User-Agent GoTiny/1.0, got %q", got)
+	}
+}
@@ -0,0 +1,153 @@
+// Package imaging decodes, orients, resizes and re-encodes images for the
+// compression API. It is pure Go, including its WebP encoder, so the service
+// can be built with CGO_ENABLED=0.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // register decoder
+	"image/jpeg"
+	_ "image/png" // register decoder
+	"io"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register decoder
+)
+
+// MaxPixels caps the decoded size of an input image, so a small file that
+// claims huge dimensions can't exhaust memory. It is checked against the
+// header before anything is decoded. Processing peaks at roughly 13 bytes a
+// pixel, so a 16 MP image needs about 210 MB.
+const MaxPixels = 16_000_000
+
+var (
+	// ErrUnsupportedFormat is returned for inputs that aren't JPEG, PNG, GIF or WebP
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+
+	// ErrTooLarge is returned for inputs with more than MaxPixels pixels
+	ErrTooLarge = errors.New("image dimensions are too large")
+)
+
+// Options control how an image is processed
+type Options struct {
+	Format    string // "jpeg" or "webp"
+	Quality   int    // 1-100
+	Lossless  bool   // WebP only; Quality is ignored
+	MaxWidth  int    // 0 means no limit
+	MaxHeight int    // 0 means no limit
+}
+
+// Process decodes data, applies its EXIF orientation, fits it within the
+// maximum dimensions and encodes it in the requested format
+func Process(data []byte, opts Options) ([]byte, error) {
+	img, _, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	img = Fit(img, opts.MaxWidth, opts.MaxHeight)
+
+	var buf bytes.Buffer
+	switch opts.Format {
+	case "jpeg":
+		err = EncodeJPEG(&buf, img, opts.Quality)
+	case "webp":
+		err = EncodeWebP(&buf, img, opts.Quality, opts.Lossless)
+	default:
+		return nil, fmt.Errorf("unsupported output format %q", opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Pixels returns how many pixels data's header declares, without decoding
+// the image
+func Pixels(data []byte) (int, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	return cfg.Width * cfg.Height, nil
+}
+
+// Decode decodes a JPEG, PNG, GIF or WebP image and rotates or flips it
+// upright according to its EXIF orientation. It returns the format name.
+func Decode(data []byte) (image.Image, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("decode %s header: %w", format, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("decode %s: %w", format, err)
+	}
+
+	if format == "jpeg" {
+		img = Orient(img, jpegOrientation(data))
+	}
+	return img, format, nil
+}
+
+// Fit scales img down, keeping its aspect ratio, so it fits within maxWidth
+// by maxHeight. A zero bound is unlimited. Images are never scaled up.
+func Fit(img image.Image, maxWidth, maxHeight int) image.Image {
+	b := img.Bounds()
+	w, h := fitSize(b.Dx(), b.Dy(), maxWidth, maxHeight)
+	if w == b.Dx() && h == b.Dy() {
+		return img
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, xdraw.Src, nil)
+	return dst
+}
+
+// fitSize returns the largest size with the aspect ratio of w by h that fits
+// the bounds
+func fitSize(w, h, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && w > maxWidth {
+		scale = float64(maxWidth) / float64(w)
+	}
+	if maxHeight > 0 && h > maxHeight {
+		scale = min(scale, float64(maxHeight)/float64(h))
+	}
+	if scale == 1 {
+		return w, h
+	}
+	return max(1, int(float64(w)*scale+0.5)), max(1, int(float64(h)*scale+0.5))
+}
+
+// EncodeJPEG writes img as a baseline JPEG. Transparent areas are flattened
+// onto white, since JPEG has no alpha channel.
+func EncodeJPEG(w io.Writer, img image.Image, quality int) error {
+	if err := jpeg.Encode(w, flatten(img), &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("encode jpeg: %w", err)
+	}
+	return nil
+}
+
+// flatten composites img over a white background if it may have transparency
+func flatten(img image.Image) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, b, img, b.Min, draw.Over)
+	return dst
+}
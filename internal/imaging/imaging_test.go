@@ -0,0 +1,280 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// testPattern draws a gradient with a distinct colour in each corner, so
+// rotations and flips are visible in the goldens
+func testPattern(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, color.NRGBA{uint8(x * 255 / w), uint8(y * 255 / h), 96, 255})
+		}
+	}
+	corner := func(x0, y0 int, c color.NRGBA) {
+		for y := y0; y < y0+h/4; y++ {
+			for x := x0; x < x0+w/4; x++ {
+				img.Set(x, y, c)
+			}
+		}
+	}
+	corner(0, 0, color.NRGBA{255, 0, 0, 255})
+	corner(w-w/4, 0, color.NRGBA{0, 255, 0, 255})
+	corner(0, h-h/4, color.NRGBA{0, 0, 255, 255})
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withOrientation inserts an EXIF APP1 segment with the given orientation
+// after the JPEG's start-of-image marker
+func withOrientation(data []byte, order binary.ByteOrder, orientation int) []byte {
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8) // IFD0 offset
+	order.PutUint16(tiff[8:], 1) // one entry
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], 3) // SHORT
+	order.PutUint32(tiff[14:], 1) // count
+	order.PutUint16(tiff[18:], uint16(orientation))
+	order.PutUint32(tiff[22:], 0) // no next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestGolden(t *testing.T) {
+	pattern := testPattern(64, 48)
+
+	var gifBuf bytes.Buffer
+	if err := gif.Encode(&gifBuf, pattern, &gif.Options{NumColors: 256}); err != nil {
+		t.Fatal(err)
+	}
+
+	transparent := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := range 16 {
+		for x := range 16 {
+			transparent.Set(x, y, color.NRGBA{200, 30, 30, uint8(x * 16)})
+		}
+	}
+
+	tests := []struct {
+		name      string
+		input     []byte
+		maxWidth  int
+		maxHeight int
+		flatten   bool
+	}{
+		{"png_original", encodePNG(t, pattern), 0, 0, false},
+		{"png_fit_width", encodePNG(t, pattern), 32, 0, false},
+		{"png_fit_box", encodePNG(t, pattern), 40, 20, false},
+		{"png_no_upscale", encodePNG(t, pattern), 200, 200, false},
+		{"gif_fit", gifBuf.Bytes(), 0, 24, false},
+		{"jpeg_orientation_3", withOrientation(encodeJPEG(t, pattern), binary.BigEndian, 3), 0, 0, false},
+		{"jpeg_orientation_6", withOrientation(encodeJPEG(t, pattern), binary.LittleEndian, 6), 0, 0, false},
+		{"jpeg_orientation_8_fit", withOrientation(encodeJPEG(t, pattern), binary.BigEndian, 8), 24, 24, false},
+		{"png_transparent_flattened", encodePNG(t, transparent), 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, _, err := Decode(tt.input)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			img = Fit(img, tt.maxWidth, tt.maxHeight)
+			if tt.flatten {
+				img = flatten(img)
+			}
+
+			got := encodePNG(t, img)
+			path := filepath.Join("testdata", tt.name+".golden.png")
+			if *update {
+				if err := os.WriteFile(path, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Missing golden file, run go test ./internal/imaging -update: %v", err)
+			}
+			wantImg, err := png.Decode(bytes.NewReader(want))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSamePixels(t, wantImg, img)
+		})
+	}
+}
+
+func assertSamePixels(t *testing.T, want, got image.Image) {
+	t.Helper()
+
+	if want.Bounds().Size() != got.Bounds().Size() {
+		t.Fatalf("Expected size %v, got %v", want.Bounds().Size(), got.Bounds().Size())
+	}
+	wb, gb := want.Bounds(), got.Bounds()
+	for y := range wb.Dy() {
+		for x := range wb.Dx() {
+			w := color.NRGBAModel.Convert(want.At(wb.Min.X+x, wb.Min.Y+y))
+			g := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+			if w != g {
+				t.Fatalf("Pixel (%d, %d): expected %v, got %v", x, y, w, g)
+			}
+		}
+	}
+}
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		w, h, maxW, maxH int
+		wantW, wantH     int
+	}{
+		{1000, 500, 0, 0, 1000, 500},
+		{1000, 500, 500, 0, 500, 250},
+		{1000, 500, 0, 100, 200, 100},
+		{1000, 500, 400, 400, 400, 200},
+		{1000, 500, 2000, 2000, 1000, 500},
+		{3000, 1, 100, 0, 100, 1},
+	}
+
+	for _, tt := range tests {
+		w, h := fitSize(tt.w, tt.h, tt.maxW, tt.maxH)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("fitSize(%d, %d, %d, %d): expected %dx%d, got %dx%d", tt.w, tt.h, tt.maxW, tt.maxH, tt.wantW, tt.wantH, w, h)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	plain := encodeJPEG(t, testPattern(8, 8))
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"no exif", plain, 1},
+		{"big endian", withOrientation(plain, binary.BigEndian, 6), 6},
+		{"little endian", withOrientation(plain, binary.LittleEndian, 8), 8},
+		{"out of range", withOrientation(plain, binary.BigEndian, 9), 1},
+		{"truncated", withOrientation(plain, binary.BigEndian, 6)[:20], 1},
+		{"not a jpeg", []byte("GIF89a"), 1},
+	}
+
+	for _, tt := range tests {
+		if got := jpegOrientation(tt.data); got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	if _, _, err := Decode([]byte("definitely not an image")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+	}
+
+	if _, _, err := Decode(pngClaiming(t, 100000, 100000)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge, got %v", err)
+	}
+}
+
+// pngClaiming returns a 1x1 PNG whose header claims w by h pixels, so only
+// the header can be read without error
+func pngClaiming(t *testing.T, w, h uint32) []byte {
+	t.Helper()
+
+	data := encodePNG(t, image.NewGray(image.Rect(0, 0, 1, 1)))
+	ihdr := data[12:29]
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(ihdr))
+	return data
+}
+
+func TestDecodeChecksPixelsBeforeDecoding(t *testing.T) {
+	// Just over the cap is refused from the header alone. Decoding would
+	// fail differently, since the pixel data is missing.
+	if _, _, err := Decode(pngClaiming(t, 4000, 4001)); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected ErrTooLarge for %d pixels, got %v", 4000*4001, err)
+	}
+
+	// At the cap the header is accepted and decoding starts
+	_, _, err := Decode(pngClaiming(t, 4000, 4000))
+	if err == nil || errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected a decode error for %d pixels, got %v", 4000*4000, err)
+	}
+}
+
+func TestProcessJPEG(t *testing.T) {
+	src := encodePNG(t, testPattern(200, 150))
+
+	high, err := Process(src, Options{Format: "jpeg", Quality: 95, MaxWidth: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	low, err := Process(src, Options{Format: "jpeg", Quality: 20, MaxWidth: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(low))
+	if err != nil {
+		t.Fatalf("Expected JPEG output: %v", err)
+	}
+	if cfg.Width != 100 || cfg.Height != 75 {
+		t.Errorf("Expected 100x75, got %dx%d", cfg.Width, cfg.Height)
+	}
+	if len(low) >= len(high) {
+		t.Errorf("Expected quality 20 (%d bytes) to be smaller than quality 95 (%d bytes)", len(low), len(high))
+	}
+
+	if _, err := Process(src, Options{Format: "bmp", Quality: 80}); err == nil {
+		t.Error("Expected an error for an unsupported output format")
+	}
+}
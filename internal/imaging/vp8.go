@@ -0,0 +1,833 @@
+package imaging
+
+import (
+	"fmt"
+)
+
+// This file implements a VP8 key frame (lossy WebP) encoder, as specified in
+// RFC 6386. Every macroblock uses whole-block 16x16 luma and 8x8 chroma
+// prediction, choosing the DC, TM, VE or HE mode with the smallest error. The
+// residuals go through the DCT and WHT and are quantized at one level for the
+// whole frame, then coded with the default token probabilities. The encoder
+// reconstructs each macroblock exactly as a decoder would, so later
+// predictions see the same pixels the decoder does.
+
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+)
+
+// maxFirstPartition is the largest first partition the 19-bit size field in
+// the frame header can describe
+const maxFirstPartition = 1<<19 - 1
+
+// boolEncoder is the boolean entropy encoder from RFC 6386 section 7
+type boolEncoder struct {
+	buf      []byte
+	rng      uint32
+	bottom   uint32
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{rng: 255, bitCount: 24}
+}
+
+// putBit writes bit, which is false with probability prob/256
+func (e *boolEncoder) putBit(bit bool, prob uint8) {
+	split := 1 + (e.rng-1)*uint32(prob)>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.carry()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= 1<<24 - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// putLiteral writes the n low bits of v, most significant first, at even odds
+func (e *boolEncoder) putLiteral(v uint32, n int) {
+	for n > 0 {
+		n--
+		e.putBit(v>>n&1 == 1, 128)
+	}
+}
+
+// carry propagates a carry into the bytes already written
+func (e *boolEncoder) carry() {
+	for i := len(e.buf) - 1; i >= 0; i-- {
+		e.buf[i]++
+		if e.buf[i] != 0 {
+			return
+		}
+	}
+}
+
+// flush writes out the remaining bits and returns the encoded bytes
+func (e *boolEncoder) flush() []byte {
+	c := e.bitCount
+	v := e.bottom
+	if v&(1<<(32-c)) != 0 {
+		e.carry()
+	}
+	v <<= c & 7
+	for c >>= 3; c > 0; c-- {
+		v <<= 8
+	}
+	for range 4 {
+		e.buf = append(e.buf, byte(v>>24))
+		v <<= 8
+	}
+	return e.buf
+}
+
+// quantizer holds the DC and AC step sizes for one kind of block
+type quantizer [2]int32
+
+// quantize maps a coefficient to a level. AC coefficients round towards zero
+// more eagerly, since zeros are cheap to code and small AC errors are hard to
+// see.
+func (q quantizer) quantize(c int32, ac bool) int32 {
+	step := q[0]
+	bias := step / 2
+	if ac {
+		step = q[1]
+		bias = step * 3 / 8
+	}
+	level := (absInt32(c) + bias) / step
+	level = min(level, 2048)
+	if c < 0 {
+		return -level
+	}
+	return level
+}
+
+// dequantize matches the decoder, which stores coefficients as int16
+func (q quantizer) dequantize(level int32, ac bool) int32 {
+	if ac {
+		return int32(int16(level * q[1]))
+	}
+	return int32(int16(level * q[0]))
+}
+
+// nzContext tracks which blocks along a macroblock edge had non-zero
+// coefficients, which selects the token probabilities for their neighbours
+type nzContext struct {
+	y  [4]uint8
+	u  [2]uint8
+	v  [2]uint8
+	y2 uint8
+}
+
+// macroblock is the first-partition information for one macroblock
+type macroblock struct {
+	lumaMode, chromaMode uint8
+	skip                 bool
+}
+
+type vp8Encoder struct {
+	width, height int
+	mbw, mbh      int
+
+	// Source and reconstructed planes, padded to whole macroblocks
+	srcY, srcU, srcV []uint8
+	recY, recU, recV []uint8
+	yStride, cStride int
+
+	qIndex       int
+	y1, y2, uv   quantizer
+	filterLevel  int
+	partitions   []*boolEncoder
+	macroblocks  []macroblock
+	topNz        []nzContext
+	leftNz       nzContext
+	skippedCount int
+}
+
+// encodeVP8 encodes w*h pixels, stored as RGBA bytes, as a VP8 key frame at
+// the given quality (1-100)
+func encodeVP8(pix []byte, w, h, quality int) ([]byte, error) {
+	e := newVP8Encoder(w, h, quality)
+	e.importPixels(pix)
+
+	for mby := range e.mbh {
+		e.leftNz = nzContext{}
+		for mbx := range e.mbw {
+			e.encodeMacroblock(mbx, mby)
+		}
+	}
+
+	first := e.firstPartition()
+	if len(first) > maxFirstPartition {
+		return nil, fmt.Errorf("encode webp: %dx%d image needs too many macroblock headers", w, h)
+	}
+
+	tag := uint32(len(first))<<5 | 1<<4 // key frame, version 0, shown
+	frame := []byte{
+		byte(tag), byte(tag >> 8), byte(tag >> 16),
+		0x9d, 0x01, 0x2a,
+		byte(w), byte(w >> 8), byte(h), byte(h >> 8),
+	}
+	frame = append(frame, first...)
+
+	parts := make([][]byte, len(e.partitions))
+	for i, p := range e.partitions {
+		parts[i] = p.flush()
+	}
+	for _, p := range parts[:len(parts)-1] {
+		n := len(p)
+		frame = append(frame, byte(n), byte(n>>8), byte(n>>16))
+	}
+	for _, p := range parts {
+		frame = append(frame, p...)
+	}
+	return frame, nil
+}
+
+func newVP8Encoder(w, h, quality int) *vp8Encoder {
+	quality = min(max(quality, 1), 100)
+	q := (100 - quality) * 127 / 99
+
+	e := &vp8Encoder{
+		width:  w,
+		height: h,
+		mbw:    (w + 15) / 16,
+		mbh:    (h + 15) / 16,
+		qIndex: q,
+		y1:     quantizer{int32(dequantTableDC[q]), int32(dequantTableAC[q])},
+		y2:     quantizer{int32(dequantTableDC[q]) * 2, max(int32(dequantTableAC[q])*155/100, 8)},
+		uv:     quantizer{int32(dequantTableDC[min(q, 117)]), int32(dequantTableAC[q])},
+		// Stronger quantization leaves stronger block edges to smooth over
+		filterLevel: min(q*3/8, 63),
+	}
+	e.yStride, e.cStride = 16*e.mbw, 8*e.mbw
+	e.srcY = make([]uint8, e.yStride*16*e.mbh)
+	e.srcU = make([]uint8, e.cStride*8*e.mbh)
+	e.srcV = make([]uint8, e.cStride*8*e.mbh)
+	e.recY = make([]uint8, len(e.srcY))
+	e.recU = make([]uint8, len(e.srcU))
+	e.recV = make([]uint8, len(e.srcV))
+
+	// Large images spread their tokens over eight partitions so no single
+	// partition outgrows the 24-bit size fields
+	n := 1
+	if w*h > 1<<22 {
+		n = 8
+	}
+	e.partitions = make([]*boolEncoder, n)
+	for i := range e.partitions {
+		e.partitions[i] = newBoolEncoder()
+	}
+	e.macroblocks = make([]macroblock, e.mbw*e.mbh)
+	e.topNz = make([]nzContext, e.mbw)
+	return e
+}
+
+// importPixels converts RGBA to 4:2:0 Y'CbCr with the BT.601 limited range
+// coefficients that VP8 decoders assume, repeating the last row and column
+// to fill partial macroblocks
+func (e *vp8Encoder) importPixels(pix []byte) {
+	rgb := func(x, y int) (int32, int32, int32) {
+		x, y = min(x, e.width-1), min(y, e.height-1)
+		p := pix[4*(y*e.width+x):]
+		return int32(p[0]), int32(p[1]), int32(p[2])
+	}
+
+	for y := range 16 * e.mbh {
+		for x := range 16 * e.mbw {
+			r, g, b := rgb(x, y)
+			e.srcY[y*e.yStride+x] = uint8((16839*r + 33059*g + 6420*b + 16<<16 + 1<<15) >> 16)
+		}
+	}
+	for y := range 8 * e.mbh {
+		for x := range 8 * e.mbw {
+			var r, g, b int32
+			for _, d := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				r1, g1, b1 := rgb(2*x+d[0], 2*y+d[1])
+				r, g, b = r+r1, g+g1, b+b1
+			}
+			// The sums of four pixels carry two extra bits of precision
+			e.srcU[y*e.cStride+x] = clampByte32((-9719*r - 19081*g + 28800*b + 128<<18 + 1<<17) >> 18)
+			e.srcV[y*e.cStride+x] = clampByte32((28800*r - 24116*g - 4684*b + 128<<18 + 1<<17) >> 18)
+		}
+	}
+}
+
+// edges holds the reconstructed pixels above and to the left of a block. Off
+// the top of the frame the decoder assumes 127, and off the left 129.
+type edges struct {
+	top, left       [16]uint8
+	topLeft         uint8
+	hasTop, hasLeft bool
+}
+
+func blockEdges(plane []uint8, stride, size, mbx, mby int) edges {
+	var e edges
+	x0, y0 := mbx*size, mby*size
+	e.hasTop, e.hasLeft = mby > 0, mbx > 0
+	for i := range size {
+		e.top[i], e.left[i] = 127, 129
+		if e.hasTop {
+			e.top[i] = plane[(y0-1)*stride+x0+i]
+		}
+		if e.hasLeft {
+			e.left[i] = plane[(y0+i)*stride+x0-1]
+		}
+	}
+	switch {
+	case !e.hasTop:
+		e.topLeft = 127
+	case !e.hasLeft:
+		e.topLeft = 129
+	default:
+		e.topLeft = plane[(y0-1)*stride+x0-1]
+	}
+	return e
+}
+
+// predict fills a size x size block with the prediction for mode, including
+// the DC variants the decoder uses along the top and left of the frame
+func (e edges) predict(mode uint8, size int, dst []uint8) {
+	switch mode {
+	case predDC:
+		dc := int32(128)
+		shift := 3
+		if size == 16 {
+			shift = 4
+		}
+		var sum int32
+		switch {
+		case e.hasTop && e.hasLeft:
+			for i := range size {
+				sum += int32(e.top[i]) + int32(e.left[i])
+			}
+			dc = (sum + int32(size)) >> (shift + 1)
+		case e.hasTop:
+			for i := range size {
+				sum += int32(e.top[i])
+			}
+			dc = (sum + int32(size)/2) >> shift
+		case e.hasLeft:
+			for i := range size {
+				sum += int32(e.left[i])
+			}
+			dc = (sum + int32(size)/2) >> shift
+		}
+		for i := range size * size {
+			dst[i] = uint8(dc)
+		}
+	case predTM:
+		for y := range size {
+			for x := range size {
+				dst[y*size+x] = clampByte32(int32(e.left[y]) + int32(e.top[x]) - int32(e.topLeft))
+			}
+		}
+	case predVE:
+		for y := range size {
+			copy(dst[y*size:y*size+size], e.top[:size])
+		}
+	case predHE:
+		for y := range size {
+			for x := range size {
+				dst[y*size+x] = e.left[y]
+			}
+		}
+	}
+}
+
+// bestMode returns the prediction mode with the smallest squared error over
+// one or more planes of a macroblock, and the predictions for that mode
+func bestMode(size int, srcs [][]uint8, stride, x0, y0 int, es []edges) (uint8, [][]uint8) {
+	var (
+		best     uint8
+		bestErr  int64 = -1
+		bestPred [][]uint8
+	)
+	for mode := uint8(predDC); mode <= predHE; mode++ {
+		preds := make([][]uint8, len(srcs))
+		var sse int64
+		for i, src := range srcs {
+			preds[i] = make([]uint8, size*size)
+			es[i].predict(mode, size, preds[i])
+			for y := range size {
+				for x := range size {
+					d := int64(src[(y0+y)*stride+x0+x]) - int64(preds[i][y*size+x])
+					sse += d * d
+				}
+			}
+		}
+		if bestErr < 0 || sse < bestErr {
+			best, bestErr, bestPred = mode, sse, preds
+		}
+	}
+	return best, bestPred
+}
+
+// encodeMacroblock predicts, transforms, quantizes and reconstructs one
+// macroblock, and writes its tokens
+func (e *vp8Encoder) encodeMacroblock(mbx, mby int) {
+	mb := &e.macroblocks[mby*e.mbw+mbx]
+
+	// Luma: sixteen 4x4 blocks whose DC coefficients go through the WHT
+	yEdges := blockEdges(e.recY, e.yStride, 16, mbx, mby)
+	var yPred [][]uint8
+	mb.lumaMode, yPred = bestMode(16, [][]uint8{e.srcY}, e.yStride, 16*mbx, 16*mby, []edges{yEdges})
+
+	var yCoeffs [16][16]int32
+	var dcs [16]int32
+	for n := range 16 {
+		bx, by := 4*(n%4), 4*(n/4)
+		var residual [16]int32
+		for y := range 4 {
+			for x := range 4 {
+				src := e.srcY[(16*mby+by+y)*e.yStride+16*mbx+bx+x]
+				residual[y*4+x] = int32(src) - int32(yPred[0][(by+y)*16+bx+x])
+			}
+		}
+		yCoeffs[n] = forwardDCT(residual)
+		dcs[n] = yCoeffs[n][0]
+	}
+
+	var y2Levels, y2Dequant [16]int32
+	whtCoeffs := forwardWHT(dcs)
+	for i, c := range whtCoeffs {
+		y2Levels[i] = e.y2.quantize(c, i > 0)
+		y2Dequant[i] = e.y2.dequantize(y2Levels[i], i > 0)
+	}
+	dcOut := inverseWHT(y2Dequant)
+
+	var yLevels [16][16]int32
+	var recon [16 * 16]uint8
+	copy(recon[:], yPred[0])
+	for n := range 16 {
+		var dequant [16]int32
+		for i := 1; i < 16; i++ {
+			yLevels[n][i] = e.y1.quantize(yCoeffs[n][i], true)
+			dequant[i] = e.y1.dequantize(yLevels[n][i], true)
+		}
+		dequant[0] = dcOut[n]
+		inverseDCT(dequant, recon[:], 16, 4*(n/4)*16+4*(n%4))
+	}
+	for y := range 16 {
+		copy(e.recY[(16*mby+y)*e.yStride+16*mbx:], recon[y*16:y*16+16])
+	}
+
+	// Chroma: four 4x4 blocks per plane, sharing one prediction mode
+	uEdges := blockEdges(e.recU, e.cStride, 8, mbx, mby)
+	vEdges := blockEdges(e.recV, e.cStride, 8, mbx, mby)
+	var cPred [][]uint8
+	mb.chromaMode, cPred = bestMode(8, [][]uint8{e.srcU, e.srcV}, e.cStride, 8*mbx, 8*mby, []edges{uEdges, vEdges})
+
+	var uvLevels [2][4][16]int32
+	for p, plane := range [2][]uint8{e.srcU, e.srcV} {
+		rec := [2][]uint8{e.recU, e.recV}[p]
+		var reconC [8 * 8]uint8
+		copy(reconC[:], cPred[p])
+		for n := range 4 {
+			bx, by := 4*(n%2), 4*(n/2)
+			var residual [16]int32
+			for y := range 4 {
+				for x := range 4 {
+					src := plane[(8*mby+by+y)*e.cStride+8*mbx+bx+x]
+					residual[y*4+x] = int32(src) - int32(cPred[p][(by+y)*8+bx+x])
+				}
+			}
+			coeffs := forwardDCT(residual)
+			var dequant [16]int32
+			for i, c := range coeffs {
+				uvLevels[p][n][i] = e.uv.quantize(c, i > 0)
+				dequant[i] = e.uv.dequantize(uvLevels[p][n][i], i > 0)
+			}
+			inverseDCT(dequant, reconC[:], 8, by*8+bx)
+		}
+		for y := range 8 {
+			copy(rec[(8*mby+y)*e.cStride+8*mbx:], reconC[y*8:y*8+8])
+		}
+	}
+
+	mb.skip = allZero(y2Levels[:])
+	for n := range 16 {
+		mb.skip = mb.skip && allZero(yLevels[n][1:])
+	}
+	for n := range 8 {
+		mb.skip = mb.skip && allZero(uvLevels[n/4][n%4][:])
+	}
+	if mb.skip {
+		// A skipped macroblock clears the contexts, just as coding its
+		// all-zero blocks would
+		e.skippedCount++
+		e.leftNz, e.topNz[mbx] = nzContext{}, nzContext{}
+		return
+	}
+
+	e.writeTokens(e.partitions[mby%len(e.partitions)], mbx, y2Levels, yLevels, uvLevels)
+}
+
+// writeTokens codes a macroblock's coefficients, tracking the non-zero
+// contexts the same way the decoder does
+func (e *vp8Encoder) writeTokens(w *boolEncoder, mbx int, y2 [16]int32, y [16][16]int32, uv [2][4][16]int32) {
+	top, left := &e.topNz[mbx], &e.leftNz
+
+	nz := writeBlock(w, planeY2, top.y2+left.y2, y2[:], 0)
+	top.y2, left.y2 = nz, nz
+
+	for by := range 4 {
+		for bx := range 4 {
+			nz := writeBlock(w, planeY1WithY2, top.y[bx]+left.y[by], y[4*by+bx][:], 1)
+			top.y[bx], left.y[by] = nz, nz
+		}
+	}
+
+	for p, ctx := range [2]struct{ top, left *[2]uint8 }{{&top.u, &left.u}, {&top.v, &left.v}} {
+		for by := range 2 {
+			for bx := range 2 {
+				nz := writeBlock(w, planeUV, ctx.top[bx]+ctx.left[by], uv[p][2*by+bx][:], 0)
+				ctx.top[bx], ctx.left[by] = nz, nz
+			}
+		}
+	}
+}
+
+// writeBlock codes the levels of one 4x4 block, held in raster order, from
+// scan position first onwards, as specified in section 13. It returns 1 if
+// any were non-zero.
+func writeBlock(w *boolEncoder, plane int, ctx uint8, levels []int32, first int) uint8 {
+	last := -1
+	for i := 15; i >= first; i-- {
+		if levels[zigzag[i]] != 0 {
+			last = i
+			break
+		}
+	}
+
+	probs := &defaultTokenProb[plane]
+	p := &probs[bands[first]][ctx]
+	if last < 0 {
+		w.putBit(false, p[0]) // end of block
+		return 0
+	}
+	w.putBit(true, p[0])
+
+	for i := first; i <= last; i++ {
+		v := levels[zigzag[i]]
+		a := absInt32(v)
+		if a == 0 {
+			w.putBit(false, p[1])
+			p = &probs[bands[i+1]][0]
+			continue // a zero is never followed by an end of block
+		}
+		w.putBit(true, p[1])
+
+		if a == 1 {
+			w.putBit(false, p[2])
+			p = &probs[bands[i+1]][1]
+		} else {
+			w.putBit(true, p[2])
+			writeLargeToken(w, p, a)
+			p = &probs[bands[i+1]][2]
+		}
+		w.putBit(v < 0, 128)
+
+		if i < 15 {
+			w.putBit(i < last, p[0])
+		}
+	}
+	return 1
+}
+
+// writeLargeToken codes a level of 2 or more, as specified in section 13.2
+func writeLargeToken(w *boolEncoder, p *[nProb]uint8, a int32) {
+	switch {
+	case a <= 4:
+		w.putBit(false, p[3])
+		if a == 2 {
+			w.putBit(false, p[4])
+		} else {
+			w.putBit(true, p[4])
+			w.putBit(a == 4, p[5])
+		}
+	case a <= 10:
+		w.putBit(true, p[3])
+		w.putBit(false, p[6])
+		if a <= 6 {
+			w.putBit(false, p[7])
+			w.putBit(a == 6, 159) // category 1
+		} else {
+			w.putBit(true, p[7])
+			w.putBit((a-7)&2 != 0, 165) // category 2
+			w.putBit((a-7)&1 != 0, 145)
+		}
+	default:
+		w.putBit(true, p[3])
+		w.putBit(true, p[6])
+		cat, base := 3, int32(67)
+		switch {
+		case a < 19:
+			cat, base = 0, 11
+		case a < 35:
+			cat, base = 1, 19
+		case a < 67:
+			cat, base = 2, 35
+		}
+		w.putBit(cat >= 2, p[8])
+		w.putBit(cat&1 == 1, p[9+cat>>1])
+		extra := a - base
+		tab := cat3456[cat]
+		for i, prob := range tab {
+			w.putBit(extra>>(len(tab)-1-i)&1 == 1, prob)
+		}
+	}
+}
+
+// firstPartition writes the frame header and the per-macroblock modes, as
+// specified in sections 9 and 19.2
+func (e *vp8Encoder) firstPartition() []byte {
+	w := newBoolEncoder()
+	w.putBit(false, 128) // color space
+	w.putBit(false, 128) // clamping type
+	w.putBit(false, 128) // no segmentation
+
+	w.putBit(false, 128) // normal loop filter
+	w.putLiteral(uint32(e.filterLevel), 6)
+	w.putLiteral(0, 3)   // sharpness
+	w.putBit(false, 128) // no loop filter deltas
+
+	log2Parts := 0
+	for 1<<log2Parts < len(e.partitions) {
+		log2Parts++
+	}
+	w.putLiteral(uint32(log2Parts), 2)
+
+	w.putLiteral(uint32(e.qIndex), 7)
+	for range 5 {
+		w.putBit(false, 128) // no quantizer deltas
+	}
+	w.putBit(false, 128) // refresh entropy probs
+
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for _, prob := range tokenProbUpdateProb[i][j][k] {
+					w.putBit(false, prob) // keep the default
+				}
+			}
+		}
+	}
+
+	// The skip flag is worth sending when some macroblocks have nothing to
+	// code; its probability is that of a macroblock not being skipped
+	useSkip := e.skippedCount > 0
+	var skipProb uint8
+	w.putBit(useSkip, 128)
+	if useSkip {
+		notSkipped := len(e.macroblocks) - e.skippedCount
+		skipProb = uint8(min(max(notSkipped*256/len(e.macroblocks), 1), 255))
+		w.putLiteral(uint32(skipProb), 8)
+	}
+
+	for _, mb := range e.macroblocks {
+		if useSkip {
+			w.putBit(mb.skip, skipProb)
+		}
+		w.putBit(true, 145) // 16x16 luma prediction
+		switch mb.lumaMode {
+		case predDC:
+			w.putBit(false, 156)
+			w.putBit(false, 163)
+		case predVE:
+			w.putBit(false, 156)
+			w.putBit(true, 163)
+		case predHE:
+			w.putBit(true, 156)
+			w.putBit(false, 128)
+		case predTM:
+			w.putBit(true, 156)
+			w.putBit(true, 128)
+		}
+		switch mb.chromaMode {
+		case predDC:
+			w.putBit(false, 142)
+		case predVE:
+			w.putBit(true, 142)
+			w.putBit(false, 114)
+		case predHE:
+			w.putBit(true, 142)
+			w.putBit(true, 114)
+			w.putBit(false, 183)
+		case predTM:
+			w.putBit(true, 142)
+			w.putBit(true, 114)
+			w.putBit(true, 183)
+		}
+	}
+	return w.flush()
+}
+
+// forwardDCT is the 4x4 forward DCT from libvpx (vp8_short_fdct4x4_c). Rows
+// of the result are vertical frequencies.
+func forwardDCT(in [16]int32) [16]int32 {
+	var tmp, out [16]int32
+	for i := range 4 {
+		r := in[4*i : 4*i+4]
+		a := (r[0] + r[3]) * 8
+		b := (r[1] + r[2]) * 8
+		c := (r[1] - r[2]) * 8
+		d := (r[0] - r[3]) * 8
+		tmp[4*i+0] = a + b
+		tmp[4*i+2] = a - b
+		tmp[4*i+1] = (c*2217 + d*5352 + 14500) >> 12
+		tmp[4*i+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+	for i := range 4 {
+		a := tmp[i] + tmp[12+i]
+		b := tmp[4+i] + tmp[8+i]
+		c := tmp[4+i] - tmp[8+i]
+		d := tmp[i] - tmp[12+i]
+		out[i] = (a + b + 7) >> 4
+		out[8+i] = (a - b + 7) >> 4
+		out[4+i] = (c*2217 + d*5352 + 12000) >> 16
+		if d != 0 {
+			out[4+i]++
+		}
+		out[12+i] = (d*2217 - c*5352 + 51000) >> 16
+	}
+	return out
+}
+
+// inverseDCT adds the inverse transform of coeffs to the 4x4 block at offset
+// in dst, exactly as the decoder does
+func inverseDCT(coeffs [16]int32, dst []uint8, stride, offset int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	var m [4][4]int32
+	for i := range 4 {
+		a := coeffs[i] + coeffs[8+i]
+		b := coeffs[i] - coeffs[8+i]
+		c := (coeffs[4+i]*c2)>>16 - (coeffs[12+i]*c1)>>16
+		d := (coeffs[4+i]*c1)>>16 + (coeffs[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + c
+		m[i][2] = b - c
+		m[i][3] = a - d
+	}
+	for j := range 4 {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		row := dst[offset+j*stride:]
+		row[0] = clampByte32(int32(row[0]) + (a+d)>>3)
+		row[1] = clampByte32(int32(row[1]) + (b+c)>>3)
+		row[2] = clampByte32(int32(row[2]) + (b-c)>>3)
+		row[3] = clampByte32(int32(row[3]) + (a-d)>>3)
+	}
+}
+
+// forwardWHT is the Walsh-Hadamard transform of the luma DC coefficients from
+// libvpx (vp8_short_walsh4x4_c)
+func forwardWHT(in [16]int32) [16]int32 {
+	var tmp, out [16]int32
+	for i := range 4 {
+		r := in[4*i : 4*i+4]
+		a := (r[0] + r[2]) * 4
+		d := (r[1] + r[3]) * 4
+		c := (r[1] - r[3]) * 4
+		b := (r[0] - r[2]) * 4
+		tmp[4*i+0] = a + d
+		if a != 0 {
+			tmp[4*i+0]++
+		}
+		tmp[4*i+1] = b + c
+		tmp[4*i+2] = b - c
+		tmp[4*i+3] = a - d
+	}
+	for i := range 4 {
+		a := tmp[i] + tmp[8+i]
+		d := tmp[4+i] + tmp[12+i]
+		c := tmp[4+i] - tmp[12+i]
+		b := tmp[i] - tmp[8+i]
+		for k, v := range [4]int32{a + d, b + c, b - c, a - d} {
+			if v < 0 {
+				v++
+			}
+			out[4*k+i] = (v + 3) >> 3
+		}
+	}
+	return out
+}
+
+// inverseWHT returns the luma DC coefficients, exactly as the decoder
+// computes them
+func inverseWHT(in [16]int32) [16]int32 {
+	var m, out [16]int32
+	for i := range 4 {
+		a0 := in[i] + in[12+i]
+		a1 := in[4+i] + in[8+i]
+		a2 := in[4+i] - in[8+i]
+		a3 := in[i] - in[12+i]
+		m[i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := range 4 {
+		dc := m[4*i] + 3
+		a0 := dc + m[4*i+3]
+		a1 := m[4*i+1] + m[4*i+2]
+		a2 := m[4*i+1] - m[4*i+2]
+		a3 := dc - m[4*i+3]
+		out[4*i+0] = int32(int16((a0 + a1) >> 3))
+		out[4*i+1] = int32(int16((a3 + a2) >> 3))
+		out[4*i+2] = int32(int16((a0 - a1) >> 3))
+		out[4*i+3] = int32(int16((a3 - a2) >> 3))
+	}
+	return out
+}
+
+func allZero(levels []int32) bool {
+	for _, l := range levels {
+		if l != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func absInt32(x int32) int32 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func clampByte(x int) byte {
+	return byte(min(max(x, 0), 255))
+}
+
+func clampByte32(x int32) byte {
+	return byte(min(max(x, 0), 255))
+}
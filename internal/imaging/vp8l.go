@@ -0,0 +1,614 @@
+package imaging
+
+import (
+	"slices"
+)
+
+// This file implements a VP8L (lossless WebP) encoder. It applies the subtract
+// green and predictor transforms, finds LZ77 back references with a hash
+// chain, and codes the result with one set of canonical Huffman codes. It
+// skips the color cache and meta Huffman codes, which cost more code than they
+// save on typical photos.
+
+const (
+	vp8lMagic = 0x2f
+
+	vp8lTransformPredictor     = 0
+	vp8lTransformSubtractGreen = 2
+
+	// vp8lPredictorBits is the log2 size of the predictor transform's tiles
+	vp8lPredictorBits = 4
+
+	vp8lLiteralCodes  = 256
+	vp8lLengthCodes   = 24
+	vp8lDistanceCodes = 40
+
+	vp8lMaxCodeLength       = 15
+	vp8lMaxCodeLengthLength = 7
+
+	lz77MinMatch  = 3
+	lz77MaxMatch  = 4096
+	lz77Window    = 1 << 18
+	lz77HashBits  = 16
+	lz77MaxChains = 32
+)
+
+// codeLengthCodeOrder is the order code length code lengths are written in
+var codeLengthCodeOrder = [19]uint8{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lBitWriter packs values least significant bit first
+type vp8lBitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint
+}
+
+func (b *vp8lBitWriter) write(v uint32, n uint) {
+	b.bits |= uint64(v) << b.nBits
+	b.nBits += n
+	for b.nBits >= 8 {
+		b.buf = append(b.buf, byte(b.bits))
+		b.bits >>= 8
+		b.nBits -= 8
+	}
+}
+
+func (b *vp8lBitWriter) bytes() []byte {
+	if b.nBits > 0 {
+		b.buf = append(b.buf, byte(b.bits))
+		b.bits, b.nBits = 0, 0
+	}
+	return b.buf
+}
+
+// encodeVP8L encodes w*h pixels, stored as RGBA bytes, as a VP8L bitstream.
+// The ALPH chunk of a lossy image holds the same bitstream without its
+// header, and has nothing in the red and blue channels to decorrelate.
+func encodeVP8L(pix []byte, w, h int, header, subtractGreen bool) []byte {
+	var bw vp8lBitWriter
+	if header {
+		alphaUsed := uint32(0)
+		for i := 3; i < len(pix); i += 4 {
+			if pix[i] != 0xff {
+				alphaUsed = 1
+				break
+			}
+		}
+		bw.write(vp8lMagic, 8)
+		bw.write(uint32(w-1), 14)
+		bw.write(uint32(h-1), 14)
+		bw.write(alphaUsed, 1)
+		bw.write(0, 3) // version
+	}
+
+	pix = slices.Clone(pix)
+	if subtractGreen {
+		bw.write(1, 1)
+		bw.write(vp8lTransformSubtractGreen, 2)
+		for p := 0; p < len(pix); p += 4 {
+			pix[p+0] -= pix[p+1]
+			pix[p+2] -= pix[p+1]
+		}
+	}
+
+	bw.write(1, 1)
+	bw.write(vp8lTransformPredictor, 2)
+	bw.write(vp8lPredictorBits-2, 3)
+	modes, residuals := predictorTransform(pix, w, h, vp8lPredictorBits)
+	tiles := vp8lTiles(w, vp8lPredictorBits)
+	writeVP8LImage(&bw, modes, tiles, false)
+
+	bw.write(0, 1) // no more transforms
+	writeVP8LImage(&bw, residuals, w, true)
+	return bw.bytes()
+}
+
+// vp8lTiles is the number of tiles of the given log2 size covering size pixels
+func vp8lTiles(size int, bits uint) int {
+	return (size + 1<<bits - 1) >> bits
+}
+
+// predictorTransform picks the predictor that leaves the smallest residuals in
+// each tile. It returns the sub-image of modes, held in the green channel, and
+// the residuals.
+func predictorTransform(pix []byte, w, h int, bits uint) ([]byte, []byte) {
+	tilesX, tilesY := vp8lTiles(w, bits), vp8lTiles(h, bits)
+	modes := make([]byte, 4*tilesX*tilesY)
+	residuals := make([]byte, len(pix))
+
+	for ty := range tilesY {
+		for tx := range tilesX {
+			x0, y0 := tx<<bits, ty<<bits
+			x1, y1 := min(x0+1<<bits, w), min(y0+1<<bits, h)
+
+			best, bestCost := 0, -1
+			for mode := range 14 {
+				cost := 0
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						p := 4 * (y*w + x)
+						pred := vp8lPredict(pix, p, w, x, y, mode)
+						for c := range 4 {
+							cost += absInt(int(int8(pix[p+c] - pred[c])))
+						}
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					best, bestCost = mode, cost
+				}
+			}
+			modes[4*(ty*tilesX+tx)+1] = byte(best)
+			modes[4*(ty*tilesX+tx)+3] = 0xff
+
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					p := 4 * (y*w + x)
+					pred := vp8lPredict(pix, p, w, x, y, best)
+					for c := range 4 {
+						residuals[p+c] = pix[p+c] - pred[c]
+					}
+				}
+			}
+		}
+	}
+	return modes, residuals
+}
+
+// vp8lPredict predicts the pixel at byte offset p, as specified in section
+// 4.1. The top row and left column always use fixed predictors.
+func vp8lPredict(pix []byte, p, w, x, y, mode int) [4]byte {
+	switch {
+	case x == 0 && y == 0:
+		mode = 0
+	case y == 0:
+		mode = 1
+	case x == 0:
+		mode = 2
+	}
+
+	var pred [4]byte
+	top := p - 4*w
+	switch mode {
+	case 0:
+		pred[3] = 0xff
+		return pred
+	case 1:
+		copy(pred[:], pix[p-4:p])
+		return pred
+	case 2:
+		copy(pred[:], pix[top:top+4])
+		return pred
+	}
+
+	if mode == 11 {
+		var l, t int
+		for c := range 4 {
+			tl := int(pix[top-4+c])
+			t += absInt(tl - int(pix[top+c]))
+			l += absInt(tl - int(pix[p-4+c]))
+		}
+		src := top
+		if t < l {
+			src = p - 4
+		}
+		copy(pred[:], pix[src:src+4])
+		return pred
+	}
+
+	for c := range 4 {
+		L, T, TR, TL := pix[p-4+c], pix[top+c], pix[top+4+c], pix[top-4+c]
+		var v byte
+		switch mode {
+		case 3:
+			v = TR
+		case 4:
+			v = TL
+		case 5:
+			v = avg2(avg2(L, TR), T)
+		case 6:
+			v = avg2(L, TL)
+		case 7:
+			v = avg2(L, T)
+		case 8:
+			v = avg2(TL, T)
+		case 9:
+			v = avg2(T, TR)
+		case 10:
+			v = avg2(avg2(L, TL), avg2(T, TR))
+		case 12:
+			v = clampByte(int(L) + int(T) - int(TL))
+		case 13:
+			a := avg2(L, T)
+			v = clampByte(int(a) + (int(a)-int(TL))/2)
+		}
+		pred[c] = v
+	}
+	return pred
+}
+
+func avg2(a, b byte) byte {
+	return byte((int(a) + int(b)) / 2)
+}
+
+// lz77Token is a literal pixel, or a back reference when length is non-zero
+type lz77Token struct {
+	pixel    uint32 // ARGB
+	length   int
+	distCode int
+}
+
+// writeVP8LImage entropy codes an image, as specified in section 5
+func writeVP8LImage(bw *vp8lBitWriter, pix []byte, w int, topLevel bool) {
+	bw.write(0, 1) // no color cache
+	if topLevel {
+		bw.write(0, 1) // no meta Huffman codes
+	}
+
+	tokens := lz77(pix, w)
+
+	histograms := [5][]uint32{
+		make([]uint32, vp8lLiteralCodes+vp8lLengthCodes),
+		make([]uint32, vp8lLiteralCodes),
+		make([]uint32, vp8lLiteralCodes),
+		make([]uint32, vp8lLiteralCodes),
+		make([]uint32, vp8lDistanceCodes),
+	}
+	for _, t := range tokens {
+		if t.length > 0 {
+			sym, _, _ := vp8lPrefix(t.length)
+			histograms[0][vp8lLiteralCodes+sym]++
+			sym, _, _ = vp8lPrefix(t.distCode)
+			histograms[4][sym]++
+			continue
+		}
+		histograms[0][t.pixel>>8&0xff]++
+		histograms[1][t.pixel>>16&0xff]++
+		histograms[2][t.pixel&0xff]++
+		histograms[3][t.pixel>>24]++
+	}
+
+	var codes [5]huffmanCode
+	for i, hist := range histograms {
+		codes[i] = newHuffmanCode(hist, vp8lMaxCodeLength)
+		codes[i].writeTo(bw)
+	}
+
+	for _, t := range tokens {
+		if t.length > 0 {
+			sym, n, extra := vp8lPrefix(t.length)
+			codes[0].put(bw, vp8lLiteralCodes+sym)
+			bw.write(extra, n)
+			sym, n, extra = vp8lPrefix(t.distCode)
+			codes[4].put(bw, sym)
+			bw.write(extra, n)
+			continue
+		}
+		codes[0].put(bw, int(t.pixel>>8&0xff))
+		codes[1].put(bw, int(t.pixel>>16&0xff))
+		codes[2].put(bw, int(t.pixel&0xff))
+		codes[3].put(bw, int(t.pixel>>24))
+	}
+}
+
+// vp8lPrefix splits a length or distance code into a prefix symbol and extra
+// bits, the inverse of the decoder's section 4.2.2 calculation
+func vp8lPrefix(v int) (symbol int, nExtra uint, extra uint32) {
+	n := v - 1
+	if n < 4 {
+		return n, 0, 0
+	}
+	hb := 0
+	for n>>(hb+1) != 0 {
+		hb++
+	}
+	second := n >> (hb - 1) & 1
+	nExtra = uint(hb - 1)
+	return 2*hb + second, nExtra, uint32(n) & (1<<nExtra - 1)
+}
+
+// lz77 turns pixels into literals and back references, finding matches with
+// a hash chain over the next lz77MinMatch pixels
+func lz77(pix []byte, w int) []lz77Token {
+	n := len(pix) / 4
+	argb := make([]uint32, n)
+	for i := range argb {
+		p := pix[4*i : 4*i+4]
+		argb[i] = uint32(p[3])<<24 | uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+	}
+
+	head := make([]int32, 1<<lz77HashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, n)
+	hash := func(i int) uint32 {
+		h := argb[i]*0x1e35a7bd ^ argb[i+1]*0x9e3779b1 ^ argb[i+2]*0x85ebca6b
+		return h >> (32 - lz77HashBits)
+	}
+	insert := func(i int) {
+		if i+lz77MinMatch <= n {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	var tokens []lz77Token
+	for i := 0; i < n; {
+		bestLen, bestDist := 0, 0
+		if i+lz77MinMatch <= n {
+			maxLen := min(lz77MaxMatch, n-i)
+			for cand, chain := head[hash(i)], 0; cand >= 0 && chain < lz77MaxChains; cand, chain = prev[cand], chain+1 {
+				dist := i - int(cand)
+				if dist > lz77Window {
+					break
+				}
+				l := 0
+				for l < maxLen && argb[int(cand)+l] == argb[i+l] {
+					l++
+				}
+				if l > bestLen {
+					bestLen, bestDist = l, dist
+					if l == maxLen {
+						break
+					}
+				}
+			}
+		}
+
+		if bestLen < lz77MinMatch {
+			tokens = append(tokens, lz77Token{pixel: argb[i]})
+			insert(i)
+			i++
+			continue
+		}
+
+		tokens = append(tokens, lz77Token{length: bestLen, distCode: vp8lDistanceCode(bestDist, w)})
+		for j := i; j < i+bestLen; j++ {
+			insert(j)
+		}
+		i += bestLen
+	}
+	return tokens
+}
+
+// vp8lDistanceCode maps a distance in pixels to a distance code. The pixels
+// directly above and to the left have short codes; everything else is offset
+// past the 120 two-dimensional codes.
+func vp8lDistanceCode(dist, w int) int {
+	switch dist {
+	case w:
+		return 1
+	case 1:
+		return 2
+	}
+	return dist + 120
+}
+
+// huffmanCode is a canonical prefix code, as specified in section 3.7.2.1
+type huffmanCode struct {
+	lengths []uint8
+	codes   []uint16 // bit-reversed, ready to be written least significant bit first
+	used    []int    // symbols with a non-zero length, in ascending order
+}
+
+// newHuffmanCode builds a code from symbol frequencies with no code longer
+// than maxLength. Halving the frequencies until the tree is shallow enough
+// costs a little compression but is far simpler than package-merge.
+func newHuffmanCode(hist []uint32, maxLength int) huffmanCode {
+	code := huffmanCode{
+		lengths: make([]uint8, len(hist)),
+		codes:   make([]uint16, len(hist)),
+	}
+	for sym, f := range hist {
+		if f > 0 {
+			code.used = append(code.used, sym)
+		}
+	}
+	switch len(code.used) {
+	case 0:
+		return code
+	case 1:
+		// A lone symbol is coded with zero bits
+		code.lengths[code.used[0]] = 1
+		return code
+	}
+
+	freqs := slices.Clone(hist)
+	for !huffmanLengths(freqs, code.used, code.lengths, maxLength) {
+		for _, sym := range code.used {
+			freqs[sym] = (freqs[sym] + 1) / 2
+		}
+	}
+
+	// Assign canonical codes in order of length, then symbol
+	var count [vp8lMaxCodeLength + 1]uint16
+	for _, sym := range code.used {
+		count[code.lengths[sym]]++
+	}
+	var next [vp8lMaxCodeLength + 1]uint16
+	for l := 2; l <= vp8lMaxCodeLength; l++ {
+		next[l] = (next[l-1] + count[l-1]) << 1
+	}
+	for _, sym := range code.used {
+		l := code.lengths[sym]
+		code.codes[sym] = reverseBits(next[l], l)
+		next[l]++
+	}
+	return code
+}
+
+// huffmanLengths sets the code lengths of a Huffman tree over the used
+// symbols. It reports false if any code is longer than maxLength.
+func huffmanLengths(freqs []uint32, used []int, lengths []uint8, maxLength int) bool {
+	type node struct {
+		freq   uint64
+		parent int
+	}
+	nodes := make([]node, 0, 2*len(used))
+	for _, sym := range used {
+		nodes = append(nodes, node{freq: uint64(freqs[sym]), parent: -1})
+	}
+	leaves := make([]int, len(used))
+	for i := range leaves {
+		leaves[i] = i
+	}
+	slices.SortStableFunc(leaves, func(a, b int) int {
+		return cmpUint64(nodes[a].freq, nodes[b].freq)
+	})
+
+	// Two-queue construction: leaves in frequency order, and internal nodes,
+	// which are created in frequency order
+	var internal []int
+	li, ii := 0, 0
+	pop := func() int {
+		if li < len(leaves) && (ii >= len(internal) || nodes[leaves[li]].freq <= nodes[internal[ii]].freq) {
+			li++
+			return leaves[li-1]
+		}
+		ii++
+		return internal[ii-1]
+	}
+	for range len(used) - 1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq, parent: -1})
+		parent := len(nodes) - 1
+		nodes[a].parent, nodes[b].parent = parent, parent
+		internal = append(internal, parent)
+	}
+
+	// Nodes are created after their children, so depths resolve root first
+	depth := make([]int, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depth[i] = depth[nodes[i].parent] + 1
+	}
+	for i, sym := range used {
+		if depth[i] > maxLength {
+			return false
+		}
+		lengths[sym] = uint8(depth[i])
+	}
+	return true
+}
+
+func cmpUint64(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func reverseBits(v uint16, n uint8) uint16 {
+	var r uint16
+	for range n {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return r
+}
+
+// put writes a symbol's code
+func (c *huffmanCode) put(bw *vp8lBitWriter, sym int) {
+	if len(c.used) > 1 {
+		bw.write(uint32(c.codes[sym]), uint(c.lengths[sym]))
+	}
+}
+
+// writeTo writes the code lengths, as specified in section 3.7.2.1. Codes with
+// at most two 8-bit symbols use the compact simple form.
+func (c *huffmanCode) writeTo(bw *vp8lBitWriter) {
+	if len(c.used) == 0 {
+		// The decoder needs at least one symbol even if none are coded
+		bw.write(1, 1) // simple
+		bw.write(0, 1) // one symbol
+		bw.write(0, 1) // 1-bit symbol
+		bw.write(0, 1)
+		return
+	}
+	if len(c.used) <= 2 && c.used[len(c.used)-1] < 256 {
+		bw.write(1, 1)
+		bw.write(uint32(len(c.used)-1), 1)
+		if c.used[0] < 2 {
+			bw.write(0, 1)
+			bw.write(uint32(c.used[0]), 1)
+		} else {
+			bw.write(1, 1)
+			bw.write(uint32(c.used[0]), 8)
+		}
+		if len(c.used) == 2 {
+			bw.write(uint32(c.used[1]), 8)
+		}
+		return
+	}
+
+	bw.write(0, 1)
+
+	// Run-length code the lengths with the repeat codes 16, 17 and 18
+	type clToken struct {
+		sym   int
+		extra uint32
+		n     uint
+	}
+	var tokens []clToken
+	prev := uint8(8)
+	for i := 0; i < len(c.lengths); {
+		l := c.lengths[i]
+		run := 1
+		for i+run < len(c.lengths) && c.lengths[i+run] == l {
+			run++
+		}
+		i += run
+
+		if l == 0 {
+			for run >= 3 {
+				if run >= 11 {
+					k := min(run, 138)
+					tokens = append(tokens, clToken{18, uint32(k - 11), 7})
+					run -= k
+				} else {
+					k := min(run, 10)
+					tokens = append(tokens, clToken{17, uint32(k - 3), 3})
+					run -= k
+				}
+			}
+		} else {
+			if l != prev {
+				tokens = append(tokens, clToken{sym: int(l)})
+				prev = l
+				run--
+			}
+			for run >= 3 {
+				k := min(run, 6)
+				tokens = append(tokens, clToken{16, uint32(k - 3), 2})
+				run -= k
+			}
+		}
+		for range run {
+			tokens = append(tokens, clToken{sym: int(l)})
+		}
+	}
+
+	hist := make([]uint32, len(codeLengthCodeOrder))
+	for _, t := range tokens {
+		hist[t.sym]++
+	}
+	clCode := newHuffmanCode(hist, vp8lMaxCodeLengthLength)
+
+	nCodes := len(codeLengthCodeOrder)
+	for nCodes > 4 && clCode.lengths[codeLengthCodeOrder[nCodes-1]] == 0 {
+		nCodes--
+	}
+	bw.write(uint32(nCodes-4), 4)
+	for _, sym := range codeLengthCodeOrder[:nCodes] {
+		bw.write(uint32(clCode.lengths[sym]), 3)
+	}
+
+	bw.write(0, 1) // code lengths for every symbol follow
+	for _, t := range tokens {
+		clCode.put(bw, t.sym)
+		bw.write(t.extra, t.n)
+	}
+}
@@ -0,0 +1,123 @@
+package imaging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// maxWebPDimension is the largest width or height a WebP image can have
+const maxWebPDimension = 16383
+
+// riffChunk is one chunk of a RIFF container
+type riffChunk struct {
+	fourCC string
+	data   []byte
+}
+
+// EncodeWebP writes img as a WebP image. Lossy output is a VP8 frame at the
+// given quality (1-100); lossless output is VP8L and keeps every pixel
+// exactly, ignoring quality. Both keep transparency.
+func EncodeWebP(w io.Writer, img image.Image, quality int, lossless bool) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > maxWebPDimension || height > maxWebPDimension {
+		return fmt.Errorf("encode webp: %dx%d is outside the %dx%d WebP limit", width, height, maxWebPDimension, maxWebPDimension)
+	}
+
+	pix := nrgbaPixels(img)
+
+	var chunks []riffChunk
+	switch {
+	case lossless:
+		chunks = []riffChunk{{"VP8L", encodeVP8L(pix, width, height, true, true)}}
+	default:
+		frame, err := encodeVP8(pix, width, height, quality)
+		if err != nil {
+			return err
+		}
+		alpha := alphaPlane(pix)
+		if alpha == nil {
+			chunks = []riffChunk{{"VP8 ", frame}}
+			break
+		}
+
+		// VP8 has no alpha channel, so it goes alongside the frame in a
+		// losslessly compressed ALPH chunk
+		extended := make([]byte, 10)
+		extended[0] = 0x10 // alpha flag
+		putUint24(extended[4:], uint32(width-1))
+		putUint24(extended[7:], uint32(height-1))
+		alphaChunk := append([]byte{1}, encodeVP8L(alpha, width, height, false, false)...) // 1: VP8L compressed
+		chunks = []riffChunk{{"VP8X", extended}, {"ALPH", alphaChunk}, {"VP8 ", frame}}
+	}
+
+	return writeRIFF(w, chunks)
+}
+
+// nrgbaPixels returns the pixels of img as non-premultiplied RGBA bytes, so
+// lossy encoding sees the true colour of translucent pixels
+func nrgbaPixels(img image.Image) []byte {
+	b := img.Bounds()
+	if m, ok := img.(*image.NRGBA); ok && m.Stride == 4*b.Dx() {
+		return m.Pix[:4*b.Dx()*b.Dy()]
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst.Pix
+}
+
+// alphaPlane returns the alpha channel laid out in the green channel of an
+// otherwise empty image, which is how the ALPH chunk stores it, or nil if
+// every pixel is opaque
+func alphaPlane(pix []byte) []byte {
+	opaque := true
+	for i := 3; i < len(pix); i += 4 {
+		if pix[i] != 0xff {
+			opaque = false
+			break
+		}
+	}
+	if opaque {
+		return nil
+	}
+
+	alpha := make([]byte, len(pix))
+	for i := 0; i < len(pix); i += 4 {
+		alpha[i+1] = pix[i+3]
+		alpha[i+3] = 0xff
+	}
+	return alpha
+}
+
+// writeRIFF writes a WebP RIFF container, padding odd-sized chunks
+func writeRIFF(w io.Writer, chunks []riffChunk) error {
+	size := 4 // "WEBP"
+	for _, c := range chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+
+	buf := make([]byte, 0, 8+size)
+	buf = append(buf, "RIFF"...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(size))
+	buf = append(buf, "WEBP"...)
+	for _, c := range chunks {
+		buf = append(buf, c.fourCC...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(c.data)))
+		buf = append(buf, c.data...)
+		if len(c.data)&1 == 1 {
+			buf = append(buf, 0)
+		}
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("encode webp: %w", err)
+	}
+	return nil
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
@@ -0,0 +1,214 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+// photoPattern is a smooth gradient with mild noise, which compresses more
+// like a photo than testPattern's flat blocks do
+func photoPattern(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rng := rand.New(rand.NewSource(1))
+	for y := range h {
+		for x := range w {
+			n := rng.Intn(12)
+			img.Set(x, y, color.NRGBA{
+				uint8(x*200/w + n),
+				uint8(y*200/h + n/2),
+				uint8((x+y)*200/(w+h) + 40 - n),
+				255,
+			})
+		}
+	}
+	return img
+}
+
+// psnr compares a decoded lossy WebP with its source. VP8 stores BT.601
+// limited range Y'CbCr, which image.YCbCr's own conversion doesn't assume,
+// so the conversion to RGB is done here.
+func psnr(t *testing.T, src *image.NRGBA, decoded image.Image) float64 {
+	t.Helper()
+	ycc, ok := decoded.(*image.YCbCr)
+	if !ok {
+		t.Fatalf("Expected *image.YCbCr, got %T", decoded)
+	}
+
+	var sum float64
+	b := src.Bounds()
+	for y := range b.Dy() {
+		for x := range b.Dx() {
+			c := ycc.YCbCrAt(x, y)
+			l := 1.164 * (float64(c.Y) - 16)
+			cb, cr := float64(c.Cb)-128, float64(c.Cr)-128
+			o := src.NRGBAAt(x, y)
+			for _, d := range [3]float64{
+				l + 1.596*cr - float64(o.R),
+				l - 0.813*cr - 0.391*cb - float64(o.G),
+				l + 2.018*cb - float64(o.B),
+			} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*b.Dx()*b.Dy())
+	return 10 * math.Log10(255*255/mse)
+}
+
+func encodeWebP(t *testing.T, img image.Image, quality int, lossless bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := EncodeWebP(&buf, img, quality, lossless); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncodeWebPLossy(t *testing.T) {
+	tests := []struct {
+		w, h    int
+		quality int
+		minPSNR float64
+	}{
+		{1, 1, 80, 30},
+		{17, 9, 80, 30},
+		{64, 48, 80, 30},
+		{200, 150, 80, 30},
+		{200, 150, 100, 35},
+		{200, 150, 20, 25},
+	}
+
+	for _, tt := range tests {
+		src := photoPattern(tt.w, tt.h)
+		data := encodeWebP(t, src, tt.quality, false)
+
+		cfg, err := webp.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%dx%d: DecodeConfig: %v", tt.w, tt.h, err)
+		}
+		if cfg.Width != tt.w || cfg.Height != tt.h {
+			t.Errorf("Expected %dx%d, got %dx%d", tt.w, tt.h, cfg.Width, cfg.Height)
+		}
+
+		img, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%dx%d: Decode: %v", tt.w, tt.h, err)
+		}
+		if got := psnr(t, src, img); got < tt.minPSNR {
+			t.Errorf("%dx%d at quality %d: expected PSNR of at least %.0f dB, got %.1f dB", tt.w, tt.h, tt.quality, tt.minPSNR, got)
+		}
+	}
+}
+
+func TestEncodeWebPSizeReduction(t *testing.T) {
+	src := photoPattern(320, 240)
+	pngSize := len(encodePNG(t, src))
+
+	high := encodeWebP(t, src, 90, false)
+	low := encodeWebP(t, src, 30, false)
+	lossless := encodeWebP(t, src, 0, true)
+
+	if len(high) >= pngSize/4 {
+		t.Errorf("Expected quality 90 WebP (%d bytes) to be under a quarter of the PNG (%d bytes)", len(high), pngSize)
+	}
+	if len(low) >= len(high) {
+		t.Errorf("Expected quality 30 (%d bytes) to be smaller than quality 90 (%d bytes)", len(low), len(high))
+	}
+	if raw := 4 * 320 * 240; len(lossless) >= raw/2 {
+		t.Errorf("Expected lossless WebP (%d bytes) to be under half the raw pixels (%d bytes)", len(lossless), raw)
+	}
+}
+
+func TestEncodeWebPLossless(t *testing.T) {
+	translucent := testPattern(37, 23)
+	for i := 3; i < len(translucent.Pix); i += 4 {
+		translucent.Pix[i] = uint8(i * 7)
+	}
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"pattern", testPattern(64, 48)},
+		{"photo", photoPattern(50, 31)},
+		{"translucent", translucent},
+		{"single pixel", testPattern(1, 1)},
+	}
+
+	for _, tt := range tests {
+		data := encodeWebP(t, tt.img, 0, true)
+		if string(data[12:16]) != "VP8L" {
+			t.Fatalf("%s: expected a VP8L chunk, got %q", tt.name, data[12:16])
+		}
+		img, err := webp.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: Decode: %v", tt.name, err)
+		}
+		assertSamePixels(t, tt.img, img)
+	}
+}
+
+func TestEncodeWebPLossyAlpha(t *testing.T) {
+	src := photoPattern(33, 21)
+	for i := 3; i < len(src.Pix); i += 4 {
+		src.Pix[i] = uint8(i)
+	}
+
+	data := encodeWebP(t, src, 80, false)
+	img, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := img.(*image.NYCbCrA)
+	if !ok {
+		t.Fatalf("Expected *image.NYCbCrA, got %T", img)
+	}
+	for y := range 21 {
+		for x := range 33 {
+			want := src.NRGBAAt(x, y).A
+			if got := m.A[y*m.AStride+x]; got != want {
+				t.Fatalf("Alpha at (%d, %d): expected %d, got %d", x, y, want, got)
+			}
+		}
+	}
+}
+
+func TestEncodeWebPTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeWebP(&buf, image.NewNRGBA(image.Rect(0, 0, 16384, 1)), 80, false); err == nil {
+		t.Error("Expected an error for an image wider than 16383 pixels")
+	}
+}
+
+func TestProcessWebP(t *testing.T) {
+	src := encodePNG(t, photoPattern(200, 150))
+
+	out, err := Process(src, Options{Format: "webp", Quality: 80, MaxWidth: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := webp.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Expected WebP output: %v", err)
+	}
+	if cfg.Width != 100 || cfg.Height != 75 {
+		t.Errorf("Expected 100x75, got %dx%d", cfg.Width, cfg.Height)
+	}
+	if len(out) >= len(src) {
+		t.Errorf("Expected WebP (%d bytes) to be smaller than the PNG (%d bytes)", len(out), len(src))
+	}
+
+	out, err = Process(src, Options{Format: "webp", Lossless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out[12:16]) != "VP8L" {
+		t.Errorf("Expected lossless output to use VP8L, got %q", out[12:16])
+	}
+}
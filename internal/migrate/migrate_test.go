@@ -0,0 +1,82 @@
+package migrate
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0002_add_widgets.up.sql":   {Data: []byte("CREATE TABLE widgets ();")},
+		"0002_add_widgets.down.sql": {Data: []byte("DROP TABLE widgets;")},
+		"0001_baseline.up.sql":      {Data: []byte("CREATE TABLE things ();")},
+		"0010_later.up.sql":         {Data: []byte("SELECT 1;")},
+	}
+
+	migrations, err := Load(fsys)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	want := []Migration{
+		{Version: 1, Name: "baseline", Up: "CREATE TABLE things ();"},
+		{Version: 2, Name: "add_widgets", Up: "CREATE TABLE widgets ();", Down: "DROP TABLE widgets;"},
+		{Version: 10, Name: "later", Up: "SELECT 1;"},
+	}
+	if len(migrations) != len(want) {
+		t.Fatalf("Expected %d migrations, got %d", len(want), len(migrations))
+	}
+	for i := range want {
+		if migrations[i] != want[i] {
+			t.Errorf("Migration %d: expected %+v, got %+v", i, want[i], migrations[i])
+		}
+	}
+}
+
+func TestLoadRejectsInvalidMigrations(t *testing.T) {
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		wantErr string
+	}{
+		{"bad name", fstest.MapFS{"baseline.sql": {Data: []byte("x")}}, "name must look like"},
+		{"version zero", fstest.MapFS{"0000_zero.up.sql": {Data: []byte("x")}}, "versions start at 1"},
+		{"duplicate version", fstest.MapFS{
+			"0001_a.up.sql": {Data: []byte("x")},
+			"0001_b.up.sql": {Data: []byte("y")},
+		}, "version 1 is also used by"},
+		{"down only", fstest.MapFS{"0001_a.down.sql": {Data: []byte("x")}}, "missing up script"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(tt.fsys)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	m, err := New(nil)
+	if err != nil {
+		t.Fatalf("Expected the embedded migrations to load, got %v", err)
+	}
+	if len(m.migrations) == 0 || m.migrations[0].Version != 1 {
+		t.Fatalf("Expected migrations starting at version 1, got %+v", m.migrations)
+	}
+	for i, mig := range m.migrations {
+		if mig.Version != i+1 {
+			t.Errorf("Expected versions without gaps, got %d at position %d", mig.Version, i)
+		}
+	}
+	// The server used to create every table it needs on boot; the baseline
+	// has to cover all of them, including the api_keys table it never created
+	for _, table := range []string{"api_keys", "checkout_keys", "batches", "batch_images", "usage_ledger", "webhook_deliveries", "login_tokens"} {
+		if !strings.Contains(m.migrations[0].Up, "CREATE TABLE IF NOT EXISTS "+table+" (") {
+			t.Errorf("Expected the baseline to create %s", table)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+-- The schema as it stood when migrations were introduced. Production
+-- databases already have some or all of it, from an api_keys table created by
+-- hand and from the idempotent statements the server used to run on boot, so
+-- every statement here is safe to run against any of those states.
+
+-- API keys, stored by the sha256 of the key. Keys bought as a subscription
+-- renew with each paid invoice and are suspended when the subscription lapses.
+-- name used to hold the tier; it is now a label customers can change.
+CREATE TABLE IF NOT EXISTS api_keys (
+	key_hash               TEXT PRIMARY KEY,
+	key_prefix             TEXT NOT NULL,
+	user_email             TEXT NOT NULL,
+	name                   TEXT NOT NULL,
+	tier                   TEXT NOT NULL,
+	monthly_limit          INTEGER NOT NULL,
+	stripe_subscription_id TEXT,
+	period_start           TIMESTAMPTZ,
+	suspended_at           TIMESTAMPTZ,
+	webhook_secret         TEXT,
+	created_at             TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revoked_at             TIMESTAMPTZ
+);
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS stripe_subscription_id TEXT;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS period_start TIMESTAMPTZ;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS suspended_at TIMESTAMPTZ;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tier TEXT;
+UPDATE api_keys SET tier = name WHERE tier IS NULL;
+-- Tiers are plan IDs; names copied from before the plan catalog are mapped
+-- onto them so the keys get their plan's limits
+UPDATE api_keys SET tier = lower(tier) WHERE tier IN ('Free', 'Starter', 'Growth', 'Professional');
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS webhook_secret TEXT;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS api_keys_stripe_subscription_id_idx ON api_keys (stripe_subscription_id);
+CREATE INDEX IF NOT EXISTS api_keys_user_email_idx ON api_keys (user_email);
+
+CREATE TABLE IF NOT EXISTS checkout_keys (
+	id          BIGSERIAL PRIMARY KEY,
+	session_id  TEXT NOT NULL,
+	key_prefix  TEXT NOT NULL,
+	key_hash    TEXT,
+	tier        TEXT NOT NULL,
+	credits     INTEGER NOT NULL,
+	user_email  TEXT NOT NULL,
+	created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+	revealed_at TIMESTAMPTZ
+);
+UPDATE checkout_keys SET tier = lower(tier) WHERE tier IN ('Free', 'Starter', 'Growth', 'Professional');
+-- One key per checkout session, however often Stripe retries the webhook
+CREATE UNIQUE INDEX IF NOT EXISTS checkout_keys_session_id_key ON checkout_keys (session_id);
+-- Buyers are emailed a link to view their key once, in case they leave the
+-- success page before it loads. The token is stored hashed.
+ALTER TABLE checkout_keys ADD COLUMN IF NOT EXISTS claim_token_hash TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS checkout_keys_claim_token_hash_key ON checkout_keys (claim_token_hash);
+
+CREATE TABLE IF NOT EXISTS email_verifications (
+	token_hash  TEXT PRIMARY KEY,
+	email       TEXT NOT NULL,
+	expires_at  TIMESTAMPTZ NOT NULL,
+	used_at     TIMESTAMPTZ,
+	created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- One free key per verified email
+CREATE TABLE IF NOT EXISTS free_signups (
+	email       TEXT PRIMARY KEY,
+	key_prefix  TEXT NOT NULL,
+	created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS login_tokens (
+	token_hash  TEXT PRIMARY KEY,
+	email       TEXT NOT NULL,
+	expires_at  TIMESTAMPTZ NOT NULL,
+	used_at     TIMESTAMPTZ,
+	created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Batches belong to the account that created them, so they stay visible
+-- after the key is rotated
+CREATE TABLE IF NOT EXISTS batches (
+	id           UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	key_hash     TEXT,
+	user_email   TEXT,
+	quality      INTEGER NOT NULL,
+	format       TEXT NOT NULL,
+	lossless     BOOLEAN NOT NULL DEFAULT false,
+	max_width    INTEGER NOT NULL DEFAULT 0,
+	max_height   INTEGER NOT NULL DEFAULT 0,
+	callback_url TEXT,
+	finished_at  TIMESTAMPTZ,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS key_hash TEXT;
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS user_email TEXT;
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS lossless BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS callback_url TEXT;
+ALTER TABLE batches ADD COLUMN IF NOT EXISTS finished_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS batches_user_email_idx ON batches (user_email);
+
+-- batch_images doubles as the worker queue. Compressed images are kept in
+-- storage under output_key until the janitor deletes them at expires_at.
+CREATE TABLE IF NOT EXISTS batch_images (
+	id              UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	batch_id        UUID NOT NULL REFERENCES batches (id) ON DELETE CASCADE,
+	position        INTEGER NOT NULL,
+	source_url      TEXT NOT NULL,
+	status          TEXT NOT NULL DEFAULT 'pending',
+	original_size   BIGINT,
+	compressed_size BIGINT,
+	error           TEXT,
+	attempts        INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	claimed_at      TIMESTAMPTZ,
+	output_key      TEXT,
+	expires_at      TIMESTAMPTZ,
+	created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE batch_images ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE batch_images ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE batch_images ADD COLUMN IF NOT EXISTS claimed_at TIMESTAMPTZ;
+ALTER TABLE batch_images ADD COLUMN IF NOT EXISTS output_key TEXT;
+ALTER TABLE batch_images ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS batch_images_batch_id_idx ON batch_images (batch_id, position);
+CREATE INDEX IF NOT EXISTS batch_images_queue_idx ON batch_images (next_attempt_at) WHERE status IN ('pending', 'processing');
+CREATE INDEX IF NOT EXISTS batch_images_expires_at_idx ON batch_images (expires_at) WHERE output_key IS NOT NULL;
+
+-- One row per image charged to a key. Rows are refunded rather than deleted
+-- when an image can't be processed.
+CREATE TABLE IF NOT EXISTS usage_ledger (
+	id          BIGSERIAL PRIMARY KEY,
+	key_hash    TEXT NOT NULL,
+	batch_id    UUID REFERENCES batches (id) ON DELETE SET NULL,
+	image_id    UUID REFERENCES batch_images (id) ON DELETE SET NULL,
+	created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+	refunded_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS usage_ledger_key_hash_idx ON usage_ledger (key_hash, created_at);
+CREATE INDEX IF NOT EXISTS usage_ledger_image_id_idx ON usage_ledger (image_id);
+
+-- Batch completion webhooks. Each key has one signing secret, shared by its
+-- default endpoints and any per-batch callback_url.
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+	id          UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	key_hash    TEXT NOT NULL,
+	url         TEXT NOT NULL,
+	created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhook_endpoints_key_hash_idx ON webhook_endpoints (key_hash);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id               UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	event_id         TEXT NOT NULL,
+	event_type       TEXT NOT NULL,
+	batch_id         UUID NOT NULL REFERENCES batches (id) ON DELETE CASCADE,
+	key_hash         TEXT NOT NULL,
+	url              TEXT NOT NULL,
+	payload          TEXT NOT NULL,
+	status           TEXT NOT NULL DEFAULT 'pending',
+	attempts         INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+	last_status_code INTEGER,
+	last_error       TEXT,
+	delivered_at     TIMESTAMPTZ,
+	created_at       TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_queue_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_batch_id_idx ON webhook_deliveries (batch_id, created_at);
+
+CREATE TABLE IF NOT EXISTS webhook_attempts (
+	id           BIGSERIAL PRIMARY KEY,
+	delivery_id  UUID NOT NULL REFERENCES webhook_deliveries (id) ON DELETE CASCADE,
+	attempt      INTEGER NOT NULL,
+	status_code  INTEGER,
+	error        TEXT,
+	duration_ms  INTEGER NOT NULL,
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_id_idx ON webhook_attempts (delivery_id, attempt);
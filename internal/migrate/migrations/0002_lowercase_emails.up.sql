@@ -0,0 +1,6 @@
+-- Checkout used to store the email as the buyer typed it, while sign-in
+-- lowercases it, so accounts with capitals in their email couldn't see their
+-- keys or batches.
+UPDATE api_keys SET user_email = lower(user_email) WHERE user_email <> lower(user_email);
+UPDATE checkout_keys SET user_email = lower(user_email) WHERE user_email <> lower(user_email);
+UPDATE batches SET user_email = lower(user_email) WHERE user_email <> lower(user_email);
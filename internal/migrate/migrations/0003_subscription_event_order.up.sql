@@ -0,0 +1,6 @@
+-- Stripe doesn't deliver events in order. subscription_event_at is when the
+-- last subscription event applied to the key was created, so older ones that
+-- arrive late are skipped. subscription_ended_at is set when the subscription
+-- is deleted; its key stays suspended whatever arrives after that.
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS subscription_event_at TIMESTAMPTZ;
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS subscription_ended_at TIMESTAMPTZ;
@@ -3,13 +3,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/magefile/mage/mg"
 	"github.com/magefile/mage/sh"
+
+	"github.com/devrewoh/devrewoh-portfolio/internal/migrate"
 )
 
 const (
@@ -164,6 +170,86 @@ func TestCoverage() error {
 	return sh.RunV("go", "tool", "cover", "-html=coverage.out", "-o", "coverage.html")
 }
 
+// Database Tasks
+
+// Migrate applies pending database migrations to DATABASE_URL
+func Migrate() error {
+	return withMigrator(func(ctx context.Context, m *migrate.Migrator) error {
+		fmt.Println("🗄️  Applying migrations...")
+		applied, err := m.Up(ctx)
+		for _, mig := range applied {
+			fmt.Printf("✅ Applied %04d_%s\n", mig.Version, mig.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("✅ Database is up to date")
+		}
+		return nil
+	})
+}
+
+// MigrateStatus lists migrations and whether each has been applied
+func MigrateStatus() error {
+	return withMigrator(func(ctx context.Context, m *migrate.Migrator) error {
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Println("🗄️  Migrations:")
+		for _, st := range statuses {
+			if st.AppliedAt != nil {
+				fmt.Printf("✅ %04d_%s (applied %s)\n", st.Version, st.Name, st.AppliedAt.Local().Format("2006-01-02 15:04"))
+			} else {
+				fmt.Printf("⏳ %04d_%s (pending)\n", st.Version, st.Name)
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateDown reverts the most recently applied migration
+func MigrateDown() error {
+	return withMigrator(func(ctx context.Context, m *migrate.Migrator) error {
+		fmt.Println("🗄️  Reverting latest migration...")
+		mig, err := m.Down(ctx)
+		if errors.Is(err, migrate.ErrIrreversible) {
+			fmt.Println("❌ The latest migration has no down script and can't be reverted; write a new migration that undoes it instead")
+		}
+		if err != nil {
+			return err
+		}
+		if mig == nil {
+			fmt.Println("📝 No migrations have been applied")
+			return nil
+		}
+		fmt.Printf("✅ Reverted %04d_%s\n", mig.Version, mig.Name)
+		return nil
+	})
+}
+
+// withMigrator connects to DATABASE_URL and runs fn with the embedded migrations
+func withMigrator(fn func(ctx context.Context, m *migrate.Migrator) error) error {
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		return fmt.Errorf("DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbURL)
+	if err != nil {
+		return fmt.Errorf("unable to create connection pool: %w", err)
+	}
+	defer pool.Close()
+
+	m, err := migrate.New(pool)
+	if err != nil {
+		return err
+	}
+	return fn(ctx, m)
+}
+
 // Production Deployment
 
 // BuildProd builds for production deployment
@@ -178,11 +264,25 @@ func BuildProd() error {
 	}
 
 	return sh.RunWithV(env, "go", "build",
-		"-ldflags", "-s -w",
+		"-ldflags", "-s -w "+buildLDFlags(),
 		"-o", filepath.Join("bin", binaryName),
 		".")
 }
 
+// buildLDFlags sets the version, commit and build time reported by /version.
+// Outside a git checkout only the build time is set; the binary falls back to
+// what Go embedded.
+func buildLDFlags() string {
+	flags := "-X main.buildTime=" + time.Now().UTC().Format(time.RFC3339)
+	if v, err := sh.Output("git", "describe", "--tags", "--always", "--dirty"); err == nil {
+		flags += " -X main.version=" + v
+	}
+	if c, err := sh.Output("git", "rev-parse", "--short=12", "HEAD"); err == nil {
+		flags += " -X main.commit=" + c
+	}
+	return flags
+}
+
 // Docker Operations
 
 // DockerBuild builds the Docker image
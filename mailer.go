@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// logMailer writes messages to the log instead of sending them. Tokens in
+// links are redacted, since logs outlive the links and are read by more
+// people than the recipient; use MAIL_DIR to follow links locally.
+type logMailer struct {
+	logger *slog.Logger
+}
+
+// linkTokenPattern matches the secret in sign-in, verification and claim links
+var linkTokenPattern = regexp.MustCompile(`token=[^&\s]+`)
+
+func (m logMailer) Send(ctx context.Context, msg Message) error {
+	m.logger.Info("email not sent (no SMTP configured)",
+		"to", msg.To,
+		"subject", msg.Subject,
+		"body", linkTokenPattern.ReplaceAllString(msg.Body, "token=REDACTED"),
+	)
+	return nil
+}
+
+// smtpMailer sends messages through an SMTP relay
+type smtpMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func (m smtpMailer) Send(ctx context.Context, msg Message) error {
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, formatMessage(m.from, msg)); err != nil {
+		return fmt.Errorf("send mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// fileMailer writes each message to its own .eml file, for development and tests
+type fileMailer struct {
+	dir string
+}
+
+func (m fileMailer) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(m.dir, 0o755); err != nil {
+		return fmt.Errorf("create mail directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(m.dir, time.Now().UTC().Format("20060102T150405")+"-*.eml")
+	if err != nil {
+		return fmt.Errorf("create mail file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(formatMessage("noreply@localhost", msg)); err != nil {
+		return fmt.Errorf("write mail file: %w", err)
+	}
+	return f.Close()
+}
+
+// formatMessage renders msg as an RFC 5322 plain-text email
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(msg.Body)
+	return []byte(b.String())
+}
+
+// newMailerFromEnv returns an SMTP mailer when SMTP_HOST is set, a file mailer
+// when MAIL_DIR is set, and otherwise a log mailer
+func newMailerFromEnv(logger *slog.Logger) Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		if dir := os.Getenv("MAIL_DIR"); dir != "" {
+			return fileMailer{dir: dir}
+		}
+		logger.Warn("SMTP_HOST not set; emails will be logged with their links redacted, not sent")
+		return logMailer{logger: logger}
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "noreply@devrewoh.com"
+	}
+
+	// Relays that accept unauthenticated mail reject an AUTH attempt, so only
+	// authenticate when credentials are configured
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	return smtpMailer{
+		addr: net.JoinHostPort(host, port),
+		auth: auth,
+		from: from,
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := fileMailer{dir: dir}
+
+	msg := Message{To: "chris@example.com", Subject: "Hello", Body: "Sign in here"}
+	for i := 0; i < 2; i++ {
+		if err := mailer.Send(context.Background(), msg); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("Expected one file per message, got %d", len(files))
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"To: chris@example.com", "Subject: Hello", "Sign in here"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Expected message file to contain %q", want)
+		}
+	}
+}
+
+func TestNewMailerFromEnv(t *testing.T) {
+	server := NewServer(":8080")
+
+	t.Setenv("SMTP_HOST", "")
+	t.Setenv("MAIL_DIR", "")
+	if _, ok := newMailerFromEnv(server.logger).(logMailer); !ok {
+		t.Error("Expected log mailer without configuration")
+	}
+
+	t.Setenv("MAIL_DIR", t.TempDir())
+	if _, ok := newMailerFromEnv(server.logger).(fileMailer); !ok {
+		t.Error("Expected file mailer when MAIL_DIR is set")
+	}
+
+	t.Setenv("SMTP_HOST", "smtp.example.com")
+	t.Setenv("SMTP_USERNAME", "")
+	mailer, ok := newMailerFromEnv(server.logger).(smtpMailer)
+	if !ok {
+		t.Fatal("Expected SMTP mailer when SMTP_HOST is set")
+	}
+	if mailer.auth != nil {
+		t.Error("Expected no SMTP auth without SMTP_USERNAME")
+	}
+
+	t.Setenv("SMTP_USERNAME", "gotiny")
+	if mailer := newMailerFromEnv(server.logger).(smtpMailer); mailer.auth == nil {
+		t.Error("Expected SMTP auth when SMTP_USERNAME is set")
+	}
+}
+
+func TestLogMailerRedactsTokens(t *testing.T) {
+	var buf bytes.Buffer
+	mailer := logMailer{logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+
+	msg := Message{
+		To:      "chris@example.com",
+		Subject: "Your GoTiny sign-in link",
+		Body:    "Sign in here:\n\nhttps://devrewoh.com/login/verify?next=%2Faccount&token=secret123\n",
+	}
+	if err := mailer.Send(context.Background(), msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "secret123") {
+		t.Errorf("Expected the token to be redacted, got %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "next=%2Faccount&token=REDACTED") {
+		t.Errorf("Expected the rest of the link to be logged, got %s", buf.String())
+	}
+}
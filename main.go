@@ -3,33 +3,81 @@ package main
 import (
 	"context"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/a-h/templ"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/stripe/stripe-go/v81"
 	"github.com/stripe/stripe-go/v81/checkout/session"
 )
 
-// Database connection pool
-var dbPool *pgxpool.Pool
+const (
+	// maxConcurrentRequests caps the requests handled at once, apart from
+	// event streams and uploads, which have caps of their own
+	maxConcurrentRequests = 100
+
+	// requestTimeout bounds how long a page or API request can take
+	requestTimeout = 30 * time.Second
+
+	// busyRetryAfter is the Retry-After sent to API clients turned away
+	// because maxConcurrentRequests are in flight
+	busyRetryAfter = "5"
+)
 
 // Server represents the HTTP server configuration
 type Server struct {
 	router chi.Router
 	addr   string
 	logger *slog.Logger
+	mailer Mailer
+
+	// store holds keys, usage, batches and sign-in tokens. dbReady is false
+	// while its database is unreachable; routes that need it then answer 503.
+	store   Store
+	pool    *pgxpool.Pool
+	dbReady atomic.Bool
+
+	// apiKeys caches API key lookups for requireAPIKey
+	apiKeys *apiKeyCache
+
+	// rateLimits holds the request budgets of API keys and of the forms that send email
+	rateLimits RateLimitStore
+
+	// workers compress batch images in the background
+	workers *WorkerPool
+
+	// uploads holds a slot for each image /api/v1/compress is compressing
+	uploads chan struct{}
+
+	// storage holds compressed batch images for download
+	storage Storage
+
+	// sessionSecret signs customer session cookies
+	sessionSecret []byte
+
+	// buffered is the middleware for every page, and apiBuffered its
+	// equivalent for the API, except event streams and uploads
+	buffered    chi.Middlewares
+	apiBuffered chi.Middlewares
+
+	// closing is cancelled on shutdown so event streams end instead of
+	// holding the server open
+	closing      context.Context
+	closeStreams context.CancelFunc
 }
 
 func init() {
@@ -37,44 +85,38 @@ func init() {
 	stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
 }
 
-// initDB initializes the database connection pool
-func initDB() error {
-	var err error
-	dbURL := os.Getenv("DATABASE_URL")
-	if dbURL == "" {
-		return fmt.Errorf("DATABASE_URL not set")
-	}
-
-	dbPool, err = pgxpool.New(context.Background(), dbURL)
-	if err != nil {
-		return fmt.Errorf("unable to create connection pool: %w", err)
-	}
-
-	return dbPool.Ping(context.Background())
+// dbExecutor is satisfied by both the connection pool and a transaction
+type dbExecutor interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
 }
 
-// generateAPIKey creates a new API key and stores it in the database
-func generateAPIKey(ctx context.Context, email, tier string, credits int) (string, error) {
-	// Generate random key
+// newAPIKey returns a random key in the "ic_" format clients send
+func newAPIKey() (string, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
+	return "ic_" + hex.EncodeToString(b), nil
+}
 
-	// Create key with prefix
-	key := "ic_" + hex.EncodeToString(b)
+// generateAPIKey creates a new API key on plan and stores it in the database.
+// The key is named after the plan and its tier is the plan ID.
+func generateAPIKey(ctx context.Context, db dbExecutor, email string, plan Plan) (string, error) {
+	key, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
 
 	// Hash for storage
-	hash := sha256.Sum256([]byte(key))
-	keyHash := hex.EncodeToString(hash[:])
+	keyHash := hashToken(key)
 
 	// Store in database
 	query := `
-		INSERT INTO api_keys (key_hash, key_prefix, user_email, name, monthly_limit)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO api_keys (key_hash, key_prefix, user_email, name, tier, monthly_limit)
+		VALUES ($1, $2, $3, $4, $5, $6)
 	`
 
-	_, err := dbPool.Exec(ctx, query, keyHash, key[:10], email, tier, credits)
+	_, err = db.Exec(ctx, query, keyHash, key[:10], email, plan.Name, plan.ID, plan.Credits)
 	if err != nil {
 		return "", err
 	}
@@ -82,17 +124,35 @@ func generateAPIKey(ctx context.Context, email, tier string, credits int) (strin
 	return key, nil
 }
 
-// NewServer creates a new server instance with configured routes
-func NewServer(addr string) *Server {
+// NewServer creates a new server instance with configured routes. Routes that
+// need the database require WithStore.
+func NewServer(addr string, opts ...ServerOption) *Server {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}))
 
+	storage := newStorageFromEnv(logger)
+
 	s := &Server{
 		router: chi.NewRouter(),
 		addr:   addr,
 		logger: logger,
+		mailer: newMailerFromEnv(logger),
+
+		rateLimits: newMemoryRateLimitStore(),
+		storage:    storage,
+
+		sessionSecret: loadSessionSecret(logger),
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.apiKeys = newAPIKeyCache(func(ctx context.Context, keyHash string) (*APIKey, error) {
+		return s.store.LoadAPIKey(ctx, keyHash)
+	})
+	s.workers = newWorkerPool(logger, s.store, storage)
+	s.uploads = make(chan struct{}, max(1, s.workers.workers))
+	s.closing, s.closeStreams = context.WithCancel(context.Background())
 
 	s.setupMiddleware()
 	s.setupRoutes()
@@ -103,13 +163,31 @@ func NewServer(addr string) *Server {
 // setupMiddleware configures the middleware stack
 func (s *Server) setupMiddleware() {
 	s.router.Use(middleware.RequestID)
-	s.router.Use(middleware.RealIP)
 	s.router.Use(s.loggingMiddleware)
 	s.router.Use(middleware.Recoverer)
-	s.router.Use(middleware.Compress(5))
-	s.router.Use(middleware.Timeout(30 * time.Second))
 	s.router.Use(s.securityMiddleware)
-	s.router.Use(middleware.Throttle(100)) // Rate limiting
+	s.router.Use(s.sessionMiddleware)
+
+	// Event streams flush as they go and stay open for minutes, so these are
+	// applied per route group rather than to the whole router. Pages and the
+	// API share one cap on concurrent requests; API keys are also limited
+	// per key. The API answers in its own JSON.
+	slots := make(chan struct{}, maxConcurrentRequests)
+	s.buffered = chi.Chain(
+		middleware.Compress(5),
+		middleware.Timeout(requestTimeout),
+		throttle(slots, func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Server capacity exceeded.", http.StatusTooManyRequests)
+		}),
+	)
+	s.apiBuffered = chi.Chain(
+		middleware.Compress(5),
+		apiTimeout(requestTimeout),
+		throttle(slots, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Retry-After", busyRetryAfter)
+			writeAPIError(w, http.StatusServiceUnavailable, "GoTiny is busy. Retry after the time in the Retry-After header")
+		}),
+	)
 }
 
 // loggingMiddleware provides structured logging
@@ -125,7 +203,7 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 			"path", r.URL.Path,
 			"status", ww.Status(),
 			"duration", time.Since(start),
-			"ip", r.RemoteAddr,
+			"ip", clientIP(r),
 			"user_agent", r.UserAgent(),
 		)
 	})
@@ -157,20 +235,60 @@ func (s *Server) securityMiddleware(next http.Handler) http.Handler {
 
 // setupRoutes configures the application routes
 func (s *Server) setupRoutes() {
-	// Static files with cache headers
-	s.router.Handle("/static/*", s.staticFileHandler())
-
-	// Page routes
-	s.router.Get("/", s.handleHome)
-	s.router.Get("/about", s.handleAbout)
-	s.router.Get("/contact", s.handleContact)
-	s.router.Get("/compress", s.handleCompress)
-	s.router.Get("/compress/docs", s.handleDocs)
-	s.router.Post("/checkout", s.handleCheckout)
-	s.router.Get("/compress/success", s.handleSuccess)
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.buffered...)
+
+		// Static files with cache headers
+		r.Handle("/static/*", s.staticFileHandler())
+
+		// Page routes
+		r.Get("/", s.handleHome)
+		r.Get("/about", s.handleAbout)
+		r.Get("/contact", s.handleContact)
+		r.Get("/compress", s.handleCompress)
+		r.Get("/compress/docs", s.handleDocs)
+
+		// Everything that reads or writes the database
+		r.Group(func(r chi.Router) {
+			r.Use(s.requireDB(s.handleUnavailable))
+
+			r.Post("/checkout", s.handleCheckout)
+			r.Get("/compress/success", s.handleSuccess)
+			r.Get("/compress/claim", s.handleClaimKey)
+			r.Post("/compress/claim", s.handleClaimKeySubmit)
+			r.Get("/compress/free", s.handleFreeSignup)
+			r.Post("/compress/free", s.handleFreeSignupSubmit)
+			r.Get("/compress/free/verify", s.handleFreeVerify)
+			r.Post("/compress/free/verify", s.handleFreeVerifySubmit)
+
+			// Magic-link sign-in
+			r.Get("/login", s.handleLogin)
+			r.Post("/login", s.handleLoginSubmit)
+			r.Get("/login/verify", s.handleLoginVerify)
+			r.Post("/login/verify", s.handleLoginVerifySubmit)
+
+			// Customer account
+			r.Group(func(r chi.Router) {
+				r.Use(s.requireUser)
+				r.Get("/account", s.handleAccount)
+				r.Post("/account/keys/{prefix}/rotate", s.handleKeyRotate)
+				r.Post("/account/keys/{prefix}/revoke", s.handleKeyRevoke)
+				r.Post("/account/keys/{prefix}/name", s.handleKeyRename)
+			})
+			r.Post("/webhooks/stripe", s.handleStripeWebhook)
+		})
+
+		// Signing out only clears the cookie
+		r.With(s.requireUser).Post("/logout", s.handleLogout)
+
+		// Liveness and readiness checks
+		r.Get("/health", s.handleHealth)
+		r.Get("/ready", s.handleReady)
+		r.Get("/version", s.handleVersion)
+	})
 
-	// Health check
-	s.router.Get("/health", s.handleHealth)
+	// GoTiny API; it applies s.apiBuffered itself so streams can opt out
+	s.router.Route("/api/v1", s.setupAPIRoutes)
 
 	// 404 handler
 	s.router.NotFound(s.handle404)
@@ -199,7 +317,7 @@ func (s *Server) renderTemplate(w http.ResponseWriter, r *http.Request, componen
 		s.logger.Error("template render error",
 			"page", pageName,
 			"error", err,
-			"ip", r.RemoteAddr,
+			"ip", clientIP(r),
 		)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
@@ -241,22 +359,34 @@ func (s *Server) handleCheckout(w http.ResponseWriter, r *http.Request) {
 	tier := r.FormValue("tier")
 
 	// Map tier to Stripe Price ID
-	priceID := ""
-	switch tier {
-	case "starter":
-		priceID = os.Getenv("STRIPE_PRICE_STARTER")
-	case "growth":
-		priceID = os.Getenv("STRIPE_PRICE_GROWTH")
-	case "professional":
-		priceID = os.Getenv("STRIPE_PRICE_PRO")
-	default:
+	plan, ok := planByID(tier)
+	if !ok || plan.IsFree() {
 		http.Error(w, "Invalid tier", http.StatusBadRequest)
 		return
 	}
 
+	// One-time credit packs by default, monthly subscriptions on request
+	mode := stripe.CheckoutSessionModePayment
+	priceID, priceEnv := plan.StripePriceID(), plan.PriceEnv
+	switch r.FormValue("billing") {
+	case "", "one_time":
+	case "monthly":
+		mode = stripe.CheckoutSessionModeSubscription
+		priceID, priceEnv = plan.MonthlyPriceID(), plan.MonthlyPriceEnv
+	default:
+		http.Error(w, "Invalid billing option", http.StatusBadRequest)
+		return
+	}
+
+	if priceID == "" {
+		s.logger.Error("stripe price not configured", "plan", plan.ID, "env", priceEnv)
+		http.Error(w, "Payment processing error", http.StatusInternalServerError)
+		return
+	}
+
 	// Create Stripe Checkout Session
 	params := &stripe.CheckoutSessionParams{
-		Mode: stripe.String(string(stripe.CheckoutSessionModePayment)),
+		Mode: stripe.String(string(mode)),
 		LineItems: []*stripe.CheckoutSessionLineItemParams{
 			{
 				Price:    stripe.String(priceID),
@@ -284,41 +414,59 @@ func (s *Server) handleSuccess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve Stripe session to get customer email and payment details
-	sess, err := session.Get(sessionID, nil)
+	// Keys are provisioned by the Stripe webhook; the buyer may land here first
+	ck, err := s.store.RevealCheckoutKey(r.Context(), sessionID)
+	if errors.Is(err, errKeyNotProvisioned) {
+		w.Header().Set("Refresh", "5")
+		component := PaymentPendingPage()
+		s.renderTemplate(w, r, component, "payment-pending")
+		return
+	}
 	if err != nil {
-		s.logger.Error("failed to retrieve stripe session", "error", err)
-		http.Error(w, "Payment verification failed", http.StatusInternalServerError)
+		s.logger.Error("failed to look up api key", "session_id", sessionID, "error", err)
+		http.Error(w, "Failed to load API key", http.StatusInternalServerError)
 		return
 	}
 
-	// Determine tier and credits from amount paid
-	tier := "unknown"
-	credits := 0
-	amountPaid := sess.AmountTotal // in cents
-
-	switch amountPaid {
-	case 1000: // $10
-		tier = "Starter"
-		credits = 1500
-	case 3900: // $39
-		tier = "Growth"
-		credits = 10000
-	case 9900: // $99
-		tier = "Professional"
-		credits = 50000
+	// Render success page with API key
+	component := SuccessPage(ck.APIKey, ck.KeyPrefix, planName(ck.Tier), ck.Credits, ck.Email)
+	s.renderTemplate(w, r, component, "success")
+}
+
+// handleClaimKey shows the button that reveals a bought key. Opening the
+// emailed link doesn't use it up, since mail scanners open links too.
+func (s *Server) handleClaimKey(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		http.Error(w, "Missing claim token", http.StatusBadRequest)
+		return
 	}
 
-	// Generate API key
-	apiKey, err := generateAPIKey(r.Context(), sess.CustomerDetails.Email, tier, credits)
+	component := ClaimKeyPage(token)
+	s.renderTemplate(w, r, component, "claim-key")
+}
+
+// handleClaimKeySubmit shows a bought key from the link emailed to the buyer,
+// if the success page hasn't already shown it
+func (s *Server) handleClaimKeySubmit(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("token")
+	if token == "" {
+		http.Error(w, "Missing claim token", http.StatusBadRequest)
+		return
+	}
+
+	ck, err := s.store.ClaimCheckoutKey(r.Context(), token)
+	if errors.Is(err, errInvalidToken) {
+		http.Error(w, "Invalid claim link", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		s.logger.Error("failed to generate api key", "error", err)
-		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		s.logger.Error("failed to claim api key", "error", err)
+		http.Error(w, "Failed to load API key", http.StatusInternalServerError)
 		return
 	}
 
-	// Render success page with API key
-	component := SuccessPage(apiKey, tier, credits, sess.CustomerDetails.Email)
+	component := SuccessPage(ck.APIKey, ck.KeyPrefix, planName(ck.Tier), ck.Credits, ck.Email)
 	s.renderTemplate(w, r, component, "success")
 }
 
@@ -328,22 +476,31 @@ func (s *Server) handle404(w http.ResponseWriter, r *http.Request) {
 	s.renderTemplate(w, r, component, "404")
 }
 
-// handleHealth provides a comprehensive health check
+type healthResponse struct {
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	Uptime    string `json:"uptime"`
+}
+
+// handleHealth reports that the process is up. It checks no dependencies, so
+// a database outage doesn't get the machine restarted; see handleReady.
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	health := map[string]interface{}{
-		"status":    "healthy",
-		"timestamp": time.Now().UTC().Format(time.RFC3339),
-		"version":   "1.0.0",
-		"uptime":    time.Since(startTime).String(),
+	health := healthResponse{
+		Status:    "healthy",
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Version:   build.Version,
+		Commit:    build.Commit,
+		BuildTime: build.BuildTime,
+		Uptime:    time.Since(startTime).String(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.WriteHeader(http.StatusOK)
-
-	// Simple JSON encoding without external deps
-	fmt.Fprintf(w, `{"status":"%s","timestamp":"%s","version":"%s","uptime":"%s"}`,
-		health["status"], health["timestamp"], health["version"], health["uptime"])
+	json.NewEncoder(w).Encode(health)
 }
 
 // Start starts the HTTP server with graceful shutdown
@@ -357,6 +514,7 @@ func (s *Server) Start() error {
 		// Prevent slowloris attacks
 		ReadHeaderTimeout: 5 * time.Second,
 	}
+	server.RegisterOnShutdown(s.closeStreams)
 
 	// Graceful shutdown setup
 	shutdown := make(chan os.Signal, 1)
@@ -371,9 +529,19 @@ func (s *Server) Start() error {
 		}
 	}()
 
+	// Connect to the database and start background workers once it's up
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		s.watchDB(watchCtx)
+	}()
+
 	// Wait for shutdown signal
 	<-shutdown
 	s.logger.Info("server shutting down")
+	stopWatching()
+	<-watching
 
 	// Graceful shutdown with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
@@ -384,6 +552,11 @@ func (s *Server) Start() error {
 		return fmt.Errorf("server shutdown failed: %w", err)
 	}
 
+	// Let in-flight jobs finish; anything still running is released to the queue
+	if err := s.workers.Stop(ctx); err != nil {
+		s.logger.Warn("workers did not finish before shutdown", "error", err)
+	}
+
 	s.logger.Info("server stopped gracefully")
 	return nil
 }
@@ -396,14 +569,17 @@ func main() {
 		addr = ":" + port
 	}
 
-	// Initialize database
-	if err := initDB(); err != nil {
+	// Without a database the marketing pages and docs still serve
+	var opts []ServerOption
+	pool, err := initDB()
+	if err != nil {
 		slog.Error("database initialization failed", "error", err)
-		os.Exit(1)
+	} else {
+		defer pool.Close()
+		opts = append(opts, WithDatabase(pool))
 	}
-	defer dbPool.Close()
 
-	server := NewServer(addr)
+	server := NewServer(addr, opts...)
 	if err := server.Start(); err != nil {
 		slog.Error("server failed", "error", err)
 		os.Exit(1)
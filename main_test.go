@@ -267,7 +267,7 @@ func TestHealthEndpointContent(t *testing.T) {
 	body := w.Body.String()
 
 	// Test JSON structure
-	expectedFields := []string{"status", "timestamp", "version", "uptime"}
+	expectedFields := []string{"status", "timestamp", "version", "commit", "build_time", "uptime"}
 	for _, field := range expectedFields {
 		if !strings.Contains(body, field) {
 			t.Errorf("Health response should contain %q field", field)
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Plan describes a GoTiny pricing tier. The pricing page, checkout and key
+// provisioning all read from the plans registry below.
+type Plan struct {
+	ID         string // Value posted to /checkout, stored in price metadata and as a key's tier
+	Name       string
+	PriceCents int
+	PriceEnv   string // Env var holding the Stripe price ID; empty for free plans
+	// MonthlyPriceEnv holds the Stripe recurring price ID. When it is set the
+	// plan can also be bought as a subscription whose credits renew monthly,
+	// charged MonthlyPriceCents each month.
+	MonthlyPriceEnv   string
+	MonthlyPriceCents int
+	Credits           int
+	BatchLimit        int
+	RateLimit         int // API requests per second per key
+	Features          []string
+	Featured          bool
+}
+
+// plans lists every plan in the order shown on the pricing page
+var plans = []Plan{
+	{
+		ID:         "free",
+		Name:       "Free",
+		Credits:    100,
+		BatchLimit: 100,
+		RateLimit:  100,
+		Features: []string{
+			"No credit card required",
+			"API access",
+			"WebP conversion",
+		},
+	},
+	{
+		ID:                "starter",
+		Name:              "Starter",
+		PriceCents:        1000,
+		PriceEnv:          "STRIPE_PRICE_STARTER",
+		MonthlyPriceEnv:   "STRIPE_PRICE_STARTER_MONTHLY",
+		MonthlyPriceCents: 1000,
+		Credits:           1500,
+		BatchLimit:        1000,
+		RateLimit:         100,
+		Features: []string{
+			"$0.0067 per image",
+			"26% cheaper than competitors",
+			"Email support",
+		},
+	},
+	{
+		ID:                "growth",
+		Name:              "Growth",
+		PriceCents:        3900,
+		PriceEnv:          "STRIPE_PRICE_GROWTH",
+		MonthlyPriceEnv:   "STRIPE_PRICE_GROWTH_MONTHLY",
+		MonthlyPriceCents: 3900,
+		Credits:           10000,
+		BatchLimit:        1000,
+		RateLimit:         100,
+		Features: []string{
+			"$0.0039 per image",
+			"Best value",
+			"Email support",
+		},
+		Featured: true,
+	},
+	{
+		ID:                "professional",
+		Name:              "Professional",
+		PriceCents:        9900,
+		PriceEnv:          "STRIPE_PRICE_PRO",
+		MonthlyPriceEnv:   "STRIPE_PRICE_PRO_MONTHLY",
+		MonthlyPriceCents: 9900,
+		Credits:           50000,
+		BatchLimit:        1000,
+		RateLimit:         100,
+		Features: []string{
+			"$0.002 per image",
+			"Lowest per-image cost",
+			"Email support",
+		},
+	},
+}
+
+// planByID returns the plan with the given ID
+func planByID(id string) (Plan, bool) {
+	for _, p := range plans {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// planName returns the display name of the plan a key's tier refers to, or
+// the tier itself for a plan that no longer exists
+func planName(tier string) string {
+	if p, ok := planByID(tier); ok {
+		return p.Name
+	}
+	return tier
+}
+
+// planByPriceID returns the paid plan whose one-time or monthly Stripe price matches priceID
+func planByPriceID(priceID string) (Plan, bool) {
+	if priceID == "" {
+		return Plan{}, false
+	}
+	for _, p := range plans {
+		if p.StripePriceID() == priceID || p.MonthlyPriceID() == priceID {
+			return p, true
+		}
+	}
+	return Plan{}, false
+}
+
+// IsFree reports whether the plan is issued without Stripe
+func (p Plan) IsFree() bool {
+	return p.PriceEnv == ""
+}
+
+// StripePriceID returns the configured Stripe price for the plan, if any
+func (p Plan) StripePriceID() string {
+	if p.PriceEnv == "" {
+		return ""
+	}
+	return os.Getenv(p.PriceEnv)
+}
+
+// MonthlyPriceID returns the configured recurring Stripe price for the plan, if any
+func (p Plan) MonthlyPriceID() string {
+	if p.MonthlyPriceEnv == "" {
+		return ""
+	}
+	return os.Getenv(p.MonthlyPriceEnv)
+}
+
+// PriceLabel formats the price for display, e.g. "$39"
+func (p Plan) PriceLabel() string {
+	return formatPrice(p.PriceCents)
+}
+
+// MonthlyPriceLabel formats the subscription price for display, e.g. "$39 / month"
+func (p Plan) MonthlyPriceLabel() string {
+	return formatPrice(p.MonthlyPriceCents) + " / month"
+}
+
+// CreditsLabel describes the plan's image allowance, e.g. "1,500 images"
+func (p Plan) CreditsLabel() string {
+	if p.IsFree() {
+		return formatCount(p.Credits) + " images / month"
+	}
+	return formatCount(p.Credits) + " images"
+}
+
+// BatchLabel describes the plan's batch size limit
+func (p Plan) BatchLabel() string {
+	return "Batch up to " + formatCount(p.BatchLimit) + " images"
+}
+
+// formatPrice formats an amount in cents as dollars, e.g. "$39" or "$9.50"
+func formatPrice(cents int) string {
+	if cents%100 == 0 {
+		return fmt.Sprintf("$%d", cents/100)
+	}
+	return fmt.Sprintf("$%d.%02d", cents/100, cents%100)
+}
+
+// formatCount formats n with thousands separators
+func formatCount(n int) string {
+	if n < 0 {
+		return "-" + formatCount(-n)
+	}
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
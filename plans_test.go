@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPlanCatalog(t *testing.T) {
+	seen := make(map[string]bool)
+	freePlans := 0
+
+	for _, plan := range plans {
+		if plan.ID == "" || plan.Name == "" {
+			t.Errorf("Plan %+v must have an ID and name", plan)
+		}
+		if seen[plan.ID] {
+			t.Errorf("Duplicate plan ID %q", plan.ID)
+		}
+		seen[plan.ID] = true
+
+		if plan.Credits <= 0 {
+			t.Errorf("Plan %q must grant credits", plan.ID)
+		}
+		if plan.BatchLimit <= 0 || plan.BatchLimit > 1000 {
+			t.Errorf("Plan %q batch limit %d must be between 1 and 1000", plan.ID, plan.BatchLimit)
+		}
+		if plan.RateLimit <= 0 {
+			t.Errorf("Plan %q must set a rate limit", plan.ID)
+		}
+
+		if plan.IsFree() {
+			freePlans++
+			if plan.PriceCents != 0 {
+				t.Errorf("Free plan %q must not have a price", plan.ID)
+			}
+		} else if plan.PriceCents <= 0 || !strings.HasPrefix(plan.PriceEnv, "STRIPE_PRICE_") {
+			t.Errorf("Paid plan %q needs a price and a STRIPE_PRICE_* env var", plan.ID)
+		}
+		if (plan.MonthlyPriceEnv == "") != (plan.MonthlyPriceCents == 0) {
+			t.Errorf("Plan %q needs both a monthly price and a STRIPE_PRICE_*_MONTHLY env var, or neither", plan.ID)
+		}
+	}
+
+	if freePlans != 1 {
+		t.Errorf("Expected exactly one free plan, got %d", freePlans)
+	}
+	if _, ok := planByID("free"); !ok {
+		t.Error("Expected a plan with ID \"free\"")
+	}
+}
+
+func TestPlanByPriceID(t *testing.T) {
+	for _, plan := range plans {
+		if plan.IsFree() {
+			continue
+		}
+		t.Setenv(plan.PriceEnv, "price_"+plan.ID)
+	}
+
+	for _, plan := range plans {
+		got, ok := planByPriceID("price_" + plan.ID)
+		if plan.IsFree() {
+			if ok {
+				t.Errorf("Free plan %q should not match a Stripe price", plan.ID)
+			}
+			continue
+		}
+		if !ok || got.ID != plan.ID {
+			t.Errorf("planByPriceID(%q) = %q, %v; want %q", "price_"+plan.ID, got.ID, ok, plan.ID)
+		}
+	}
+
+	if _, ok := planByPriceID(""); ok {
+		t.Error("Empty price ID should not match any plan")
+	}
+}
+
+func TestPricingPageListsEveryPlan(t *testing.T) {
+	server := NewServer(":8080")
+
+	req := httptest.NewRequest("GET", "/compress", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	body := w.Body.String()
+	for _, plan := range plans {
+		for _, want := range []string{plan.Name, plan.PriceLabel(), plan.CreditsLabel()} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Pricing page should contain %q for plan %q", want, plan.ID)
+			}
+		}
+		if !plan.IsFree() && !strings.Contains(body, `value="`+plan.ID+`"`) {
+			t.Errorf("Pricing page should post tier %q to checkout", plan.ID)
+		}
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	tests := map[int]string{
+		0:       "0",
+		100:     "100",
+		1000:    "1,000",
+		50000:   "50,000",
+		1234567: "1,234,567",
+		-1500:   "-1,500",
+	}
+
+	for n, want := range tests {
+		if got := formatCount(n); got != want {
+			t.Errorf("formatCount(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultRateLimit applies to keys whose tier is no longer in the plan catalog
+const defaultRateLimit = 100
+
+// maxRateLimitBuckets is how many buckets the in-memory store holds before
+// dropping idle ones
+const maxRateLimitBuckets = 10000
+
+// Sign-in and signup emails allowed per emailRateWindow, to each address and
+// from each client IP
+const (
+	emailsPerAddress = 3
+	emailsPerIP      = 10
+	emailRateWindow  = time.Hour
+)
+
+// RateLimitResult is the outcome of taking a token from a key's bucket
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next token, when not allowed
+	RetryAfter time.Duration
+}
+
+// RateLimitStore holds a token bucket per key, such as an API key or an
+// email address. Each bucket holds up to limit tokens and refills at limit
+// tokens per window. The in-memory store works for a single instance; a
+// shared store such as Redis can implement this to enforce limits across
+// machines.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error)
+}
+
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	rate     float64 // Tokens per second
+	last     time.Time
+}
+
+// memoryRateLimitStore keeps token buckets in process
+type memoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Take removes a token from key's bucket if one is available
+func (m *memoryRateLimitStore) Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	capacity := float64(limit)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxRateLimitBuckets {
+			m.dropFullBuckets(now)
+		}
+		b = &tokenBucket{tokens: capacity, last: now}
+		m.buckets[key] = b
+	}
+	// A key's plan can change while its bucket exists
+	b.capacity = capacity
+	b.rate = capacity / window.Seconds()
+
+	// Refill for the time since the last request
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	res := RateLimitResult{Limit: limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = secondsToDuration((1 - b.tokens) / b.rate)
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = secondsToDuration((capacity - b.tokens) / b.rate)
+	return res, nil
+}
+
+// dropFullBuckets forgets buckets that have refilled, since a missing bucket
+// starts full anyway. If every bucket is busy the map is cleared rather than
+// allowed to grow without bound.
+func (m *memoryRateLimitStore) dropFullBuckets(now time.Time) {
+	for key, b := range m.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.capacity {
+			delete(m.buckets, key)
+		}
+	}
+	if len(m.buckets) >= maxRateLimitBuckets {
+		clear(m.buckets)
+	}
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// rateLimitAPIKey enforces the per-second request limit of the key's plan.
+// It must run after requireAPIKey.
+func (s *Server) rateLimitAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, _ := apiKeyFromContext(r.Context())
+
+		res, err := s.rateLimits.Take(r.Context(), key.KeyHash, key.RateLimit, time.Second)
+		if err != nil {
+			// A broken shared store shouldn't take the API down with it
+			s.logger.Error("rate limit store failed", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+		if !res.Allowed {
+			h.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(res.RetryAfter))))
+			writeAPIError(w, http.StatusTooManyRequests, "Rate limit exceeded. Retry after the time in the Retry-After header")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// limitEmail takes a token from the buckets for the address and the client's
+// IP, so the forms that send email can't be used to flood one inbox or to
+// mail many. It returns how long to wait when either bucket is empty, or 0.
+func (s *Server) limitEmail(r *http.Request, form, email string) time.Duration {
+	ip := clientIP(r)
+
+	buckets := []struct {
+		key   string
+		limit int
+	}{
+		{form + ":ip:" + ip, emailsPerIP},
+		{form + ":email:" + email, emailsPerAddress},
+	}
+
+	var wait time.Duration
+	for _, b := range buckets {
+		res, err := s.rateLimits.Take(r.Context(), b.key, b.limit, emailRateWindow)
+		if err != nil {
+			s.logger.Error("rate limit store failed", "error", err)
+			continue
+		}
+		if !res.Allowed {
+			wait = max(wait, res.RetryAfter)
+		}
+	}
+	return wait
+}
+
+// clientIP is the address of whoever sent r. On Fly the proxy sets
+// Fly-Client-IP, replacing any value the client sent. Other forwarding
+// headers can be set by anyone, so elsewhere it is the peer address.
+func clientIP(r *http.Request) string {
+	if os.Getenv("FLY_APP_NAME") != "" {
+		if ip := r.Header.Get("Fly-Client-IP"); ip != "" {
+			return ip
+		}
+	}
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	return ip
+}
+
+// retryMessage asks someone to come back after wait
+func retryMessage(wait time.Duration) string {
+	minutes := int(math.Ceil(wait.Minutes()))
+	if minutes == 1 {
+		return "Please try again in a minute."
+	}
+	return fmt.Sprintf("Please try again in %d minutes.", minutes)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := range 10 {
+		res, _ := store.Take(ctx, "key", 10, time.Second)
+		if !res.Allowed {
+			t.Fatalf("Expected request %d to be allowed", i+1)
+		}
+		if res.Remaining != 9-i {
+			t.Errorf("Expected %d remaining, got %d", 9-i, res.Remaining)
+		}
+	}
+
+	res, _ := store.Take(ctx, "key", 10, time.Second)
+	if res.Allowed {
+		t.Fatal("Expected the 11th request in the same instant to be limited")
+	}
+	if res.RetryAfter != 100*time.Millisecond {
+		t.Errorf("Expected to retry after 100ms, got %v", res.RetryAfter)
+	}
+	if res.Reset != time.Second {
+		t.Errorf("Expected the bucket to refill in 1s, got %v", res.Reset)
+	}
+
+	if res, _ := store.Take(ctx, "other", 10, time.Second); !res.Allowed {
+		t.Error("Expected a different key to have its own bucket")
+	}
+
+	now = now.Add(100 * time.Millisecond)
+	if res, _ := store.Take(ctx, "key", 10, time.Second); !res.Allowed {
+		t.Error("Expected a token to refill after 100ms")
+	}
+}
+
+func TestRateLimitAPIKey(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	apiKey := testAPIKey(t, server, "starter", func(k *APIKey) { k.RateLimit = 2 })
+
+	var w *httptest.ResponseRecorder
+	for range 3 {
+		req := httptest.NewRequest("GET", "/api/v1/batches/not-a-uuid/status", nil)
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		w = httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+
+		if w.Header().Get("RateLimit-Limit") != "2" {
+			t.Errorf("Expected RateLimit-Limit 2, got %q", w.Header().Get("RateLimit-Limit"))
+		}
+	}
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("Expected RateLimit-Remaining 0, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Reset"); got != "1" {
+		t.Errorf("Expected RateLimit-Reset 1, got %q", got)
+	}
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) Take(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("store unavailable")
+}
+
+func TestRateLimitStoreFailureAllowsRequests(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	server.rateLimits = failingRateLimitStore{}
+	apiKey := testAPIKey(t, server, "starter", nil)
+
+	req := httptest.NewRequest("GET", "/api/v1/batches/not-a-uuid/status", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected the request to reach the handler, got status %d", w.Code)
+	}
+}
+
+// withPlanLimits gives the plan limits no other plan or default shares, for
+// the rest of the test
+func withPlanLimits(t *testing.T, id string, batchLimit, rateLimit int) {
+	t.Helper()
+
+	i := slices.IndexFunc(plans, func(p Plan) bool { return p.ID == id })
+	if i < 0 {
+		t.Fatalf("Unknown plan %q", id)
+	}
+	orig := plans[i]
+	plans[i].BatchLimit = batchLimit
+	plans[i].RateLimit = rateLimit
+	t.Cleanup(func() { plans[i] = orig })
+}
+
+func TestPlanLimitsApplyToProvisionedKeys(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		plan      string
+		provision func(t *testing.T, store *memoryStore) string
+	}{
+		{"growth", func(t *testing.T, store *memoryStore) string {
+			growth, _ := planByID("growth")
+			if _, err := store.ProvisionCheckoutKey(ctx, "cs_test_1", "buyer@example.com", growth, ""); err != nil {
+				t.Fatal(err)
+			}
+			ck, err := store.RevealCheckoutKey(ctx, "cs_test_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ck.APIKey
+		}},
+		{"free", func(t *testing.T, store *memoryStore) string {
+			token, err := store.CreateEmailVerification(ctx, "chris@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, key, err := store.IssueFreeKey(ctx, token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return key
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.plan, func(t *testing.T) {
+			withPlanLimits(t, tt.plan, 2, 3)
+			store := newMemoryStore()
+			server := NewServer(":8080", WithStore(store))
+			apiKey := tt.provision(t, store)
+
+			req := httptest.NewRequest("POST", "/api/v1/batches", strings.NewReader(`{"image_urls": ["https://example.com/1.jpg", "https://example.com/2.jpg", "https://example.com/3.jpg"]}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+			w := httptest.NewRecorder()
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "at most 2 images per batch") {
+				t.Errorf("Expected the plan's batch limit to reject 3 images, got %d %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("RateLimit-Limit"); got != "3" {
+				t.Errorf("Expected RateLimit-Limit 3, got %q", got)
+			}
+
+			for range 3 {
+				req := httptest.NewRequest("GET", "/api/v1/usage", nil)
+				req.Header.Set("Authorization", "Bearer "+apiKey)
+				w = httptest.NewRecorder()
+				server.router.ServeHTTP(w, req)
+			}
+			if w.Code != http.StatusTooManyRequests {
+				t.Errorf("Expected the 4th request in a second to be limited, got status %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimitStoreWindow(t *testing.T) {
+	now := time.Now()
+	store := newMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for range 3 {
+		store.Take(ctx, "email", 3, time.Hour)
+	}
+	res, _ := store.Take(ctx, "email", 3, time.Hour)
+	if res.Allowed {
+		t.Fatal("Expected the 4th request in the window to be limited")
+	}
+	if res.RetryAfter != 20*time.Minute {
+		t.Errorf("Expected to retry after 20m, got %v", res.RetryAfter)
+	}
+
+	now = now.Add(20 * time.Minute)
+	if res, _ := store.Take(ctx, "email", 3, time.Hour); !res.Allowed {
+		t.Error("Expected a token to refill after 20m")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		onFly   bool
+		headers map[string]string
+		want    string
+	}{
+		{"peer", false, nil, "192.0.2.1"},
+		{"forwarding headers ignored", false, map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Real-IP": "198.51.100.7"}, "192.0.2.1"},
+		{"Fly header ignored off Fly", false, map[string]string{"Fly-Client-IP": "198.51.100.7"}, "192.0.2.1"},
+		{"Fly header on Fly", true, map[string]string{"Fly-Client-IP": "198.51.100.7", "X-Forwarded-For": "203.0.113.9"}, "198.51.100.7"},
+		{"no Fly header on Fly", true, map[string]string{"X-Forwarded-For": "203.0.113.9"}, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.onFly {
+				t.Setenv("FLY_APP_NAME", "devrewoh-portfolio")
+			} else {
+				t.Setenv("FLY_APP_NAME", "")
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			if got := clientIP(req); got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// readyTimeout bounds the whole readiness check, so it answers before
+	// a monitor's request times out
+	readyTimeout = 3 * time.Second
+
+	// maxQueueDelay is how long an image can wait for a worker before the
+	// instance reports itself not ready
+	maxQueueDelay = 10 * time.Minute
+)
+
+// Readiness check statuses. A skipped check depends on one that failed.
+const (
+	checkOK      = "ok"
+	checkFailed  = "fail"
+	checkSkipped = "skipped"
+)
+
+// readinessCheck is the result of checking one dependency. /ready is
+// unauthenticated, so why a check failed goes to the logs, not the response.
+type readinessCheck struct {
+	Status string     `json:"status"`
+	Pool   *poolStats `json:"pool,omitempty"`
+}
+
+// poolStats counts the database pool's connections. Total includes those
+// still connecting.
+type poolStats struct {
+	Acquired int32 `json:"acquired"`
+	Idle     int32 `json:"idle"`
+	Total    int32 `json:"total"`
+	Max      int32 `json:"max"`
+}
+
+type readinessResponse struct {
+	Status    string                    `json:"status"`
+	Timestamp string                    `json:"timestamp"`
+	Checks    map[string]readinessCheck `json:"checks"`
+}
+
+// checkResult reports err as a check status, logging it if the check failed
+func (s *Server) checkResult(name string, err error) readinessCheck {
+	if err != nil {
+		s.logger.Warn("readiness check failed", "check", name, "error", err)
+		return readinessCheck{Status: checkFailed}
+	}
+	return readinessCheck{Status: checkOK}
+}
+
+// handleReady reports whether the instance can serve every route: the
+// database answers with connections to spare, Stripe and storage are
+// configured and workers are keeping up. Unlike handleHealth it answers 503
+// when any of them fails.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	resp := readinessResponse{
+		Status:    "ready",
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Checks:    make(map[string]readinessCheck),
+	}
+
+	pool, err := s.checkDatabase(ctx)
+	db := s.checkResult("database", err)
+	db.Pool = pool
+	resp.Checks["database"] = db
+	resp.Checks["stripe"] = s.checkResult("stripe", checkStripe())
+	resp.Checks["storage"] = s.checkResult("storage", s.checkStorage())
+	if db.Status == checkOK {
+		resp.Checks["queue"] = s.checkResult("queue", s.checkQueue(ctx))
+	} else {
+		resp.Checks["queue"] = readinessCheck{Status: checkSkipped}
+	}
+
+	status := http.StatusOK
+	for _, c := range resp.Checks {
+		if c.Status == checkFailed {
+			resp.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, resp)
+}
+
+// checkDatabase checks the pool has a connection to spare, pings it and
+// checks migrations have run. It returns the pool's stats, if there is one.
+func (s *Server) checkDatabase(ctx context.Context) (*poolStats, error) {
+	if s.pool == nil {
+		if s.dbReady.Load() {
+			return nil, nil
+		}
+		return nil, errors.New("no database configured")
+	}
+
+	// Read before pinging, since the ping waits for a connection like
+	// everything else does when there are none left
+	stat := s.pool.Stat()
+	pool := &poolStats{
+		Acquired: stat.AcquiredConns(),
+		Idle:     stat.IdleConns(),
+		Total:    stat.TotalConns(),
+		Max:      stat.MaxConns(),
+	}
+	if err := checkPool(pool); err != nil {
+		return pool, err
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+	defer cancel()
+	if err := s.pool.Ping(pingCtx); err != nil {
+		return pool, err
+	}
+
+	// Reachable but migrations haven't run yet; watchDB will get there
+	if !s.dbReady.Load() {
+		return pool, errors.New("database connected but not yet migrated")
+	}
+	return pool, nil
+}
+
+// checkPool fails when every connection is in use. pgxpool doesn't count
+// acquires waiting for a connection, but from then on every new one waits.
+func checkPool(pool *poolStats) error {
+	if pool.Acquired >= pool.Max {
+		return fmt.Errorf("connection pool exhausted: %d of %d connections acquired", pool.Acquired, pool.Max)
+	}
+	return nil
+}
+
+// checkStripe checks the keys needed to sell and provision API keys are set
+func checkStripe() error {
+	key := os.Getenv("STRIPE_SECRET_KEY")
+	switch {
+	case key == "":
+		return errors.New("STRIPE_SECRET_KEY not set")
+	case !strings.HasPrefix(key, "sk_") && !strings.HasPrefix(key, "rk_"):
+		return errors.New("STRIPE_SECRET_KEY is not a Stripe secret key")
+	case os.Getenv("STRIPE_WEBHOOK_SECRET") == "":
+		return errors.New("STRIPE_WEBHOOK_SECRET not set")
+	}
+	return nil
+}
+
+// checkStorage fails on Fly when outputs are kept on the machine's own disk,
+// which doesn't survive a restart
+func (s *Server) checkStorage() error {
+	if _, ok := s.storage.(localStorage); ok && onFly() {
+		return errors.New("S3_BUCKET not set; outputs on local disk are lost when the machine restarts")
+	}
+	return nil
+}
+
+// checkQueue fails when images have waited longer than maxQueueDelay for a worker
+func (s *Server) checkQueue(ctx context.Context) error {
+	backlog, err := s.store.QueueBacklog(ctx)
+	if err != nil {
+		return err
+	}
+
+	if backlog.OldestDue != nil {
+		if wait := time.Since(*backlog.OldestDue); wait > maxQueueDelay {
+			return fmt.Errorf("%d images due; the oldest has waited %s for one of %d workers",
+				backlog.Due, wait.Round(time.Second), s.workers.workers)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// getReady requests /ready and decodes the report
+func getReady(t *testing.T, server *Server) (int, readinessResponse) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/ready", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	var resp readinessResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Expected a JSON report, got %q", w.Body.String())
+	}
+	return w.Code, resp
+}
+
+func TestReadyWhenDependenciesAreUp(t *testing.T) {
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_test")
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	code, resp := getReady(t, server)
+
+	if code != http.StatusOK {
+		t.Errorf("Expected status %d, got %d", http.StatusOK, code)
+	}
+	if resp.Status != "ready" {
+		t.Errorf("Expected status ready, got %q", resp.Status)
+	}
+	for _, name := range []string{"database", "stripe", "storage", "queue"} {
+		if resp.Checks[name].Status != checkOK {
+			t.Errorf("Expected %s check to pass, got %+v", name, resp.Checks[name])
+		}
+	}
+}
+
+func TestReadyFailsWithoutDatabase(t *testing.T) {
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_test")
+	server := NewServer(":8080")
+
+	code, resp := getReady(t, server)
+
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if resp.Checks["database"].Status != checkFailed {
+		t.Errorf("Expected database check to fail, got %+v", resp.Checks["database"])
+	}
+	if resp.Checks["queue"].Status != checkSkipped {
+		t.Errorf("Expected queue check to be skipped, got %+v", resp.Checks["queue"])
+	}
+
+	// Why it failed is logged, not shown to whoever asked
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if strings.Contains(w.Body.String(), "database configured") {
+		t.Errorf("Expected no error detail in the response, got %s", w.Body.String())
+	}
+
+	// Liveness doesn't depend on the database
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected /health status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+func TestReadyReportsPoolStats(t *testing.T) {
+	// The pool connects lazily, so nothing needs to listen on the port
+	pool, err := pgxpool.New(context.Background(), "postgres://gotiny@127.0.0.1:1/gotiny?pool_max_conns=4&connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+	server.pool = pool
+
+	_, resp := getReady(t, server)
+
+	db := resp.Checks["database"]
+	if db.Pool == nil {
+		t.Fatalf("Expected the database check to report pool stats, got %+v", db)
+	}
+	if db.Pool.Max != 4 || db.Pool.Acquired != 0 {
+		t.Errorf("Expected 0 of 4 connections acquired, got %+v", *db.Pool)
+	}
+}
+
+func TestCheckPool(t *testing.T) {
+	tests := []struct {
+		name string
+		pool poolStats
+		ok   bool
+	}{
+		{"idle", poolStats{Acquired: 0, Idle: 2, Total: 2, Max: 4}, true},
+		{"busy", poolStats{Acquired: 3, Idle: 0, Total: 3, Max: 4}, true},
+		{"exhausted", poolStats{Acquired: 4, Idle: 0, Total: 4, Max: 4}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkPool(&tt.pool); (err == nil) != tt.ok {
+				t.Errorf("Expected ok %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestCheckStripe(t *testing.T) {
+	tests := []struct {
+		name   string
+		key    string
+		secret string
+		ok     bool
+	}{
+		{"configured", "sk_live_123", "whsec_123", true},
+		{"restricted key", "rk_test_123", "whsec_123", true},
+		{"missing key", "", "whsec_123", false},
+		{"publishable key", "pk_test_123", "whsec_123", false},
+		{"missing webhook secret", "sk_test_123", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STRIPE_SECRET_KEY", tt.key)
+			t.Setenv("STRIPE_WEBHOOK_SECRET", tt.secret)
+
+			if err := checkStripe(); (err == nil) != tt.ok {
+				t.Errorf("Expected ok %v, got %v", tt.ok, err)
+			}
+		})
+	}
+}
+
+func TestReadyFailsWhenQueueFallsBehind(t *testing.T) {
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_test")
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	key := &APIKey{KeyHash: hashToken(storeAPIKey(t, store, "customer@example.com", "starter")), Email: "customer@example.com"}
+	if _, err := store.CreateBatch(context.Background(), key, []string{"https://example.com/a.jpg"}, BatchSettings{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	store.images[0].nextAttemptAt = time.Now().Add(-maxQueueDelay - time.Minute)
+
+	code, resp := getReady(t, server)
+
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if resp.Checks["queue"].Status != checkFailed {
+		t.Errorf("Expected queue check to fail, got %+v", resp.Checks["queue"])
+	}
+}
+
+func TestReadyFailsWithLocalStorageOnFly(t *testing.T) {
+	t.Setenv("STRIPE_SECRET_KEY", "sk_test_123")
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "whsec_test")
+	t.Setenv("S3_BUCKET", "")
+
+	t.Setenv("FLY_APP_NAME", "")
+	if _, resp := getReady(t, NewServer(":8080", WithStore(newMemoryStore()))); resp.Checks["storage"].Status != checkOK {
+		t.Errorf("Expected local storage to pass in development, got %+v", resp.Checks["storage"])
+	}
+
+	t.Setenv("FLY_APP_NAME", "devrewoh-portfolio")
+	code, resp := getReady(t, NewServer(":8080", WithStore(newMemoryStore())))
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if resp.Checks["storage"].Status != checkFailed {
+		t.Errorf("Expected local storage to fail on Fly, got %+v", resp.Checks["storage"])
+	}
+}
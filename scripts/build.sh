@@ -6,7 +6,21 @@ templ generate
 
 echo "▶ building Go binary"
 
+# Values git can't provide are left out, so the binary falls back to the
+# metadata Go embeds
+VERSION="${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || true)}"
+COMMIT="${COMMIT:-$(git rev-parse --short=12 HEAD 2>/dev/null || true)}"
+BUILD_TIME="${BUILD_TIME:-$(date -u +%Y-%m-%dT%H:%M:%SZ)}"
+
+LDFLAGS="-s -w -X main.buildTime=${BUILD_TIME}"
+if [ -n "$VERSION" ]; then
+  LDFLAGS="$LDFLAGS -X main.version=${VERSION}"
+fi
+if [ -n "$COMMIT" ]; then
+  LDFLAGS="$LDFLAGS -X main.commit=${COMMIT}"
+fi
+
 CGO_ENABLED=0 GOOS=linux GOARCH=amd64 \
-go build -ldflags="-s -w" -o bin/devrewoh-portfolio .
+go build -ldflags="$LDFLAGS" -o bin/devrewoh-portfolio .
 
 echo "✅ build complete"
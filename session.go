@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionCookieName = "gotiny_session"
+	sessionTTL        = 30 * 24 * time.Hour
+)
+
+// loadSessionSecret returns the key used to sign session cookies. Without
+// SESSION_SECRET a random key is used, so sessions don't survive a restart.
+func loadSessionSecret(logger *slog.Logger) []byte {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+
+	logger.Warn("SESSION_SECRET not set, using a random key; sessions end on restart")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return b
+}
+
+// signSession encodes email and its expiry into a signed cookie value
+func signSession(secret []byte, email string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(email)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + sign(secret, payload)
+}
+
+// verifySession returns the email in a cookie value if the signature is valid and it hasn't expired
+func verifySession(secret []byte, value string, now time.Time) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	payload, sig := value[:i], value[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(sign(secret, payload))) {
+		return "", false
+	}
+
+	encodedEmail, expiry, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() >= expires {
+		return "", false
+	}
+	email, err := base64.RawURLEncoding.DecodeString(encodedEmail)
+	if err != nil {
+		return "", false
+	}
+	return string(email), true
+}
+
+func sign(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// isHTTPS reports whether the request reached us over TLS, directly or via Fly's proxy
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// setSession signs the user in by setting the session cookie
+func (s *Server) setSession(w http.ResponseWriter, r *http.Request, email string) {
+	expires := time.Now().Add(sessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    signSession(s.sessionSecret, email, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearSession signs the user out
+func (s *Server) clearSession(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   isHTTPS(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// sessionEmail returns the signed-in user's email, if any
+func (s *Server) sessionEmail(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", false
+	}
+	return verifySession(s.sessionSecret, cookie.Value, time.Now())
+}
+
+// csrfToken derives the form token for the current session cookie
+func (s *Server) csrfToken(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, s.sessionSecret)
+	mac.Write([]byte("csrf:" + cookie.Value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRF checks the csrf_token form field against the session
+func (s *Server) validCSRF(r *http.Request) bool {
+	want := s.csrfToken(r)
+	return want != "" && hmac.Equal([]byte(r.FormValue("csrf_token")), []byte(want))
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionRoundTrip(t *testing.T) {
+	secret := []byte("test-secret")
+	now := time.Now()
+
+	value := signSession(secret, "chris@example.com", now.Add(time.Hour))
+
+	email, ok := verifySession(secret, value, now)
+	if !ok || email != "chris@example.com" {
+		t.Errorf("Expected valid session for chris@example.com, got %q (ok=%v)", email, ok)
+	}
+}
+
+func TestSessionRejectsInvalid(t *testing.T) {
+	secret := []byte("test-secret")
+	now := time.Now()
+	value := signSession(secret, "chris@example.com", now.Add(time.Hour))
+
+	tests := []struct {
+		name   string
+		secret []byte
+		value  string
+		now    time.Time
+	}{
+		{"Expired", secret, value, now.Add(2 * time.Hour)},
+		{"Wrong secret", []byte("other-secret"), value, now},
+		{"Tampered email", secret, signSession(secret, "x", now.Add(time.Hour))[:2] + value[2:], now},
+		{"Tampered expiry", secret, strings.Replace(value, ".", ".9", 1), now},
+		{"Garbage", secret, "not-a-session", now},
+		{"Empty", secret, "", now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if email, ok := verifySession(tt.secret, tt.value, tt.now); ok {
+				t.Errorf("Expected session to be rejected, got %q", email)
+			}
+		})
+	}
+}
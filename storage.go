@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultOutputRetention is how long compressed images are kept when
+// OUTPUT_RETENTION isn't set
+const defaultOutputRetention = 7 * 24 * time.Hour
+
+var errObjectNotFound = errors.New("object not found")
+
+// Storage holds compressed images until they expire. Keys are slash-separated
+// paths chosen by the caller.
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns errObjectNotFound if key doesn't exist
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete succeeds if key doesn't exist
+	Delete(ctx context.Context, key string) error
+}
+
+// URLSigner is implemented by storage that can hand out time-limited URLs,
+// so downloads can go straight to the store instead of through the server
+type URLSigner interface {
+	SignedURL(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// localStorage keeps objects as files under a directory, for single-instance
+// deployments and development
+type localStorage struct {
+	dir string
+}
+
+func (s localStorage) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file and renames it, so a reader never sees a
+// partial object
+func (s localStorage) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("create storage directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("create object: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("write object: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write object: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("write object: %w", err)
+	}
+	return nil
+}
+
+func (s localStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open object: %w", err)
+	}
+	return f, nil
+}
+
+func (s localStorage) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("delete object: %w", err)
+	}
+	return nil
+}
+
+// newStorageFromEnv returns S3-compatible storage when S3_BUCKET is set, and
+// otherwise local storage under STORAGE_DIR. Local storage is for development:
+// a Fly machine's disk is wiped when it restarts, taking unexpired outputs
+// with it, so on Fly it is logged as an error and /ready fails.
+func newStorageFromEnv(logger *slog.Logger) Storage {
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		region := os.Getenv("S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+
+		// Custom endpoints such as MinIO or R2 generally need path-style
+		// URLs; AWS itself prefers virtual-hosted ones
+		endpoint := os.Getenv("S3_ENDPOINT")
+		pathStyle := endpoint != ""
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+
+		return newS3Storage(s3Config{
+			Endpoint:        endpoint,
+			Region:          region,
+			Bucket:          bucket,
+			AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle:       pathStyle,
+		})
+	}
+
+	dir := os.Getenv("STORAGE_DIR")
+	if dir == "" {
+		dir = "data/outputs"
+	}
+	if onFly() {
+		logger.Error("S3_BUCKET not set; compressed images on local disk are lost whenever the machine restarts", "dir", dir)
+	} else {
+		logger.Info("storing compressed images on local disk", "dir", dir)
+	}
+	return localStorage{dir: dir}
+}
+
+// onFly reports whether the server is running on a Fly machine
+func onFly() bool {
+	return os.Getenv("FLY_APP_NAME") != ""
+}
+
+// outputRetention reads OUTPUT_RETENTION, a duration such as "72h"
+func outputRetention(logger *slog.Logger) time.Duration {
+	v := os.Getenv("OUTPUT_RETENTION")
+	if v == "" {
+		return defaultOutputRetention
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		logger.Warn("invalid OUTPUT_RETENTION; using default", "value", v, "default", defaultOutputRetention)
+		return defaultOutputRetention
+	}
+	return d
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalStorageRoundTrip(t *testing.T) {
+	s := localStorage{dir: t.TempDir()}
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "batch/image.webp", []byte("compressed"), "image/webp"); err != nil {
+		t.Fatalf("Put: expected no error, got %v", err)
+	}
+
+	rc, err := s.Get(ctx, "batch/image.webp")
+	if err != nil {
+		t.Fatalf("Get: expected no error, got %v", err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(data) != "compressed" {
+		t.Errorf("Expected %q, got %q", "compressed", data)
+	}
+
+	// Only the object is left behind, not the temporary file
+	entries, _ := os.ReadDir(filepath.Join(s.dir, "batch"))
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 file, got %d", len(entries))
+	}
+
+	if err := s.Delete(ctx, "batch/image.webp"); err != nil {
+		t.Fatalf("Delete: expected no error, got %v", err)
+	}
+	if _, err := s.Get(ctx, "batch/image.webp"); !errors.Is(err, errObjectNotFound) {
+		t.Errorf("Expected errObjectNotFound after delete, got %v", err)
+	}
+	if err := s.Delete(ctx, "batch/image.webp"); err != nil {
+		t.Errorf("Expected deleting a missing object to succeed, got %v", err)
+	}
+}
+
+func TestLocalStorageRejectsEscapingKeys(t *testing.T) {
+	s := localStorage{dir: t.TempDir()}
+
+	for _, key := range []string{"../outside.webp", "/etc/passwd", "a/../../b"} {
+		if err := s.Put(context.Background(), key, []byte("x"), "image/webp"); err == nil {
+			t.Errorf("%s: expected an error", key)
+		}
+	}
+}
+
+func TestOutputRetention(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		env  string
+		want time.Duration
+	}{
+		{"", defaultOutputRetention},
+		{"72h", 72 * time.Hour},
+		{"soon", defaultOutputRetention},
+		{"-1h", defaultOutputRetention},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("OUTPUT_RETENTION", tt.env)
+		if got := outputRetention(logger); got != tt.want {
+			t.Errorf("OUTPUT_RETENTION=%q: expected %v, got %v", tt.env, tt.want, got)
+		}
+	}
+}
+
+func TestNewStorageFromEnv(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	t.Setenv("S3_BUCKET", "")
+	t.Setenv("STORAGE_DIR", "/var/lib/gotiny")
+	if s, ok := newStorageFromEnv(logger).(localStorage); !ok || s.dir != "/var/lib/gotiny" {
+		t.Errorf("Expected local storage in /var/lib/gotiny, got %#v", s)
+	}
+
+	t.Setenv("S3_BUCKET", "outputs")
+	t.Setenv("S3_REGION", "eu-west-1")
+	s3, ok := newStorageFromEnv(logger).(*s3Storage)
+	if !ok {
+		t.Fatal("Expected S3 storage when S3_BUCKET is set")
+	}
+	if s3.cfg.Endpoint != "https://s3.eu-west-1.amazonaws.com" || s3.cfg.PathStyle {
+		t.Errorf("Expected the virtual-hosted AWS endpoint, got %+v", s3.cfg)
+	}
+
+	t.Setenv("S3_ENDPOINT", "http://localhost:9000")
+	s3 = newStorageFromEnv(logger).(*s3Storage)
+	if !s3.cfg.PathStyle {
+		t.Error("Expected path-style URLs for a custom endpoint")
+	}
+}
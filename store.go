@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Store is everything the server keeps in the database. pgStore is backed by
+// Postgres; tests use the in-memory memoryStore.
+type Store interface {
+	// API keys
+	LoadAPIKey(ctx context.Context, keyHash string) (*APIKey, error)
+	ListAccountKeys(ctx context.Context, email string) ([]accountKey, error)
+	RotateAccountKey(ctx context.Context, email, prefix string) (string, accountKey, error)
+	RevokeAccountKey(ctx context.Context, email, prefix string) (string, error)
+	RenameAccountKey(ctx context.Context, email, prefix, name string) error
+
+	// Purchases and subscriptions
+	ProvisionCheckoutKey(ctx context.Context, sessionID, email string, plan Plan, subscriptionID string) (string, error)
+	RevealCheckoutKey(ctx context.Context, sessionID string) (checkoutKey, error)
+	ClaimCheckoutKey(ctx context.Context, token string) (checkoutKey, error)
+	ApplySubscriptionPlan(ctx context.Context, subscriptionID string, plan Plan, periodStart, eventAt *time.Time) (int64, error)
+	SuspendSubscriptionKey(ctx context.Context, subscriptionID string, eventAt time.Time) (int64, error)
+	EndSubscriptionKey(ctx context.Context, subscriptionID string) (int64, error)
+
+	// Sign-in links and free signups
+	CreateLoginToken(ctx context.Context, email string) (string, error)
+	ConsumeLoginToken(ctx context.Context, token string) (string, error)
+	CreateEmailVerification(ctx context.Context, email string) (string, error)
+	IssueFreeKey(ctx context.Context, token string) (string, string, error)
+
+	// Usage
+	GetUsage(ctx context.Context, keyHash string) (Usage, error)
+	ChargeCredit(ctx context.Context, keyHash string) (int64, error)
+	RefundCredit(ctx context.Context, id int64) error
+
+	// Batches
+	CreateBatch(ctx context.Context, key *APIKey, imageURLs []string, settings BatchSettings, callbackURL string) (string, error)
+	GetBatchStatus(ctx context.Context, email, batchID string) (batchStatusResponse, error)
+	GetImageOutput(ctx context.Context, email, imageID string) (imageOutput, error)
+
+	// Worker queue
+	ClaimImageJob(ctx context.Context) (*imageJob, error)
+	CompleteImageJob(ctx context.Context, id string, attempt, originalSize, compressedSize int, outputKey string, retention time.Duration) error
+	ReleaseImageJob(ctx context.Context, id string, attempt int) error
+	FailImageJob(ctx context.Context, id string, attempt int, message string, retry bool, backoff time.Duration) error
+	FinishBatch(ctx context.Context, batchID string) (bool, error)
+	ExpiredOutputs(ctx context.Context, limit int) ([]expiredOutput, error)
+	ClearOutputKey(ctx context.Context, id string) error
+	QueueBacklog(ctx context.Context) (queueBacklog, error)
+
+	// Batch webhooks
+	ListWebhookEndpoints(ctx context.Context, keyHash string) (webhookEndpointsResponse, error)
+	CreateWebhookEndpoint(ctx context.Context, keyHash, url string) (webhookEndpoint, error)
+	DeleteWebhookEndpoint(ctx context.Context, keyHash, id string) error
+	ListWebhookDeliveries(ctx context.Context, email, batchID string) ([]webhookDelivery, error)
+	RedeliverWebhook(ctx context.Context, email, deliveryID string) (webhookDelivery, error)
+	ClaimWebhookDelivery(ctx context.Context) (*webhookJob, error)
+	RecordWebhookAttempt(ctx context.Context, job *webhookJob, res webhookResult, retry bool, backoff time.Duration) error
+}
+
+// pgStore is the Postgres Store. Its methods live beside the handlers that
+// use them.
+type pgStore struct {
+	pool *pgxpool.Pool
+}
+
+func newPgStore(pool *pgxpool.Pool) *pgStore {
+	return &pgStore{pool: pool}
+}
+
+// ServerOption configures NewServer
+type ServerOption func(*Server)
+
+// WithStore sets where the server keeps keys, usage, batches and sign-in
+// tokens. The store is assumed to be always available.
+func WithStore(store Store) ServerOption {
+	return func(s *Server) {
+		s.store = store
+		s.dbReady.Store(true)
+	}
+}
+
+// WithDatabase keeps everything in Postgres. The server starts in
+// marketing-only mode and switches to full mode once it can reach pool.
+func WithDatabase(pool *pgxpool.Pool) ServerOption {
+	return func(s *Server) {
+		s.store = newPgStore(pool)
+		s.pool = pool
+	}
+}
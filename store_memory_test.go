@@ -0,0 +1,1012 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+var _ Store = (*memoryStore)(nil)
+
+// memoryStore is a Store kept in maps, so handlers can be tested without
+// Postgres. It follows pgStore's rules but not its concurrency guarantees
+// beyond a single lock.
+type memoryStore struct {
+	mu            sync.Mutex
+	seq           int
+	keys          map[string]*memoryKey
+	checkouts     map[string]*memoryCheckout
+	loginTokens   map[string]*memoryToken
+	verifications map[string]*memoryToken
+	freeSignups   map[string]string
+	ledger        []*memoryCharge
+	batches       map[string]*memoryBatch
+	images        []*memoryImage
+	endpoints     []*memoryEndpoint
+	deliveries    []*memoryDelivery
+}
+
+type memoryKey struct {
+	APIKey
+	Name           string
+	SubscriptionID string
+	EventAt        *time.Time
+	Ended          bool
+	WebhookSecret  string
+	CreatedAt      time.Time
+}
+
+type memoryCheckout struct {
+	checkoutKey
+	keyHash   string
+	claimHash string
+	createdAt time.Time
+}
+
+type memoryToken struct {
+	email   string
+	expires time.Time
+	used    bool
+}
+
+type memoryCharge struct {
+	id        int64
+	keyHash   string
+	imageID   string
+	createdAt time.Time
+	refunded  bool
+}
+
+type memoryBatch struct {
+	id          string
+	keyHash     string
+	email       string
+	settings    BatchSettings
+	callbackURL string
+	finished    bool
+}
+
+type memoryImage struct {
+	batchImage
+	batchID       string
+	sourceURL     string
+	attempts      int
+	nextAttemptAt time.Time
+	claimedAt     time.Time
+	outputKey     *string
+}
+
+type memoryEndpoint struct {
+	webhookEndpoint
+	keyHash string
+}
+
+type memoryDelivery struct {
+	webhookDelivery
+	keyHash string
+	payload []byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		keys:          make(map[string]*memoryKey),
+		checkouts:     make(map[string]*memoryCheckout),
+		loginTokens:   make(map[string]*memoryToken),
+		verifications: make(map[string]*memoryToken),
+		freeSignups:   make(map[string]string),
+		batches:       make(map[string]*memoryBatch),
+	}
+}
+
+// newID returns a unique UUID-shaped id
+func (m *memoryStore) newID() string {
+	m.seq++
+	return fmt.Sprintf("00000000-0000-4000-8000-%012x", m.seq)
+}
+
+// addKey stores a new key for email on plan and returns it
+func (m *memoryStore) addKey(email string, plan Plan) (string, *memoryKey, error) {
+	key, err := newAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+	k := &memoryKey{
+		APIKey: APIKey{
+			KeyHash:      hashToken(key),
+			KeyPrefix:    key[:10],
+			Email:        email,
+			Tier:         plan.ID,
+			MonthlyLimit: plan.Credits,
+		},
+		Name:      plan.Name,
+		CreatedAt: time.Now(),
+	}
+	m.keys[k.KeyHash] = k
+	return key, k, nil
+}
+
+// findKey returns email's key with prefix, or nil
+func (m *memoryStore) findKey(email, prefix string, active bool) *memoryKey {
+	for _, k := range m.keys {
+		if k.Email == email && k.KeyPrefix == prefix && (!active || !k.Revoked) {
+			return k
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) LoadAPIKey(ctx context.Context, keyHash string) (*APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[keyHash]
+	if !ok {
+		return nil, errUnknownAPIKey
+	}
+	key := k.APIKey
+	key.BatchLimit = maxBatchImages
+	key.RateLimit = defaultRateLimit
+	if plan, ok := planByID(key.Tier); ok {
+		key.BatchLimit = plan.BatchLimit
+		key.RateLimit = plan.RateLimit
+	}
+	return &key, nil
+}
+
+func (m *memoryStore) ListAccountKeys(ctx context.Context, email string) ([]accountKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []accountKey
+	for _, k := range m.keys {
+		if k.Email != email {
+			continue
+		}
+		ak := accountKey{
+			KeyHash:      k.KeyHash,
+			KeyPrefix:    k.KeyPrefix,
+			Name:         k.Name,
+			Tier:         k.Tier,
+			MonthlyLimit: k.MonthlyLimit,
+			CreatedAt:    k.CreatedAt,
+			Revoked:      k.Revoked,
+			Suspended:    k.Suspended,
+		}
+		if !k.Revoked {
+			ak.Used = m.usage(k).Used
+		}
+		keys = append(keys, ak)
+	}
+	slices.SortFunc(keys, func(a, b accountKey) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	return keys, nil
+}
+
+func (m *memoryStore) RotateAccountKey(ctx context.Context, email, prefix string) (string, accountKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old := m.findKey(email, prefix, true)
+	if old == nil {
+		return "", accountKey{}, errKeyNotFound
+	}
+
+	key, k, err := m.addKey(email, Plan{ID: old.Tier, Name: old.Name, Credits: old.MonthlyLimit})
+	if err != nil {
+		return "", accountKey{}, err
+	}
+	k.Name = old.Name
+	k.SubscriptionID = old.SubscriptionID
+	k.PeriodStart = old.PeriodStart
+	k.Suspended = old.Suspended
+	k.EventAt = old.EventAt
+	k.Ended = old.Ended
+	k.WebhookSecret = old.WebhookSecret
+
+	old.Revoked = true
+	old.SubscriptionID = ""
+	for _, c := range m.ledger {
+		if c.keyHash == old.KeyHash {
+			c.keyHash = k.KeyHash
+		}
+	}
+	for _, e := range m.endpoints {
+		if e.keyHash == old.KeyHash {
+			e.keyHash = k.KeyHash
+		}
+	}
+	for _, b := range m.batches {
+		if b.keyHash == old.KeyHash && !b.finished {
+			b.keyHash = k.KeyHash
+		}
+	}
+
+	return key, accountKey{KeyHash: old.KeyHash, Name: old.Name, Tier: old.Tier, MonthlyLimit: old.MonthlyLimit}, nil
+}
+
+func (m *memoryStore) RevokeAccountKey(ctx context.Context, email, prefix string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := m.findKey(email, prefix, true)
+	if k == nil {
+		return "", errKeyNotFound
+	}
+	k.Revoked = true
+	return k.KeyHash, nil
+}
+
+func (m *memoryStore) RenameAccountKey(ctx context.Context, email, prefix, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k := m.findKey(email, prefix, false)
+	if k == nil {
+		return errKeyNotFound
+	}
+	k.Name = name
+	return nil
+}
+
+func (m *memoryStore) ProvisionCheckoutKey(ctx context.Context, sessionID, email string, plan Plan, subscriptionID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.checkouts[sessionID]; ok {
+		return "", nil
+	}
+
+	claim, claimHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+	key, k, err := m.addKey(email, plan)
+	if err != nil {
+		return "", err
+	}
+	if subscriptionID != "" {
+		now := time.Now()
+		k.SubscriptionID = subscriptionID
+		k.PeriodStart = &now
+	}
+
+	m.checkouts[sessionID] = &memoryCheckout{
+		checkoutKey: checkoutKey{
+			KeyPrefix: k.KeyPrefix,
+			Tier:      plan.ID,
+			Credits:   plan.Credits,
+			Email:     email,
+		},
+		keyHash:   hashToken(key),
+		claimHash: claimHash,
+		createdAt: time.Now(),
+	}
+	return claim, nil
+}
+
+// reveal returns c, issuing its key in place of the provisioned one the
+// first time within checkoutKeyTTL
+func (m *memoryStore) reveal(c *memoryCheckout) (checkoutKey, error) {
+	ck := c.checkoutKey
+	k := m.keys[c.keyHash]
+	if k != nil && !k.Revoked && time.Since(c.createdAt) < checkoutKeyTTL {
+		key, err := newAPIKey()
+		if err != nil {
+			return ck, err
+		}
+		delete(m.keys, k.KeyHash)
+		k.KeyHash, k.KeyPrefix = hashToken(key), key[:10]
+		m.keys[k.KeyHash] = k
+		ck.APIKey, ck.KeyPrefix = key, k.KeyPrefix
+	}
+
+	c.keyHash = ""
+	c.KeyPrefix = ck.KeyPrefix
+	return ck, nil
+}
+
+func (m *memoryStore) RevealCheckoutKey(ctx context.Context, sessionID string) (checkoutKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.checkouts[sessionID]
+	if !ok {
+		return checkoutKey{}, errKeyNotProvisioned
+	}
+	return m.reveal(c)
+}
+
+func (m *memoryStore) ClaimCheckoutKey(ctx context.Context, token string) (checkoutKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.checkouts {
+		if c.claimHash == hashToken(token) {
+			return m.reveal(c)
+		}
+	}
+	return checkoutKey{}, errInvalidToken
+}
+
+func (m *memoryStore) ApplySubscriptionPlan(ctx context.Context, subscriptionID string, plan Plan, periodStart, eventAt *time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for _, k := range m.keys {
+		if k.SubscriptionID != subscriptionID || subscriptionID == "" || k.Ended {
+			continue
+		}
+		if eventAt != nil && k.EventAt != nil && k.EventAt.After(*eventAt) {
+			continue
+		}
+		k.Tier = plan.ID
+		k.MonthlyLimit = plan.Credits
+		k.Suspended = false
+		if periodStart != nil {
+			start := *periodStart
+			k.PeriodStart = &start
+		}
+		if eventAt != nil {
+			at := *eventAt
+			k.EventAt = &at
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (m *memoryStore) SuspendSubscriptionKey(ctx context.Context, subscriptionID string, eventAt time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for _, k := range m.keys {
+		if k.SubscriptionID != subscriptionID || subscriptionID == "" {
+			continue
+		}
+		if k.EventAt != nil && k.EventAt.After(eventAt) {
+			continue
+		}
+		k.EventAt = &eventAt
+		if !k.Suspended {
+			k.Suspended = true
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) EndSubscriptionKey(ctx context.Context, subscriptionID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	for _, k := range m.keys {
+		if k.SubscriptionID == subscriptionID && subscriptionID != "" && !k.Ended {
+			k.Suspended = true
+			k.Ended = true
+			n++
+		}
+	}
+	return n, nil
+}
+
+// addToken stores a new single-use token for email in tokens
+func (m *memoryStore) addToken(tokens map[string]*memoryToken, email string, ttl time.Duration) (string, error) {
+	token, tokenHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens[tokenHash] = &memoryToken{email: email, expires: time.Now().Add(ttl)}
+	return token, nil
+}
+
+// useToken marks a token in tokens as used and returns its email
+func (m *memoryStore) useToken(tokens map[string]*memoryToken, token string) (string, error) {
+	t, ok := tokens[hashToken(token)]
+	if !ok || t.used || time.Now().After(t.expires) {
+		return "", errInvalidToken
+	}
+	t.used = true
+	return t.email, nil
+}
+
+func (m *memoryStore) CreateLoginToken(ctx context.Context, email string) (string, error) {
+	return m.addToken(m.loginTokens, email, loginTokenTTL)
+}
+
+func (m *memoryStore) ConsumeLoginToken(ctx context.Context, token string) (string, error) {
+	if token == "" {
+		return "", errInvalidToken
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.useToken(m.loginTokens, token)
+}
+
+func (m *memoryStore) CreateEmailVerification(ctx context.Context, email string) (string, error) {
+	return m.addToken(m.verifications, email, verificationTTL)
+}
+
+func (m *memoryStore) IssueFreeKey(ctx context.Context, token string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	email, err := m.useToken(m.verifications, token)
+	if err != nil {
+		return "", "", err
+	}
+	if _, ok := m.freeSignups[email]; ok {
+		return email, "", errFreeKeyExists
+	}
+
+	free, _ := planByID("free")
+	key, k, err := m.addKey(email, free)
+	if err != nil {
+		return "", "", err
+	}
+	m.freeSignups[email] = k.KeyPrefix
+	return email, key, nil
+}
+
+// usage totals k's charges for its current period
+func (m *memoryStore) usage(k *memoryKey) Usage {
+	usage := Usage{Tier: k.Tier, MonthlyLimit: k.MonthlyLimit}
+	start, end, resets := usagePeriod(time.Now(), k.Tier, k.PeriodStart)
+	if resets {
+		usage.PeriodStart, usage.PeriodEnd = &start, &end
+	}
+	for _, c := range m.ledger {
+		if c.keyHash == k.KeyHash && !c.refunded && !c.createdAt.Before(start) {
+			usage.Used++
+		}
+	}
+	usage.Remaining = max(0, usage.MonthlyLimit-usage.Used)
+	return usage
+}
+
+// reserve checks that n more images fit in the key's quota
+func (m *memoryStore) reserve(keyHash string, n int) error {
+	k, ok := m.keys[keyHash]
+	if !ok {
+		return errUnknownAPIKey
+	}
+	usage := m.usage(k)
+	if n > usage.Remaining {
+		return &quotaError{Requested: n, Remaining: usage.Remaining, ResetsAt: usage.PeriodEnd}
+	}
+	return nil
+}
+
+// charge records one image against a key
+func (m *memoryStore) charge(keyHash, imageID string) int64 {
+	c := &memoryCharge{id: int64(len(m.ledger) + 1), keyHash: keyHash, imageID: imageID, createdAt: time.Now()}
+	m.ledger = append(m.ledger, c)
+	return c.id
+}
+
+func (m *memoryStore) GetUsage(ctx context.Context, keyHash string) (Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[keyHash]
+	if !ok {
+		return Usage{}, errUnknownAPIKey
+	}
+	return m.usage(k), nil
+}
+
+func (m *memoryStore) ChargeCredit(ctx context.Context, keyHash string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.reserve(keyHash, 1); err != nil {
+		return 0, err
+	}
+	return m.charge(keyHash, ""), nil
+}
+
+func (m *memoryStore) RefundCredit(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range m.ledger {
+		if c.id == id {
+			c.refunded = true
+		}
+	}
+	return nil
+}
+
+// secret returns the key's signing secret, creating it on first use
+func (m *memoryStore) secret(keyHash string) (string, error) {
+	k, ok := m.keys[keyHash]
+	if !ok {
+		return "", errUnknownAPIKey
+	}
+	if k.WebhookSecret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			return "", err
+		}
+		k.WebhookSecret = secret
+	}
+	return k.WebhookSecret, nil
+}
+
+func (m *memoryStore) CreateBatch(ctx context.Context, key *APIKey, imageURLs []string, settings BatchSettings, callbackURL string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.reserve(key.KeyHash, len(imageURLs)); err != nil {
+		return "", err
+	}
+	if callbackURL != "" {
+		if _, err := m.secret(key.KeyHash); err != nil {
+			return "", err
+		}
+	}
+
+	b := &memoryBatch{id: m.newID(), keyHash: key.KeyHash, email: key.Email, settings: settings, callbackURL: callbackURL}
+	m.batches[b.id] = b
+	for _, u := range imageURLs {
+		img := &memoryImage{
+			batchImage:    batchImage{ID: m.newID(), Status: statusPending},
+			batchID:       b.id,
+			sourceURL:     u,
+			nextAttemptAt: time.Now(),
+		}
+		m.images = append(m.images, img)
+		m.charge(key.KeyHash, img.ID)
+	}
+	return b.id, nil
+}
+
+// batchStatus summarises a batch from the status of each of its images
+func (m *memoryStore) batchStatus(batchID string) batchStatusResponse {
+	resp := batchStatusResponse{BatchID: batchID, Images: []batchImage{}}
+	for _, img := range m.images {
+		if img.batchID != batchID {
+			continue
+		}
+		bi := img.batchImage
+		if img.outputKey != nil && img.ExpiresAt != nil && img.ExpiresAt.After(time.Now()) {
+			bi.DownloadURL = downloadPath(bi.ID)
+		} else {
+			bi.ExpiresAt = nil
+		}
+		switch bi.Status {
+		case statusCompleted:
+			resp.Completed++
+		case statusFailed:
+			resp.Failed++
+		}
+		resp.Images = append(resp.Images, bi)
+	}
+	resp.TotalImages = len(resp.Images)
+	resp.Status = batchStatus(resp.TotalImages, resp.Completed, resp.Failed)
+	return resp
+}
+
+func (m *memoryStore) GetBatchStatus(ctx context.Context, email, batchID string) (batchStatusResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.batches[batchID]
+	if !ok || b.email != email {
+		return batchStatusResponse{}, errBatchNotFound
+	}
+	return m.batchStatus(batchID), nil
+}
+
+// image returns the image with id, or nil
+func (m *memoryStore) image(id string) *memoryImage {
+	for _, img := range m.images {
+		if img.ID == id {
+			return img
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) GetImageOutput(ctx context.Context, email, imageID string) (imageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	img := m.image(imageID)
+	if img == nil || m.batches[img.batchID].email != email {
+		return imageOutput{}, errImageNotFound
+	}
+	return imageOutput{
+		ID:             img.ID,
+		Status:         img.Status,
+		Format:         m.batches[img.batchID].settings.Format,
+		Key:            img.outputKey,
+		ExpiresAt:      img.ExpiresAt,
+		CompressedSize: img.CompressedSize,
+	}, nil
+}
+
+func (m *memoryStore) ClaimImageJob(ctx context.Context) (*imageJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var next *memoryImage
+	for _, img := range m.images {
+		due := (img.Status == statusPending && !img.nextAttemptAt.After(now)) ||
+			(img.Status == statusProcessing && img.claimedAt.Before(now.Add(-staleJobTimeout)))
+		if due && (next == nil || img.nextAttemptAt.Before(next.nextAttemptAt)) {
+			next = img
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+
+	abandoned := next.Status == statusProcessing && next.attempts >= maxJobAttempts
+	if abandoned {
+		next.Status = statusFailed
+		next.Error = abandonedJobError
+		next.claimedAt = time.Time{}
+		for _, c := range m.ledger {
+			if c.imageID == next.ID {
+				c.refunded = true
+			}
+		}
+	} else {
+		next.Status = statusProcessing
+		next.attempts++
+		next.claimedAt = now
+	}
+	return &imageJob{
+		ID:        next.ID,
+		BatchID:   next.batchID,
+		SourceURL: next.sourceURL,
+		Attempts:  next.attempts,
+		Settings:  m.batches[next.batchID].settings,
+		Abandoned: abandoned,
+	}, nil
+}
+
+// claimedImage returns the image while it is processing the given attempt.
+// The caller must hold m.mu.
+func (m *memoryStore) claimedImage(id string, attempt int) (*memoryImage, error) {
+	img := m.image(id)
+	if img == nil || img.Status != statusProcessing || img.attempts != attempt {
+		return nil, errLostClaim
+	}
+	return img, nil
+}
+
+func (m *memoryStore) CompleteImageJob(ctx context.Context, id string, attempt, originalSize, compressedSize int, outputKey string, retention time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	img, err := m.claimedImage(id, attempt)
+	if err != nil {
+		return err
+	}
+	orig, comp := int64(originalSize), int64(compressedSize)
+	expires := time.Now().Add(retention)
+	img.Status = statusCompleted
+	img.OriginalSize = &orig
+	img.CompressedSize = &comp
+	img.Error = ""
+	img.outputKey = &outputKey
+	img.ExpiresAt = &expires
+	img.claimedAt = time.Time{}
+	return nil
+}
+
+func (m *memoryStore) ReleaseImageJob(ctx context.Context, id string, attempt int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	img, err := m.claimedImage(id, attempt)
+	if err != nil {
+		return err
+	}
+	img.Status = statusPending
+	img.attempts--
+	img.nextAttemptAt = time.Now()
+	img.claimedAt = time.Time{}
+	return nil
+}
+
+func (m *memoryStore) FailImageJob(ctx context.Context, id string, attempt int, message string, retry bool, backoff time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	img, err := m.claimedImage(id, attempt)
+	if err != nil {
+		return err
+	}
+	img.Error = message
+	img.claimedAt = time.Time{}
+	if retry {
+		img.Status = statusPending
+		img.nextAttemptAt = time.Now().Add(backoff)
+		return nil
+	}
+
+	img.Status = statusFailed
+	for _, c := range m.ledger {
+		if c.imageID == id {
+			c.refunded = true
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) FinishBatch(ctx context.Context, batchID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.batches[batchID]
+	if !ok || b.finished {
+		return false, nil
+	}
+	for _, img := range m.images {
+		if img.batchID == batchID && (img.Status == statusPending || img.Status == statusProcessing) {
+			return false, nil
+		}
+	}
+	b.finished = true
+
+	var urls []string
+	if b.callbackURL != "" {
+		urls = append(urls, b.callbackURL)
+	}
+	for _, e := range m.endpoints {
+		if e.keyHash == b.keyHash {
+			urls = append(urls, e.URL)
+		}
+	}
+	if len(urls) == 0 {
+		return true, nil
+	}
+
+	event, payload, err := newBatchEvent(m.batchStatus(batchID))
+	if err != nil {
+		return false, err
+	}
+	for _, u := range urls {
+		m.addDelivery(event.ID, event.Type, batchID, b.keyHash, u, payload)
+	}
+	return true, nil
+}
+
+func (m *memoryStore) ExpiredOutputs(ctx context.Context, limit int) ([]expiredOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var outputs []expiredOutput
+	for _, img := range m.images {
+		if len(outputs) == limit {
+			break
+		}
+		if img.outputKey != nil && !img.ExpiresAt.After(time.Now()) {
+			outputs = append(outputs, expiredOutput{ImageID: img.ID, Key: *img.outputKey})
+		}
+	}
+	return outputs, nil
+}
+
+func (m *memoryStore) ClearOutputKey(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if img := m.image(id); img != nil {
+		img.outputKey = nil
+	}
+	return nil
+}
+
+func (m *memoryStore) QueueBacklog(ctx context.Context) (queueBacklog, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var b queueBacklog
+	now := time.Now()
+	for _, img := range m.images {
+		if img.Status != statusPending || img.nextAttemptAt.After(now) {
+			continue
+		}
+		b.Due++
+		if b.OldestDue == nil || img.nextAttemptAt.Before(*b.OldestDue) {
+			due := img.nextAttemptAt
+			b.OldestDue = &due
+		}
+	}
+	return b, nil
+}
+
+func (m *memoryStore) ListWebhookEndpoints(ctx context.Context, keyHash string) (webhookEndpointsResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	secret, err := m.secret(keyHash)
+	if err != nil {
+		return webhookEndpointsResponse{}, err
+	}
+	resp := webhookEndpointsResponse{SigningSecret: secret, Endpoints: []webhookEndpoint{}}
+	for _, e := range m.endpoints {
+		if e.keyHash == keyHash {
+			resp.Endpoints = append(resp.Endpoints, e.webhookEndpoint)
+		}
+	}
+	return resp, nil
+}
+
+func (m *memoryStore) CreateWebhookEndpoint(ctx context.Context, keyHash, url string) (webhookEndpoint, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.secret(keyHash); err != nil {
+		return webhookEndpoint{}, err
+	}
+	count := 0
+	for _, e := range m.endpoints {
+		if e.keyHash == keyHash {
+			count++
+		}
+	}
+	if count >= maxWebhookEndpoints {
+		return webhookEndpoint{}, errTooManyEndpoints
+	}
+
+	e := &memoryEndpoint{webhookEndpoint: webhookEndpoint{ID: m.newID(), URL: url, CreatedAt: time.Now()}, keyHash: keyHash}
+	m.endpoints = append(m.endpoints, e)
+	return e.webhookEndpoint, nil
+}
+
+func (m *memoryStore) DeleteWebhookEndpoint(ctx context.Context, keyHash, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, e := range m.endpoints {
+		if e.ID == id && e.keyHash == keyHash {
+			m.endpoints = slices.Delete(m.endpoints, i, i+1)
+			return nil
+		}
+	}
+	return errEndpointNotFound
+}
+
+// addDelivery queues a pending delivery
+func (m *memoryStore) addDelivery(eventID, eventType, batchID, keyHash, url string, payload []byte) *memoryDelivery {
+	now := time.Now()
+	d := &memoryDelivery{
+		webhookDelivery: webhookDelivery{
+			ID:            m.newID(),
+			EventID:       eventID,
+			EventType:     eventType,
+			BatchID:       batchID,
+			URL:           url,
+			Status:        deliveryPending,
+			NextAttemptAt: &now,
+			CreatedAt:     now,
+			AttemptLog:    []webhookAttempt{},
+		},
+		keyHash: keyHash,
+		payload: payload,
+	}
+	m.deliveries = append(m.deliveries, d)
+	return d
+}
+
+// delivery returns one of email's deliveries, or nil
+func (m *memoryStore) delivery(email, id string) *memoryDelivery {
+	for _, d := range m.deliveries {
+		if d.ID == id && m.batches[d.BatchID].email == email {
+			return d
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) ListWebhookDeliveries(ctx context.Context, email, batchID string) ([]webhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deliveries := []webhookDelivery{}
+	for i := len(m.deliveries) - 1; i >= 0 && len(deliveries) < 50; i-- {
+		d := m.deliveries[i]
+		if m.batches[d.BatchID].email != email || (batchID != "" && d.BatchID != batchID) {
+			continue
+		}
+		wd := d.webhookDelivery
+		if wd.Status != deliveryPending {
+			wd.NextAttemptAt = nil
+		}
+		wd.AttemptLog = slices.Clone(d.AttemptLog)
+		deliveries = append(deliveries, wd)
+	}
+	return deliveries, nil
+}
+
+func (m *memoryStore) RedeliverWebhook(ctx context.Context, email, deliveryID string) (webhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	d := m.delivery(email, deliveryID)
+	if d == nil {
+		return webhookDelivery{}, errDeliveryNotFound
+	}
+	return m.addDelivery(d.EventID, d.EventType, d.BatchID, d.keyHash, d.URL, d.payload).webhookDelivery, nil
+}
+
+func (m *memoryStore) ClaimWebhookDelivery(ctx context.Context) (*webhookJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, d := range m.deliveries {
+		if d.Status != deliveryPending || d.NextAttemptAt.After(now) {
+			continue
+		}
+		k, ok := m.keys[d.keyHash]
+		if !ok {
+			continue
+		}
+		lease := now.Add(webhookLease)
+		d.Attempts++
+		d.NextAttemptAt = &lease
+		return &webhookJob{
+			ID:        d.ID,
+			EventType: d.EventType,
+			URL:       d.URL,
+			Payload:   d.payload,
+			Secret:    k.WebhookSecret,
+			Attempts:  d.Attempts,
+		}, nil
+	}
+	return nil, nil
+}
+
+func (m *memoryStore) RecordWebhookAttempt(ctx context.Context, job *webhookJob, res webhookResult, retry bool, backoff time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var d *memoryDelivery
+	for _, candidate := range m.deliveries {
+		if candidate.ID == job.ID {
+			d = candidate
+		}
+	}
+	if d == nil {
+		return errDeliveryNotFound
+	}
+
+	a := webhookAttempt{Attempt: job.Attempts, DurationMS: int(res.Duration.Milliseconds()), CreatedAt: time.Now()}
+	if res.StatusCode != 0 {
+		code := res.StatusCode
+		a.StatusCode = &code
+	}
+	if res.Err != nil {
+		a.Error = res.Err.Error()
+	}
+	d.AttemptLog = append(d.AttemptLog, a)
+	d.LastStatusCode = a.StatusCode
+	d.LastError = a.Error
+
+	switch {
+	case res.ok():
+		now := time.Now()
+		d.Status = deliverySucceeded
+		d.DeliveredAt = &now
+	case retry:
+		next := time.Now().Add(backoff)
+		d.NextAttemptAt = &next
+	default:
+		d.Status = deliveryFailed
+	}
+	return nil
+}
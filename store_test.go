@@ -0,0 +1,570 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/devrewoh/devrewoh-portfolio/internal/migrate"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testStore is a Store under test, with a way to move its records back in
+// time so the cases can reach timeouts without waiting for them
+type testStore struct {
+	Store
+	ageImage    func(t *testing.T, id string, d time.Duration)
+	ageCheckout func(t *testing.T, sessionID string, d time.Duration)
+}
+
+// newTestMemoryStore returns an empty memoryStore
+func newTestMemoryStore(t *testing.T) testStore {
+	store := newMemoryStore()
+	return testStore{
+		Store: store,
+		ageImage: func(t *testing.T, id string, d time.Duration) {
+			store.mu.Lock()
+			defer store.mu.Unlock()
+			img := store.image(id)
+			if img == nil {
+				t.Fatalf("Expected image %s to exist", id)
+			}
+			img.nextAttemptAt = img.nextAttemptAt.Add(-d)
+			if !img.claimedAt.IsZero() {
+				img.claimedAt = img.claimedAt.Add(-d)
+			}
+			if img.ExpiresAt != nil {
+				expires := img.ExpiresAt.Add(-d)
+				img.ExpiresAt = &expires
+			}
+		},
+		ageCheckout: func(t *testing.T, sessionID string, d time.Duration) {
+			store.mu.Lock()
+			defer store.mu.Unlock()
+			c, ok := store.checkouts[sessionID]
+			if !ok {
+				t.Fatalf("Expected checkout %s to exist", sessionID)
+			}
+			c.createdAt = c.createdAt.Add(-d)
+		},
+	}
+}
+
+// newTestPgStore connects to TEST_DATABASE_URL, applies the migrations and
+// empties every table. It skips the test when TEST_DATABASE_URL is unset.
+// Everything in the database is deleted, so never point it at one you use.
+func newTestPgStore(t *testing.T) testStore {
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, dbURL)
+	if err != nil {
+		t.Fatalf("Failed to connect to TEST_DATABASE_URL: %v", err)
+	}
+	t.Cleanup(pool.Close)
+
+	m, err := migrate.New(pool)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatalf("Failed to apply migrations: %v", err)
+	}
+	_, err = pool.Exec(ctx, `
+		DO $$
+		DECLARE tables text;
+		BEGIN
+			SELECT string_agg(quote_ident(tablename), ', ') INTO tables
+			FROM pg_tables
+			WHERE schemaname = current_schema() AND tablename <> 'schema_migrations';
+			EXECUTE 'TRUNCATE ' || tables || ' CASCADE';
+		END $$
+	`)
+	if err != nil {
+		t.Fatalf("Failed to empty the database: %v", err)
+	}
+
+	age := func(t *testing.T, query, id string, d time.Duration) {
+		tag, err := pool.Exec(ctx, query, id, d.String())
+		if err != nil {
+			t.Fatalf("Failed to age %s: %v", id, err)
+		}
+		if tag.RowsAffected() != 1 {
+			t.Fatalf("Expected %s to exist", id)
+		}
+	}
+	return testStore{
+		Store: newPgStore(pool),
+		ageImage: func(t *testing.T, id string, d time.Duration) {
+			age(t, `
+				UPDATE batch_images
+				SET next_attempt_at = next_attempt_at - $2::interval,
+					claimed_at = claimed_at - $2::interval,
+					expires_at = expires_at - $2::interval
+				WHERE id = $1
+			`, id, d)
+		},
+		ageCheckout: func(t *testing.T, sessionID string, d time.Duration) {
+			age(t, `
+				UPDATE checkout_keys SET created_at = created_at - $2::interval
+				WHERE session_id = $1
+			`, sessionID, d)
+		},
+	}
+}
+
+// buyTestKey provisions and reveals a key for a checkout of plan
+func buyTestKey(t *testing.T, store Store, sessionID, email, planID, subscriptionID string) *APIKey {
+	t.Helper()
+	ctx := context.Background()
+
+	plan, _ := planByID(planID)
+	if _, err := store.ProvisionCheckoutKey(ctx, sessionID, email, plan, subscriptionID); err != nil {
+		t.Fatalf("Failed to provision key: %v", err)
+	}
+	ck, err := store.RevealCheckoutKey(ctx, sessionID)
+	if err != nil {
+		t.Fatalf("Failed to reveal key: %v", err)
+	}
+	key, err := store.LoadAPIKey(ctx, hashToken(ck.APIKey))
+	if err != nil {
+		t.Fatalf("Failed to load revealed key: %v", err)
+	}
+	return key
+}
+
+// claimTestJob claims the next job, failing the test if there is none
+func claimTestJob(t *testing.T, store Store) *imageJob {
+	t.Helper()
+	job, err := store.ClaimImageJob(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to claim job: %v", err)
+	}
+	if job == nil {
+		t.Fatal("Expected a job to claim, got none")
+	}
+	return job
+}
+
+// storeCases run against every Store, so the Postgres queries and the
+// in-memory fake the other tests rely on are held to the same behaviour
+var storeCases = []struct {
+	name string
+	run  func(t *testing.T, store testStore)
+}{
+	{"checkout key is provisioned and revealed once", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		plan, _ := planByID("starter")
+
+		claim, err := store.ProvisionCheckoutKey(ctx, "cs_1", "buyer@example.com", plan, "")
+		if err != nil || claim == "" {
+			t.Fatalf("Expected a claim token, got %q (%v)", claim, err)
+		}
+		again, err := store.ProvisionCheckoutKey(ctx, "cs_1", "buyer@example.com", plan, "")
+		if err != nil || again != "" {
+			t.Errorf("Expected a retried webhook to provision nothing, got %q (%v)", again, err)
+		}
+
+		ck, err := store.RevealCheckoutKey(ctx, "cs_1")
+		if err != nil {
+			t.Fatalf("Failed to reveal key: %v", err)
+		}
+		if ck.APIKey == "" || ck.KeyPrefix != ck.APIKey[:10] || ck.Tier != "starter" || ck.Credits != plan.Credits {
+			t.Errorf("Expected a starter key, got %+v", ck)
+		}
+		key, err := store.LoadAPIKey(ctx, hashToken(ck.APIKey))
+		if err != nil {
+			t.Fatalf("Expected the revealed key to load, got %v", err)
+		}
+		if key.Email != "buyer@example.com" || key.MonthlyLimit != plan.Credits || key.BatchLimit != plan.BatchLimit {
+			t.Errorf("Expected the key to carry the starter plan, got %+v", key)
+		}
+
+		ck, err = store.RevealCheckoutKey(ctx, "cs_1")
+		if err != nil || ck.APIKey != "" || ck.KeyPrefix == "" {
+			t.Errorf("Expected a second reveal to show only the prefix, got %+v (%v)", ck, err)
+		}
+		ck, err = store.ClaimCheckoutKey(ctx, claim)
+		if err != nil || ck.APIKey != "" {
+			t.Errorf("Expected the claim link not to reveal the key again, got %+v (%v)", ck, err)
+		}
+		if _, err := store.ClaimCheckoutKey(ctx, "wrong"); !errors.Is(err, errInvalidToken) {
+			t.Errorf("Expected errInvalidToken, got %v", err)
+		}
+		if _, err := store.RevealCheckoutKey(ctx, "cs_missing"); !errors.Is(err, errKeyNotProvisioned) {
+			t.Errorf("Expected errKeyNotProvisioned, got %v", err)
+		}
+	}},
+	{"checkout key is not revealed after it expires", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		plan, _ := planByID("starter")
+
+		claim, err := store.ProvisionCheckoutKey(ctx, "cs_1", "buyer@example.com", plan, "")
+		if err != nil {
+			t.Fatalf("Failed to provision key: %v", err)
+		}
+		store.ageCheckout(t, "cs_1", checkoutKeyTTL+time.Minute)
+
+		ck, err := store.ClaimCheckoutKey(ctx, claim)
+		if err != nil || ck.APIKey != "" || ck.Tier != "starter" {
+			t.Errorf("Expected an expired checkout to show no key, got %+v (%v)", ck, err)
+		}
+	}},
+	{"subscription plan changes apply to its key", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "sub_1")
+		growth, _ := planByID("growth")
+		start := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+		n, err := store.ApplySubscriptionPlan(ctx, "sub_1", growth, &start, nil)
+		if err != nil || n != 1 {
+			t.Fatalf("Expected 1 key updated, got %d (%v)", n, err)
+		}
+		if n, _ := store.ApplySubscriptionPlan(ctx, "", growth, nil, nil); n != 0 {
+			t.Errorf("Expected no keys updated without a subscription, got %d", n)
+		}
+		got, _ := store.LoadAPIKey(ctx, key.KeyHash)
+		if got.Tier != "growth" || got.MonthlyLimit != growth.Credits || got.PeriodStart == nil || !got.PeriodStart.Equal(start) {
+			t.Errorf("Expected the growth plan from %v, got %+v", start, got)
+		}
+
+		if n, err := store.SuspendSubscriptionKey(ctx, "sub_1", start); err != nil || n != 1 {
+			t.Fatalf("Expected 1 key suspended, got %d (%v)", n, err)
+		}
+		if n, _ := store.SuspendSubscriptionKey(ctx, "sub_1", start); n != 0 {
+			t.Errorf("Expected a suspended key not to be suspended again, got %d", n)
+		}
+		if got, _ := store.LoadAPIKey(ctx, key.KeyHash); !got.Suspended {
+			t.Error("Expected the key to be suspended")
+		}
+		store.ApplySubscriptionPlan(ctx, "sub_1", growth, nil, nil)
+		if got, _ := store.LoadAPIKey(ctx, key.KeyHash); got.Suspended {
+			t.Error("Expected a renewed subscription to reinstate the key")
+		}
+	}},
+	{"subscription events older than the last applied are skipped", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "sub_1")
+		growth, _ := planByID("growth")
+		earlier := time.Now().Add(-time.Hour).Truncate(time.Second)
+		later := earlier.Add(time.Minute)
+
+		if n, err := store.SuspendSubscriptionKey(ctx, "sub_1", later); err != nil || n != 1 {
+			t.Fatalf("Expected 1 key suspended, got %d (%v)", n, err)
+		}
+		if n, _ := store.ApplySubscriptionPlan(ctx, "sub_1", growth, nil, &earlier); n != 0 {
+			t.Errorf("Expected an older event not to reinstate the key, got %d updated", n)
+		}
+		if n, _ := store.ApplySubscriptionPlan(ctx, "sub_1", growth, nil, &later); n != 1 {
+			t.Errorf("Expected an event as new as the last to apply, got %d updated", n)
+		}
+		if n, _ := store.SuspendSubscriptionKey(ctx, "sub_1", earlier); n != 0 {
+			t.Errorf("Expected an older event not to suspend the key, got %d suspended", n)
+		}
+		if got, _ := store.LoadAPIKey(ctx, key.KeyHash); got.Suspended {
+			t.Error("Expected the key to stay active")
+		}
+	}},
+	{"keys of deleted subscriptions stay suspended", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "sub_1")
+		growth, _ := planByID("growth")
+		later := time.Now().Add(time.Hour).Truncate(time.Second)
+
+		if n, err := store.EndSubscriptionKey(ctx, "sub_1"); err != nil || n != 1 {
+			t.Fatalf("Expected 1 key ended, got %d (%v)", n, err)
+		}
+		if n, _ := store.ApplySubscriptionPlan(ctx, "sub_1", growth, nil, &later); n != 0 {
+			t.Errorf("Expected a deleted subscription not to be updated, got %d", n)
+		}
+		if n, _ := store.ApplySubscriptionPlan(ctx, "sub_1", growth, &later, nil); n != 0 {
+			t.Errorf("Expected a deleted subscription not to renew, got %d", n)
+		}
+		if got, _ := store.LoadAPIKey(ctx, key.KeyHash); !got.Suspended {
+			t.Error("Expected the key to stay suspended")
+		}
+	}},
+	{"login and verification tokens are single use", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+
+		token, err := store.CreateLoginToken(ctx, "user@example.com")
+		if err != nil {
+			t.Fatalf("Failed to create login token: %v", err)
+		}
+		if email, err := store.ConsumeLoginToken(ctx, token); err != nil || email != "user@example.com" {
+			t.Errorf("Expected user@example.com, got %q (%v)", email, err)
+		}
+		if _, err := store.ConsumeLoginToken(ctx, token); !errors.Is(err, errInvalidToken) {
+			t.Errorf("Expected a used login token to be rejected, got %v", err)
+		}
+
+		token, _ = store.CreateEmailVerification(ctx, "user@example.com")
+		email, key, err := store.IssueFreeKey(ctx, token)
+		if err != nil || email != "user@example.com" || key == "" {
+			t.Fatalf("Expected a free key for user@example.com, got %q %q (%v)", email, key, err)
+		}
+		if got, err := store.LoadAPIKey(ctx, hashToken(key)); err != nil || got.Tier != "free" {
+			t.Errorf("Expected a free key, got %+v (%v)", got, err)
+		}
+		if _, _, err := store.IssueFreeKey(ctx, token); !errors.Is(err, errInvalidToken) {
+			t.Errorf("Expected a used verification to be rejected, got %v", err)
+		}
+		token, _ = store.CreateEmailVerification(ctx, "user@example.com")
+		if _, _, err := store.IssueFreeKey(ctx, token); !errors.Is(err, errFreeKeyExists) {
+			t.Errorf("Expected errFreeKeyExists, got %v", err)
+		}
+	}},
+	{"credits are charged and refunded", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "")
+
+		id, err := store.ChargeCredit(ctx, key.KeyHash)
+		if err != nil {
+			t.Fatalf("Failed to charge credit: %v", err)
+		}
+		if usage, _ := store.GetUsage(ctx, key.KeyHash); usage.Used != 1 || usage.Remaining != key.MonthlyLimit-1 {
+			t.Errorf("Expected 1 credit used, got %+v", usage)
+		}
+		if err := store.RefundCredit(ctx, id); err != nil {
+			t.Fatalf("Failed to refund credit: %v", err)
+		}
+		if usage, _ := store.GetUsage(ctx, key.KeyHash); usage.Used != 0 {
+			t.Errorf("Expected the refund to return the credit, got %+v", usage)
+		}
+		if _, err := store.GetUsage(ctx, "unknown"); !errors.Is(err, errUnknownAPIKey) {
+			t.Errorf("Expected errUnknownAPIKey, got %v", err)
+		}
+	}},
+	{"rotation moves usage, webhooks and running batches", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "")
+
+		endpoint, err := store.CreateWebhookEndpoint(ctx, key.KeyHash, "https://example.com/hook")
+		if err != nil {
+			t.Fatalf("Failed to create webhook endpoint: %v", err)
+		}
+		before, _ := store.ListWebhookEndpoints(ctx, key.KeyHash)
+		batchID, err := store.CreateBatch(ctx, key, []string{"https://example.com/a.png"}, BatchSettings{Quality: 80, Format: "webp"}, "")
+		if err != nil {
+			t.Fatalf("Failed to create batch: %v", err)
+		}
+
+		newKey, old, err := store.RotateAccountKey(ctx, "buyer@example.com", key.KeyPrefix)
+		if err != nil {
+			t.Fatalf("Failed to rotate key: %v", err)
+		}
+		if old.KeyHash != key.KeyHash {
+			t.Errorf("Expected the old key's hash %s, got %s", key.KeyHash, old.KeyHash)
+		}
+		if got, _ := store.LoadAPIKey(ctx, key.KeyHash); !got.Revoked {
+			t.Error("Expected the old key to be revoked")
+		}
+		newHash := hashToken(newKey)
+		if usage, _ := store.GetUsage(ctx, newHash); usage.Used != 1 {
+			t.Errorf("Expected the new key to carry the batch's credit, got %+v", usage)
+		}
+		after, err := store.ListWebhookEndpoints(ctx, newHash)
+		if err != nil || len(after.Endpoints) != 1 || after.Endpoints[0].ID != endpoint.ID || after.SigningSecret != before.SigningSecret {
+			t.Errorf("Expected the endpoint and signing secret to move, got %+v (%v)", after, err)
+		}
+
+		job := claimTestJob(t, store)
+		if err := store.CompleteImageJob(ctx, job.ID, job.Attempts, 100, 50, "out/"+job.ID, time.Hour); err != nil {
+			t.Fatalf("Failed to complete job: %v", err)
+		}
+		if finished, err := store.FinishBatch(ctx, batchID); err != nil || !finished {
+			t.Fatalf("Expected the batch to finish, got %v (%v)", finished, err)
+		}
+		deliveries, _ := store.ListWebhookDeliveries(ctx, "buyer@example.com", batchID)
+		if len(deliveries) != 1 || deliveries[0].URL != "https://example.com/hook" {
+			t.Errorf("Expected the moved endpoint to be notified, got %+v", deliveries)
+		}
+
+		revoked, err := store.RevokeAccountKey(ctx, "buyer@example.com", newKey[:10])
+		if err != nil || revoked != newHash {
+			t.Errorf("Expected revoke to return %s, got %s (%v)", newHash, revoked, err)
+		}
+		if _, err := store.RevokeAccountKey(ctx, "buyer@example.com", newKey[:10]); !errors.Is(err, errKeyNotFound) {
+			t.Errorf("Expected errKeyNotFound, got %v", err)
+		}
+	}},
+	{"failed jobs are retried after their backoff", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "")
+		if _, err := store.CreateBatch(ctx, key, []string{"https://example.com/a.png"}, BatchSettings{Quality: 80, Format: "webp"}, ""); err != nil {
+			t.Fatalf("Failed to create batch: %v", err)
+		}
+
+		if backlog, _ := store.QueueBacklog(ctx); backlog.Due != 1 || backlog.OldestDue == nil {
+			t.Errorf("Expected 1 due image, got %+v", backlog)
+		}
+		job := claimTestJob(t, store)
+		if job.Attempts != 1 || job.SourceURL != "https://example.com/a.png" || job.Settings.Format != "webp" {
+			t.Errorf("Expected the first attempt at the image, got %+v", job)
+		}
+		if backlog, _ := store.QueueBacklog(ctx); backlog.Due != 0 {
+			t.Errorf("Expected a claimed image not to be due, got %+v", backlog)
+		}
+
+		if err := store.FailImageJob(ctx, job.ID, job.Attempts, "timed out", true, time.Minute); err != nil {
+			t.Fatalf("Failed to fail job: %v", err)
+		}
+		if job, _ := store.ClaimImageJob(ctx); job != nil {
+			t.Fatalf("Expected no job before the backoff, got %+v", job)
+		}
+		store.ageImage(t, job.ID, 2*time.Minute)
+		retry := claimTestJob(t, store)
+		if retry.ID != job.ID || retry.Attempts != 2 {
+			t.Errorf("Expected the second attempt at %s, got %+v", job.ID, retry)
+		}
+
+		if err := store.FailImageJob(ctx, retry.ID, retry.Attempts, "not an image", false, 0); err != nil {
+			t.Fatalf("Failed to fail job: %v", err)
+		}
+		if usage, _ := store.GetUsage(ctx, key.KeyHash); usage.Used != 0 {
+			t.Errorf("Expected the failed image to be refunded, got %+v", usage)
+		}
+	}},
+	{"stale jobs are reclaimed, then abandoned", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "")
+		batchID, err := store.CreateBatch(ctx, key, []string{"https://example.com/a.png"}, BatchSettings{Quality: 80, Format: "webp"}, "")
+		if err != nil {
+			t.Fatalf("Failed to create batch: %v", err)
+		}
+
+		for attempt := 1; attempt <= maxJobAttempts; attempt++ {
+			job := claimTestJob(t, store)
+			if job.Abandoned || job.Attempts != attempt {
+				t.Fatalf("Expected attempt %d, got %+v", attempt, job)
+			}
+			if job, _ := store.ClaimImageJob(ctx); job != nil {
+				t.Fatalf("Expected a running job not to be claimed again, got %+v", job)
+			}
+			store.ageImage(t, job.ID, staleJobTimeout+time.Minute)
+		}
+
+		job := claimTestJob(t, store)
+		if !job.Abandoned {
+			t.Fatalf("Expected the job to be abandoned, got %+v", job)
+		}
+		status, _ := store.GetBatchStatus(ctx, "buyer@example.com", batchID)
+		if status.Failed != 1 || status.Images[0].Error != abandonedJobError {
+			t.Errorf("Expected the image to fail, got %+v", status)
+		}
+		if usage, _ := store.GetUsage(ctx, key.KeyHash); usage.Used != 0 {
+			t.Errorf("Expected the abandoned image to be refunded, got %+v", usage)
+		}
+		if job, _ := store.ClaimImageJob(ctx); job != nil {
+			t.Errorf("Expected nothing left to claim, got %+v", job)
+		}
+		if finished, _ := store.FinishBatch(ctx, batchID); !finished {
+			t.Error("Expected the batch to finish")
+		}
+	}},
+	{"a worker that lost its claim can't record a result", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "")
+		batchID, err := store.CreateBatch(ctx, key, []string{"https://example.com/a.png"}, BatchSettings{Quality: 80, Format: "webp"}, "")
+		if err != nil {
+			t.Fatalf("Failed to create batch: %v", err)
+		}
+
+		// The first worker stalls until its job goes stale and is claimed again
+		stalled := claimTestJob(t, store)
+		store.ageImage(t, stalled.ID, staleJobTimeout+time.Minute)
+		job := claimTestJob(t, store)
+		if job.ID != stalled.ID || job.Attempts != 2 {
+			t.Fatalf("Expected the second attempt at %s, got %+v", stalled.ID, job)
+		}
+
+		if err := store.FailImageJob(ctx, stalled.ID, stalled.Attempts, "timed out", false, 0); !errors.Is(err, errLostClaim) {
+			t.Errorf("Expected errLostClaim failing the stale attempt, got %v", err)
+		}
+		if usage, _ := store.GetUsage(ctx, key.KeyHash); usage.Used != 1 {
+			t.Errorf("Expected the credit not to be refunded, got %+v", usage)
+		}
+		if err := store.CompleteImageJob(ctx, stalled.ID, stalled.Attempts, 100, 50, "out/"+stalled.ID, time.Hour); !errors.Is(err, errLostClaim) {
+			t.Errorf("Expected errLostClaim completing the stale attempt, got %v", err)
+		}
+		if err := store.ReleaseImageJob(ctx, stalled.ID, stalled.Attempts); !errors.Is(err, errLostClaim) {
+			t.Errorf("Expected errLostClaim releasing the stale attempt, got %v", err)
+		}
+
+		if err := store.CompleteImageJob(ctx, job.ID, job.Attempts, 100, 50, "out/"+job.ID, time.Hour); err != nil {
+			t.Fatalf("Failed to complete job: %v", err)
+		}
+		if err := store.FailImageJob(ctx, job.ID, job.Attempts, "timed out", false, 0); !errors.Is(err, errLostClaim) {
+			t.Errorf("Expected errLostClaim failing a completed job, got %v", err)
+		}
+		status, _ := store.GetBatchStatus(ctx, "buyer@example.com", batchID)
+		if status.Completed != 1 || status.Failed != 0 {
+			t.Errorf("Expected the image to stay completed, got %+v", status)
+		}
+		if usage, _ := store.GetUsage(ctx, key.KeyHash); usage.Used != 1 {
+			t.Errorf("Expected the completed image to keep its credit, got %+v", usage)
+		}
+	}},
+	{"outputs expire after their retention", func(t *testing.T, store testStore) {
+		ctx := context.Background()
+		key := buyTestKey(t, store, "cs_1", "buyer@example.com", "starter", "")
+		if _, err := store.CreateBatch(ctx, key, []string{"https://example.com/a.png"}, BatchSettings{Quality: 80, Format: "webp"}, ""); err != nil {
+			t.Fatalf("Failed to create batch: %v", err)
+		}
+
+		job := claimTestJob(t, store)
+		if err := store.CompleteImageJob(ctx, job.ID, job.Attempts, 100, 50, "out/"+job.ID, time.Hour); err != nil {
+			t.Fatalf("Failed to complete job: %v", err)
+		}
+		output, err := store.GetImageOutput(ctx, "buyer@example.com", job.ID)
+		if err != nil || output.Key == nil || *output.Key != "out/"+job.ID || output.ExpiresAt == nil {
+			t.Fatalf("Expected the stored output, got %+v (%v)", output, err)
+		}
+		if until := time.Until(*output.ExpiresAt); until < 59*time.Minute || until > time.Hour {
+			t.Errorf("Expected the output to expire in an hour, got %v", until)
+		}
+		if _, err := store.GetImageOutput(ctx, "other@example.com", job.ID); !errors.Is(err, errImageNotFound) {
+			t.Errorf("Expected errImageNotFound for another account, got %v", err)
+		}
+		if expired, _ := store.ExpiredOutputs(ctx, 10); len(expired) != 0 {
+			t.Errorf("Expected no expired outputs, got %+v", expired)
+		}
+
+		store.ageImage(t, job.ID, 2*time.Hour)
+		expired, err := store.ExpiredOutputs(ctx, 10)
+		if err != nil || len(expired) != 1 || expired[0].ImageID != job.ID {
+			t.Fatalf("Expected %s to have expired, got %+v (%v)", job.ID, expired, err)
+		}
+		if err := store.ClearOutputKey(ctx, job.ID); err != nil {
+			t.Fatalf("Failed to clear output key: %v", err)
+		}
+		if expired, _ := store.ExpiredOutputs(ctx, 10); len(expired) != 0 {
+			t.Errorf("Expected a cleared output not to expire again, got %+v", expired)
+		}
+	}},
+}
+
+func TestStores(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) testStore
+	}{
+		{"memory", newTestMemoryStore},
+		{"postgres", newTestPgStore},
+	}
+
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			for _, c := range storeCases {
+				t.Run(c.name, func(t *testing.T) {
+					c.run(t, s.open(t))
+				})
+			}
+		})
+	}
+}
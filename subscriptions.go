@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+)
+
+// handleInvoicePaid renews the credits of a subscription key for the new
+// billing period. Only invoices that start a period renew: proration invoices
+// for a mid-period plan change don't, or upgrading would reset the quota.
+func (s *Server) handleInvoicePaid(ctx context.Context, event stripe.Event) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(event.Data.Raw, &inv); err != nil {
+		return fmt.Errorf("decode invoice: %w", err)
+	}
+
+	if inv.Subscription == nil {
+		return nil
+	}
+
+	// The first invoice is usually paid before checkout provisions the key,
+	// in which case there is nothing to renew yet
+	switch inv.BillingReason {
+	case stripe.InvoiceBillingReasonSubscriptionCycle, stripe.InvoiceBillingReasonSubscriptionCreate:
+	default:
+		s.logger.Info("invoice doesn't start a billing period", "invoice_id", inv.ID, "billing_reason", inv.BillingReason)
+		return nil
+	}
+
+	plan, periodStart, err := planForInvoice(&inv)
+	if err != nil {
+		return fmt.Errorf("invoice %s: %w", inv.ID, err)
+	}
+
+	updated, err := s.store.ApplySubscriptionPlan(ctx, inv.Subscription.ID, plan, &periodStart, nil)
+	if err != nil {
+		return fmt.Errorf("renew subscription %s: %w", inv.Subscription.ID, err)
+	}
+	if updated == 0 {
+		s.logger.Warn("no api key for paid subscription invoice", "subscription_id", inv.Subscription.ID, "invoice_id", inv.ID)
+		return nil
+	}
+
+	s.logger.Info("subscription renewed", "subscription_id", inv.Subscription.ID, "plan", plan.ID)
+	return nil
+}
+
+// handleSubscriptionUpdated applies plan changes and suspends or restores the key
+// as the subscription moves between states. Stripe may deliver these events
+// out of order, so one older than the last applied to the key is skipped.
+func (s *Server) handleSubscriptionUpdated(ctx context.Context, event stripe.Event) error {
+	var sub stripe.Subscription
+	if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+		return fmt.Errorf("decode subscription: %w", err)
+	}
+	eventAt := time.Unix(event.Created, 0).UTC()
+
+	if !subscriptionActive(sub.Status) {
+		if sub.Status == stripe.SubscriptionStatusIncomplete {
+			// Checkout hasn't finished collecting the first payment yet
+			return nil
+		}
+		updated, err := s.store.SuspendSubscriptionKey(ctx, sub.ID, eventAt)
+		if err != nil {
+			return fmt.Errorf("suspend subscription %s: %w", sub.ID, err)
+		}
+		if updated > 0 {
+			s.logger.Info("subscription key suspended", "subscription_id", sub.ID, "reason", sub.Status)
+		}
+		return nil
+	}
+
+	plan, err := planForSubscription(&sub)
+	if err != nil {
+		return fmt.Errorf("subscription %s: %w", sub.ID, err)
+	}
+
+	updated, err := s.store.ApplySubscriptionPlan(ctx, sub.ID, plan, nil, &eventAt)
+	if err != nil {
+		return fmt.Errorf("update subscription %s: %w", sub.ID, err)
+	}
+	if updated > 0 {
+		s.logger.Info("subscription updated", "subscription_id", sub.ID, "plan", plan.ID, "status", sub.Status)
+	}
+	return nil
+}
+
+// handleSubscriptionDeleted suspends the key of a cancelled subscription for
+// good, whenever the event arrives
+func (s *Server) handleSubscriptionDeleted(ctx context.Context, event stripe.Event) error {
+	var sub stripe.Subscription
+	if err := json.Unmarshal(event.Data.Raw, &sub); err != nil {
+		return fmt.Errorf("decode subscription: %w", err)
+	}
+
+	updated, err := s.store.EndSubscriptionKey(ctx, sub.ID)
+	if err != nil {
+		return fmt.Errorf("end subscription %s: %w", sub.ID, err)
+	}
+	if updated > 0 {
+		s.logger.Info("subscription key suspended", "subscription_id", sub.ID, "reason", "deleted")
+	}
+	return nil
+}
+
+// subscriptionActive reports whether a subscription in this status keeps its key usable.
+// Past-due subscriptions stay active while Stripe retries the payment.
+func subscriptionActive(status stripe.SubscriptionStatus) bool {
+	switch status {
+	case stripe.SubscriptionStatusActive,
+		stripe.SubscriptionStatusTrialing,
+		stripe.SubscriptionStatusPastDue:
+		return true
+	}
+	return false
+}
+
+// planForSubscription resolves the plan from the subscription's price
+func planForSubscription(sub *stripe.Subscription) (Plan, error) {
+	if sub.Items == nil || len(sub.Items.Data) == 0 {
+		return Plan{}, fmt.Errorf("%w: subscription has no items", errUnknownPrice)
+	}
+	return planForPrice(sub.Items.Data[0].Price)
+}
+
+// planForInvoice resolves the plan, and the start of the period the invoice
+// pays for, from the first invoice line with a known price. The invoice's own
+// period_start is the previous period, so the line's is used.
+func planForInvoice(inv *stripe.Invoice) (Plan, time.Time, error) {
+	if inv.Lines == nil {
+		return Plan{}, time.Time{}, fmt.Errorf("%w: invoice has no lines", errUnknownPrice)
+	}
+
+	for _, line := range inv.Lines.Data {
+		plan, err := planForPrice(line.Price)
+		if err != nil {
+			continue
+		}
+		if line.Period == nil || line.Period.Start == 0 {
+			return Plan{}, time.Time{}, fmt.Errorf("invoice line %s has no period", line.ID)
+		}
+		return plan, time.Unix(line.Period.Start, 0).UTC(), nil
+	}
+	return Plan{}, time.Time{}, fmt.Errorf("%w: no invoice line matches a plan", errUnknownPrice)
+}
+
+// ApplySubscriptionPlan moves the key tied to a subscription onto plan and lifts
+// any suspension. A non-nil periodStart also starts a new billing period. A
+// non-nil eventAt is when the subscription event was created; the key is left
+// alone if a later one has already been applied. Keys of deleted subscriptions
+// are never changed. It returns the number of keys updated.
+func (pg *pgStore) ApplySubscriptionPlan(ctx context.Context, subscriptionID string, plan Plan, periodStart, eventAt *time.Time) (int64, error) {
+	query := `
+		UPDATE api_keys
+		SET tier = $2,
+			monthly_limit = $3,
+			suspended_at = NULL,
+			period_start = COALESCE($4, period_start),
+			subscription_event_at = COALESCE($5, subscription_event_at)
+		WHERE stripe_subscription_id = $1
+			AND subscription_ended_at IS NULL
+			AND ($5::timestamptz IS NULL OR subscription_event_at IS NULL OR subscription_event_at <= $5)
+	`
+
+	tag, err := pg.pool.Exec(ctx, query, subscriptionID, plan.ID, plan.Credits, periodStart, eventAt)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// SuspendSubscriptionKey blocks the key tied to a subscription until it is
+// paid again, unless a subscription event created after eventAt has already
+// been applied. It returns the number of keys that weren't suspended before.
+func (pg *pgStore) SuspendSubscriptionKey(ctx context.Context, subscriptionID string, eventAt time.Time) (int64, error) {
+	// The event time is recorded even on keys that are already suspended, so
+	// an older event restoring the key can't arrive after it. prev is the row
+	// as it was before the update.
+	query := `
+		UPDATE api_keys AS k
+		SET suspended_at = COALESCE(k.suspended_at, now()),
+			subscription_event_at = $2
+		FROM api_keys AS prev
+		WHERE prev.key_hash = k.key_hash
+			AND k.stripe_subscription_id = $1
+			AND (k.subscription_event_at IS NULL OR k.subscription_event_at <= $2)
+		RETURNING prev.suspended_at IS NULL
+	`
+
+	rows, err := pg.pool.Query(ctx, query, subscriptionID, eventAt)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var suspended int64
+	for rows.Next() {
+		var wasActive bool
+		if err := rows.Scan(&wasActive); err != nil {
+			return 0, err
+		}
+		if wasActive {
+			suspended++
+		}
+	}
+	return suspended, rows.Err()
+}
+
+// EndSubscriptionKey suspends the key tied to a deleted subscription. Unlike
+// SuspendSubscriptionKey it ignores event order, and nothing lifts it.
+func (pg *pgStore) EndSubscriptionKey(ctx context.Context, subscriptionID string) (int64, error) {
+	query := `
+		UPDATE api_keys
+		SET suspended_at = COALESCE(suspended_at, now()),
+			subscription_ended_at = now()
+		WHERE stripe_subscription_id = $1 AND subscription_ended_at IS NULL
+	`
+
+	tag, err := pg.pool.Exec(ctx, query, subscriptionID)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
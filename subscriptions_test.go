@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+)
+
+func TestSubscriptionActive(t *testing.T) {
+	tests := map[stripe.SubscriptionStatus]bool{
+		stripe.SubscriptionStatusActive:            true,
+		stripe.SubscriptionStatusTrialing:          true,
+		stripe.SubscriptionStatusPastDue:           true,
+		stripe.SubscriptionStatusUnpaid:            false,
+		stripe.SubscriptionStatusCanceled:          false,
+		stripe.SubscriptionStatusIncompleteExpired: false,
+		stripe.SubscriptionStatusPaused:            false,
+	}
+
+	for status, want := range tests {
+		if got := subscriptionActive(status); got != want {
+			t.Errorf("subscriptionActive(%s) = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestPlanForSubscription(t *testing.T) {
+	t.Setenv("STRIPE_PRICE_GROWTH_MONTHLY", "price_growth_monthly")
+
+	sub := &stripe.Subscription{
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{{Price: &stripe.Price{ID: "price_growth_monthly"}}},
+		},
+	}
+	plan, err := planForSubscription(sub)
+	if err != nil || plan.ID != "growth" {
+		t.Errorf("Expected growth plan, got %q (err %v)", plan.ID, err)
+	}
+
+	if _, err := planForSubscription(&stripe.Subscription{}); !errors.Is(err, errUnknownPrice) {
+		t.Errorf("Expected errUnknownPrice for subscription without items, got %v", err)
+	}
+}
+
+func TestPlanForInvoice(t *testing.T) {
+	t.Setenv("STRIPE_PRICE_PRO_MONTHLY", "price_pro_monthly")
+
+	inv := &stripe.Invoice{
+		Lines: &stripe.InvoiceLineItemList{
+			Data: []*stripe.InvoiceLineItem{
+				{Price: &stripe.Price{ID: "price_tax_adjustment"}},
+				{Price: &stripe.Price{ID: "price_pro_monthly"}, Period: &stripe.Period{Start: 1792108800, End: 1794787200}},
+			},
+		},
+	}
+	plan, start, err := planForInvoice(inv)
+	if err != nil || plan.ID != "professional" {
+		t.Errorf("Expected professional plan, got %q (err %v)", plan.ID, err)
+	}
+	if want := time.Unix(1792108800, 0); !start.Equal(want) {
+		t.Errorf("Expected the period to start at %v, got %v", want, start)
+	}
+
+	inv.Lines.Data = inv.Lines.Data[:1]
+	if _, _, err := planForInvoice(inv); !errors.Is(err, errUnknownPrice) {
+		t.Errorf("Expected errUnknownPrice for unknown invoice lines, got %v", err)
+	}
+}
+
+func TestCheckoutRejectsUnknownBilling(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("POST", "/checkout", strings.NewReader("tier=starter&billing=weekly"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestPricingPageOffersSubscriptions(t *testing.T) {
+	server := NewServer(":8080")
+
+	render := func() string {
+		req := httptest.NewRequest("GET", "/compress", nil)
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	t.Setenv("STRIPE_PRICE_STARTER_MONTHLY", "")
+	if strings.Contains(render(), `value="monthly"`) {
+		t.Error("Monthly billing should be hidden when no recurring price is configured")
+	}
+
+	t.Setenv("STRIPE_PRICE_STARTER_MONTHLY", "price_starter_monthly")
+	body := render()
+	if !strings.Contains(body, "Subscribe Monthly") {
+		t.Error("Monthly billing should be offered when a recurring price is configured")
+	}
+	if !strings.Contains(body, "$10 / month") {
+		t.Error("Expected the pricing page to show the starter plan's monthly price")
+	}
+}
+
+func TestInvoicePaidRenewsOnlyNewPeriods(t *testing.T) {
+	t.Setenv("STRIPE_PRICE_GROWTH_MONTHLY", "price_growth_monthly")
+
+	periodStart := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		reason    stripe.InvoiceBillingReason
+		wantRenew bool
+	}{
+		{stripe.InvoiceBillingReasonSubscriptionCycle, true},
+		{stripe.InvoiceBillingReasonSubscriptionCreate, true},
+		{stripe.InvoiceBillingReasonSubscriptionUpdate, false},
+		{stripe.InvoiceBillingReasonManual, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.reason), func(t *testing.T) {
+			store := newMemoryStore()
+			server := NewServer(":8080", WithStore(store))
+			starter, _ := planByID("starter")
+			if _, err := store.ProvisionCheckoutKey(context.Background(), "cs_test_1", "buyer@example.com", starter, "sub_123"); err != nil {
+				t.Fatal(err)
+			}
+			key := store.keys[store.checkouts["cs_test_1"].keyHash]
+			before := *key.PeriodStart
+
+			raw, _ := json.Marshal(map[string]any{
+				"id":             "in_123",
+				"billing_reason": tt.reason,
+				"subscription":   "sub_123",
+				"lines": map[string]any{"data": []map[string]any{{
+					"id":     "il_123",
+					"price":  map[string]any{"id": "price_growth_monthly"},
+					"period": map[string]any{"start": periodStart.Unix(), "end": periodStart.AddDate(0, 1, 0).Unix()},
+				}}},
+			})
+			event := stripe.Event{Data: &stripe.EventData{Raw: raw}}
+			if err := server.handleInvoicePaid(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.wantRenew {
+				if !key.PeriodStart.Equal(periodStart) {
+					t.Errorf("Expected the period to start at the invoice line's %v, got %v", periodStart, key.PeriodStart)
+				}
+				if key.Tier != "growth" {
+					t.Errorf("Expected tier growth, got %q", key.Tier)
+				}
+			} else if !key.PeriodStart.Equal(before) || key.Tier != "starter" {
+				t.Errorf("Expected the key to be left alone, got tier %q from %v", key.Tier, key.PeriodStart)
+			}
+		})
+	}
+}
+
+func TestSubscriptionEventsOutOfOrder(t *testing.T) {
+	t.Setenv("STRIPE_PRICE_GROWTH_MONTHLY", "price_growth_monthly")
+
+	subscription := func(status string) map[string]any {
+		return map[string]any{
+			"id":     "sub_123",
+			"object": "subscription",
+			"status": status,
+			"items": map[string]any{"object": "list", "data": []map[string]any{{
+				"id":    "si_123",
+				"price": map[string]any{"id": "price_growth_monthly"},
+			}}},
+		}
+	}
+
+	updated := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name      string
+		eventType string
+		status    string
+	}{
+		{"deleted", "customer.subscription.deleted", "canceled"},
+		{"unpaid", "customer.subscription.updated", "unpaid"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemoryStore()
+			server := NewServer(":8080", WithStore(store))
+			starter, _ := planByID("starter")
+			if _, err := store.ProvisionCheckoutKey(context.Background(), "cs_test_1", "buyer@example.com", starter, "sub_123"); err != nil {
+				t.Fatal(err)
+			}
+			key := store.keys[store.checkouts["cs_test_1"].keyHash]
+
+			// The later event arrives first, then the stale activation
+			if w := postStripeEvent(t, server, tt.eventType, updated.Add(time.Minute), subscription(tt.status)); w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			if w := postStripeEvent(t, server, "customer.subscription.updated", updated, subscription("active")); w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			if !key.Suspended {
+				t.Error("Expected the stale event not to reinstate the key")
+			}
+			if key.Tier != "starter" {
+				t.Errorf("Expected the stale event not to change the plan, got %q", key.Tier)
+			}
+		})
+	}
+
+	t.Run("deleted then newer update", func(t *testing.T) {
+		store := newMemoryStore()
+		server := NewServer(":8080", WithStore(store))
+		starter, _ := planByID("starter")
+		if _, err := store.ProvisionCheckoutKey(context.Background(), "cs_test_1", "buyer@example.com", starter, "sub_123"); err != nil {
+			t.Fatal(err)
+		}
+		key := store.keys[store.checkouts["cs_test_1"].keyHash]
+
+		postStripeEvent(t, server, "customer.subscription.deleted", updated, subscription("canceled"))
+		postStripeEvent(t, server, "customer.subscription.updated", updated.Add(time.Minute), subscription("active"))
+
+		if !key.Suspended {
+			t.Error("Expected a deleted subscription's key to stay suspended")
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Usage is a key's credit consumption in its current billing period. Keys
+// bought as a one-time credit pack have no period: their credits never reset,
+// so Used counts every image since purchase and the period is null.
+type Usage struct {
+	Tier         string     `json:"tier"` // Plan ID, e.g. "growth"
+	MonthlyLimit int        `json:"monthly_limit"`
+	Used         int        `json:"used"`
+	Remaining    int        `json:"remaining"`
+	PeriodStart  *time.Time `json:"period_start"`
+	PeriodEnd    *time.Time `json:"period_end"`
+}
+
+// quotaError rejects a batch that needs more credits than the key has left.
+// ResetsAt is nil for keys whose credits never reset.
+type quotaError struct {
+	Requested int
+	Remaining int
+	ResetsAt  *time.Time
+}
+
+func (e *quotaError) Error() string {
+	if e.ResetsAt == nil {
+		return fmt.Sprintf("Credit pack used up: this request needs %d credits but only %d remain. Credit packs don't reset; buy another to continue",
+			e.Requested, e.Remaining)
+	}
+	return fmt.Sprintf("Monthly image limit reached: this request needs %d credits but only %d remain. Credits reset on %s",
+		e.Requested, e.Remaining, e.ResetsAt.Format("2006-01-02"))
+}
+
+// usagePeriod returns the billing period containing now, or ok false for a
+// key whose credits never reset. Subscription keys count from their last
+// renewal and free keys count calendar months in UTC; one-time credit packs
+// are charged against every image since purchase.
+func usagePeriod(now time.Time, tier string, periodStart *time.Time) (start, end time.Time, ok bool) {
+	if periodStart != nil {
+		return *periodStart, periodStart.AddDate(0, 1, 0), true
+	}
+	if plan, found := planByID(tier); !found || !plan.IsFree() {
+		return time.Time{}, time.Time{}, false
+	}
+	now = now.UTC()
+	start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(0, 1, 0), true
+}
+
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	key, _ := apiKeyFromContext(r.Context())
+
+	usage, err := s.store.GetUsage(r.Context(), key.KeyHash)
+	if err != nil {
+		s.logger.Error("failed to load usage", "key_prefix", key.KeyPrefix, "error", err)
+		writeAPIError(w, http.StatusInternalServerError, "Failed to load usage")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// dbQuerier is satisfied by both the connection pool and a transaction
+type dbQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// getUsage totals a key's ledger for its current period. With lock set the
+// key row is locked until the surrounding transaction ends, so concurrent
+// requests for the same key see each other's charges.
+func getUsage(ctx context.Context, db dbQuerier, keyHash string, lock bool) (Usage, error) {
+	query := `SELECT tier, monthly_limit, period_start FROM api_keys WHERE key_hash = $1`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+
+	var usage Usage
+	var periodStart *time.Time
+	if err := db.QueryRow(ctx, query, keyHash).Scan(&usage.Tier, &usage.MonthlyLimit, &periodStart); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Usage{}, errUnknownAPIKey
+		}
+		return Usage{}, err
+	}
+	start, end, resets := usagePeriod(time.Now(), usage.Tier, periodStart)
+	if resets {
+		usage.PeriodStart, usage.PeriodEnd = &start, &end
+	}
+
+	// start is the zero time for keys that never reset, which counts every charge
+	err := db.QueryRow(ctx, `
+		SELECT count(*) FROM usage_ledger
+		WHERE key_hash = $1 AND refunded_at IS NULL AND created_at >= $2
+	`, keyHash, start).Scan(&usage.Used)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	usage.Remaining = max(0, usage.MonthlyLimit-usage.Used)
+	return usage, nil
+}
+
+// GetUsage returns a key's usage for its current period
+func (pg *pgStore) GetUsage(ctx context.Context, keyHash string) (Usage, error) {
+	return getUsage(ctx, pg.pool, keyHash, false)
+}
+
+// reserveCredits locks the key and checks that n more images fit in its
+// quota. The caller records the charge in usage_ledger in the same
+// transaction.
+func reserveCredits(ctx context.Context, tx pgx.Tx, keyHash string, n int) error {
+	usage, err := getUsage(ctx, tx, keyHash, true)
+	if err != nil {
+		return err
+	}
+	if n > usage.Remaining {
+		return &quotaError{Requested: n, Remaining: usage.Remaining, ResetsAt: usage.PeriodEnd}
+	}
+	return nil
+}
+
+// ChargeCredit charges one image to a key outside of a batch and returns the
+// ledger row, so the charge can be refunded if the image can't be processed
+func (pg *pgStore) ChargeCredit(ctx context.Context, keyHash string) (int64, error) {
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := reserveCredits(ctx, tx, keyHash, 1); err != nil {
+		return 0, err
+	}
+
+	var id int64
+	err = tx.QueryRow(ctx, `INSERT INTO usage_ledger (key_hash) VALUES ($1) RETURNING id`, keyHash).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit(ctx)
+}
+
+// RefundCredit refunds a charge made by ChargeCredit
+func (pg *pgStore) RefundCredit(ctx context.Context, id int64) error {
+	_, err := pg.pool.Exec(ctx, `UPDATE usage_ledger SET refunded_at = now() WHERE id = $1 AND refunded_at IS NULL`, id)
+	return err
+}
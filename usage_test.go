@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsagePeriod(t *testing.T) {
+	now := time.Date(2026, 10, 16, 15, 30, 0, 0, time.UTC)
+	renewed := time.Date(2026, 9, 20, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		now         time.Time
+		tier        string
+		periodStart *time.Time
+		wantStart   time.Time
+		wantEnd     time.Time
+		wantResets  bool
+	}{
+		{"free calendar month", now, "free", nil, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), true},
+		{"december rolls over", time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC), "free", nil, time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC), true},
+		{"non-UTC clock", time.Date(2026, 11, 1, 1, 0, 0, 0, time.FixedZone("CET", 3600)), "free", nil, time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), true},
+		{"subscription", now, "growth", &renewed, renewed, time.Date(2026, 10, 20, 8, 0, 0, 0, time.UTC), true},
+		{"one-time pack", now, "growth", nil, time.Time{}, time.Time{}, false},
+		{"retired plan", now, "Legacy", nil, time.Time{}, time.Time{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, resets := usagePeriod(tt.now, tt.tier, tt.periodStart)
+			if resets != tt.wantResets {
+				t.Fatalf("Expected resets %v, got %v", tt.wantResets, resets)
+			}
+			if !start.Equal(tt.wantStart) || !end.Equal(tt.wantEnd) {
+				t.Errorf("Expected %v to %v, got %v to %v", tt.wantStart, tt.wantEnd, start, end)
+			}
+		})
+	}
+}
+
+func TestQuotaErrorMessage(t *testing.T) {
+	resets := time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		err  *quotaError
+		want string
+	}{
+		{"monthly", &quotaError{Requested: 50, Remaining: 20, ResetsAt: &resets},
+			"Monthly image limit reached: this request needs 50 credits but only 20 remain. Credits reset on 2026-11-01"},
+		{"credit pack", &quotaError{Requested: 50, Remaining: 20},
+			"Credit pack used up: this request needs 50 credits but only 20 remain. Credit packs don't reset; buy another to continue"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.err.Error() != tt.want {
+				t.Errorf("Expected %q, got %q", tt.want, tt.err.Error())
+			}
+		})
+	}
+}
+
+func TestCreditPackUsageDoesNotReset(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	apiKey := storeAPIKey(t, store, "customer@example.com", "starter")
+
+	// A charge from before this calendar month still counts
+	store.charge(hashToken(apiKey), "")
+	store.ledger[0].createdAt = time.Now().AddDate(0, -2, 0)
+
+	req := httptest.NewRequest("GET", "/api/v1/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	var usage Usage
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Used != 1 {
+		t.Errorf("Expected 1 used, got %d", usage.Used)
+	}
+	if usage.PeriodStart != nil || usage.PeriodEnd != nil {
+		t.Errorf("Expected no period for a credit pack, got %v to %v", usage.PeriodStart, usage.PeriodEnd)
+	}
+}
+
+func TestUsageRequiresAPIKey(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("GET", "/api/v1/usage", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestUsageReportsCharges(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+	apiKey := storeAPIKey(t, store, "customer@example.com", "starter")
+
+	id, err := store.ChargeCredit(context.Background(), hashToken(apiKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.ChargeCredit(context.Background(), hashToken(apiKey))
+	store.RefundCredit(context.Background(), id)
+
+	req := httptest.NewRequest("GET", "/api/v1/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var usage Usage
+	if err := json.Unmarshal(w.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Tier != "starter" {
+		t.Errorf("Expected tier %q, got %q", "starter", usage.Tier)
+	}
+	starter, _ := planByID("starter")
+	if usage.Used != 1 || usage.Remaining != starter.Credits-1 {
+		t.Errorf("Expected 1 used and %d remaining, got %d and %d", starter.Credits-1, usage.Used, usage.Remaining)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build metadata, set at link time by BuildProd, scripts/build.sh and the
+// Dockerfile:
+//
+//	-ldflags "-X main.version=v1.2.0 -X main.commit=abc1234 -X main.buildTime=2025-01-01T00:00:00Z"
+var (
+	version   string
+	commit    string
+	buildTime string
+)
+
+// buildInfo identifies the running binary
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	Modified  bool   `json:"modified,omitempty"` // Uncommitted changes, when Commit came from Go
+	GoVersion string `json:"go_version"`
+}
+
+// build is the running binary's metadata
+var build = newBuildInfo(version, commit, buildTime, readBuildInfo())
+
+// readBuildInfo returns the metadata the Go toolchain embedded, or nil
+func readBuildInfo() *debug.BuildInfo {
+	info, _ := debug.ReadBuildInfo()
+	return info
+}
+
+// newBuildInfo prefers the link-time values and falls back to what the Go
+// toolchain embedded: the module version for `go install`, and the VCS
+// revision and commit time for builds inside a git checkout
+func newBuildInfo(version, commit, buildTime string, info *debug.BuildInfo) buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+
+	if info != nil {
+		b.GoVersion = info.GoVersion
+		if b.Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		vcs := make(map[string]string)
+		for _, s := range info.Settings {
+			vcs[s.Key] = s.Value
+		}
+		if b.Commit == "" && vcs["vcs.revision"] != "" {
+			b.Commit = vcs["vcs.revision"]
+			if len(b.Commit) > 12 {
+				b.Commit = b.Commit[:12]
+			}
+			b.Modified = vcs["vcs.modified"] == "true"
+		}
+		if b.BuildTime == "" {
+			b.BuildTime = vcs["vcs.time"]
+		}
+	}
+
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	if b.Commit == "" {
+		b.Commit = "unknown"
+	}
+	if b.BuildTime == "" {
+		b.BuildTime = "unknown"
+	}
+	return b
+}
+
+// handleVersion reports which build is running
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, build)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"testing"
+)
+
+func TestNewBuildInfo(t *testing.T) {
+	embedded := &debug.BuildInfo{
+		GoVersion: "go1.25.5",
+		Main:      debug.Module{Version: "v1.4.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "0123456789abcdef0123"},
+			{Key: "vcs.time", Value: "2026-01-02T03:04:05Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+
+	tests := []struct {
+		name                       string
+		version, commit, buildTime string
+		info                       *debug.BuildInfo
+		want                       buildInfo
+	}{
+		{
+			"link-time values win",
+			"v2.0.0", "abc1234", "2026-10-16T00:00:00Z", embedded,
+			buildInfo{Version: "v2.0.0", Commit: "abc1234", BuildTime: "2026-10-16T00:00:00Z", GoVersion: "go1.25.5"},
+		},
+		{
+			"falls back to embedded metadata",
+			"", "", "", embedded,
+			buildInfo{Version: "v1.4.0", Commit: "0123456789ab", BuildTime: "2026-01-02T03:04:05Z", Modified: true, GoVersion: "go1.25.5"},
+		},
+		{
+			"devel build without vcs",
+			"", "", "", &debug.BuildInfo{GoVersion: "go1.25.5", Main: debug.Module{Version: "(devel)"}},
+			buildInfo{Version: "dev", Commit: "unknown", BuildTime: "unknown", GoVersion: "go1.25.5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newBuildInfo(tt.version, tt.commit, tt.buildTime, tt.info)
+			if got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	server := NewServer(":8080")
+
+	req := httptest.NewRequest("GET", "/version", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	var got buildInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Expected JSON build info, got %q", w.Body.String())
+	}
+	if got != build {
+		t.Errorf("Expected %+v, got %+v", build, got)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/checkout/session"
+	"github.com/stripe/stripe-go/v81/webhook"
+)
+
+const (
+	// maxWebhookBodyBytes caps the size of an incoming Stripe event payload
+	maxWebhookBodyBytes = 65536
+
+	// checkoutKeyTTL is how long after buying a key the success page or the
+	// emailed claim link can still reveal it
+	checkoutKeyTTL = 24 * time.Hour
+)
+
+// errKeyNotProvisioned is returned when no key has been issued for a checkout session yet
+var errKeyNotProvisioned = errors.New("api key not provisioned")
+
+// errUnknownPrice is returned when a purchase doesn't match any tier we sell
+var errUnknownPrice = errors.New("unrecognised price")
+
+// checkoutKey is the API key issued for a completed checkout session.
+// APIKey is only set the first time the key is revealed, since that is when
+// the key is generated.
+type checkoutKey struct {
+	APIKey    string
+	KeyPrefix string
+	Tier      string
+	Credits   int
+	Email     string
+}
+
+// handleStripeWebhook verifies and dispatches events sent by Stripe
+func (s *Server) handleStripeWebhook(w http.ResponseWriter, r *http.Request) {
+	secret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+	if secret == "" {
+		s.logger.Error("stripe webhook received but STRIPE_WEBHOOK_SECRET not set")
+		http.Error(w, "Webhook not configured", http.StatusInternalServerError)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// The account's API version may lag behind the library's; the fields we
+	// read are stable across versions, so don't reject on mismatch.
+	event, err := webhook.ConstructEventWithOptions(payload, r.Header.Get("Stripe-Signature"), secret,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+	if err != nil {
+		s.logger.Warn("stripe webhook signature verification failed", "error", err, "ip", clientIP(r))
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+
+	switch event.Type {
+	case stripe.EventTypeCheckoutSessionCompleted, stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded:
+		err = s.handleCheckoutCompleted(r.Context(), event)
+	case stripe.EventTypeInvoicePaid:
+		err = s.handleInvoicePaid(r.Context(), event)
+	case stripe.EventTypeCustomerSubscriptionUpdated:
+		err = s.handleSubscriptionUpdated(r.Context(), event)
+	case stripe.EventTypeCustomerSubscriptionDeleted:
+		err = s.handleSubscriptionDeleted(r.Context(), event)
+	default:
+		s.logger.Info("ignoring stripe event", "type", event.Type, "event_id", event.ID)
+	}
+
+	if err != nil {
+		s.logger.Error("stripe webhook processing failed",
+			"type", event.Type,
+			"event_id", event.ID,
+			"error", err,
+		)
+		// A non-2xx response makes Stripe retry the delivery
+		http.Error(w, "Webhook processing failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleCheckoutCompleted issues an API key once a checkout session has been paid for
+func (s *Server) handleCheckoutCompleted(ctx context.Context, event stripe.Event) error {
+	var sess stripe.CheckoutSession
+	if err := json.Unmarshal(event.Data.Raw, &sess); err != nil {
+		return fmt.Errorf("decode checkout session: %w", err)
+	}
+
+	// Delayed payment methods complete the session before the money arrives;
+	// those are provisioned on checkout.session.async_payment_succeeded instead.
+	// Subscriptions that start with a trial or a full discount owe nothing yet.
+	if sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusPaid &&
+		sess.PaymentStatus != stripe.CheckoutSessionPaymentStatusNoPaymentRequired {
+		s.logger.Info("checkout session not paid yet", "session_id", sess.ID, "payment_status", sess.PaymentStatus)
+		return nil
+	}
+
+	if sess.CustomerDetails == nil || sess.CustomerDetails.Email == "" {
+		return fmt.Errorf("checkout session %s has no customer email", sess.ID)
+	}
+
+	// Accounts are looked up by the lowercased email sign-in uses, and Stripe
+	// keeps the address as the buyer typed it
+	email, err := normalizeEmail(sess.CustomerDetails.Email)
+	if err != nil {
+		return fmt.Errorf("checkout session %s: %w", sess.ID, err)
+	}
+
+	plan, err := resolvePurchase(sess.ID)
+	if err != nil {
+		return err
+	}
+
+	subscriptionID := ""
+	if sess.Subscription != nil {
+		subscriptionID = sess.Subscription.ID
+	}
+
+	claim, err := s.store.ProvisionCheckoutKey(ctx, sess.ID, email, plan, subscriptionID)
+	if err != nil {
+		return fmt.Errorf("provision key for session %s: %w", sess.ID, err)
+	}
+	if claim == "" {
+		s.logger.Info("api key already provisioned", "session_id", sess.ID)
+		return nil
+	}
+
+	s.logger.Info("api key provisioned", "session_id", sess.ID, "plan", plan.ID)
+
+	// The buyer may close the tab before the success page shows the key.
+	// The key is saved either way, so a failed email isn't worth a retry.
+	msg := Message{
+		To:      email,
+		Subject: "Your GoTiny API key",
+		Body: "Thanks for buying the GoTiny " + plan.Name + " plan. If you didn't copy your API key " +
+			"from the page you saw after checkout, you can view it once here:\n\n" +
+			baseURL() + "/compress/claim?token=" + claim + "\n\n" +
+			"This link expires in 24 hours. After that, sign in at " + baseURL() + "/login " +
+			"and rotate the key to get a new one.\n",
+	}
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		s.logger.Error("failed to send api key email", "session_id", sess.ID, "error", err)
+	}
+	return nil
+}
+
+// resolvePurchase looks up the plan bought in a checkout session. The event
+// payload doesn't include line items, so the session is fetched again with
+// them expanded.
+func resolvePurchase(sessionID string) (Plan, error) {
+	params := &stripe.CheckoutSessionParams{}
+	params.AddExpand("line_items")
+
+	sess, err := session.Get(sessionID, params)
+	if err != nil {
+		return Plan{}, fmt.Errorf("retrieve checkout session: %w", err)
+	}
+
+	if sess.LineItems == nil || len(sess.LineItems.Data) != 1 {
+		return Plan{}, fmt.Errorf("%w: checkout session %s must contain exactly one line item", errUnknownPrice, sessionID)
+	}
+
+	plan, err := planForPrice(sess.LineItems.Data[0].Price)
+	if err != nil {
+		return Plan{}, fmt.Errorf("checkout session %s (amount %d %s): %w", sessionID, sess.AmountTotal, sess.Currency, err)
+	}
+	return plan, nil
+}
+
+// planForPrice resolves the plan bought with a Stripe price, first by the
+// STRIPE_PRICE_* ids used at checkout and then by the price's "tier" metadata
+func planForPrice(price *stripe.Price) (Plan, error) {
+	if price == nil {
+		return Plan{}, fmt.Errorf("%w: line item has no price", errUnknownPrice)
+	}
+
+	if plan, ok := planByPriceID(price.ID); ok {
+		return plan, nil
+	}
+
+	if plan, ok := planByID(price.Metadata["tier"]); ok && !plan.IsFree() {
+		return plan, nil
+	}
+
+	return Plan{}, fmt.Errorf("%w: %s", errUnknownPrice, price.ID)
+}
+
+// ProvisionCheckoutKey creates the API key for a checkout session. Keys bought
+// as a subscription are also linked to it so renewals and plan changes can
+// find them. Only the key's hash is kept, and nobody ever sees the key itself:
+// revealing it issues the key the buyer gets in its place. It returns a token
+// for ClaimCheckoutKey, or "" without creating anything when the session
+// already has a key.
+func (pg *pgStore) ProvisionCheckoutKey(ctx context.Context, sessionID, email string, plan Plan, subscriptionID string) (string, error) {
+	claim, claimHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	key, err := generateAPIKey(ctx, tx, email, plan)
+	if err != nil {
+		return "", err
+	}
+
+	if subscriptionID != "" {
+		_, err = tx.Exec(ctx, `
+			UPDATE api_keys SET stripe_subscription_id = $1, period_start = now()
+			WHERE key_hash = $2
+		`, subscriptionID, hashToken(key))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// A concurrent delivery for the same session blocks on the unique index
+	// until this transaction finishes, then falls through to DO NOTHING.
+	query := `
+		INSERT INTO checkout_keys (session_id, key_prefix, key_hash, tier, credits, user_email, claim_token_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (session_id) DO NOTHING
+	`
+
+	tag, err := tx.Exec(ctx, query, sessionID, key[:10], hashToken(key), plan.ID, plan.Credits, email, claimHash)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", nil
+	}
+
+	return claim, tx.Commit(ctx)
+}
+
+// RevealCheckoutKey returns the key issued for a checkout session. The first
+// call within checkoutKeyTTL of the purchase generates the key and returns it
+// in checkoutKey.APIKey; later calls only describe it.
+func (pg *pgStore) RevealCheckoutKey(ctx context.Context, sessionID string) (checkoutKey, error) {
+	return pg.revealCheckoutKey(ctx, "session_id", sessionID)
+}
+
+// ClaimCheckoutKey is RevealCheckoutKey for the emailed claim link
+func (pg *pgStore) ClaimCheckoutKey(ctx context.Context, token string) (checkoutKey, error) {
+	ck, err := pg.revealCheckoutKey(ctx, "claim_token_hash", hashToken(token))
+	if errors.Is(err, errKeyNotProvisioned) {
+		return ck, errInvalidToken
+	}
+	return ck, err
+}
+
+// revealCheckoutKey reveals the checkout key whose column matches value
+func (pg *pgStore) revealCheckoutKey(ctx context.Context, column, value string) (checkoutKey, error) {
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return checkoutKey{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var ck checkoutKey
+	var keyHash *string
+	var expired bool
+	err = tx.QueryRow(ctx, `
+		SELECT key_hash, key_prefix, tier, credits, user_email, created_at < now() - $2::interval
+		FROM checkout_keys
+		WHERE `+column+` = $1
+		FOR UPDATE
+	`, value, checkoutKeyTTL.String()).Scan(&keyHash, &ck.KeyPrefix, &ck.Tier, &ck.Credits, &ck.Email, &expired)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ck, errKeyNotProvisioned
+	}
+	if err != nil {
+		return ck, err
+	}
+
+	if keyHash != nil && !expired {
+		key, err := newAPIKey()
+		if err != nil {
+			return ck, err
+		}
+
+		// Nobody has the provisioned key, so it can be swapped for this one,
+		// unless the buyer has already rotated or revoked it from their account
+		tag, err := tx.Exec(ctx, `
+			UPDATE api_keys SET key_hash = $1, key_prefix = $2
+			WHERE key_hash = $3 AND revoked_at IS NULL
+		`, hashToken(key), key[:10], *keyHash)
+		if err != nil {
+			return ck, err
+		}
+		if tag.RowsAffected() == 1 {
+			ck.APIKey, ck.KeyPrefix = key, key[:10]
+		}
+	}
+
+	_, err = tx.Exec(ctx, `
+		UPDATE checkout_keys
+		SET key_hash = NULL, key_prefix = $2, revealed_at = COALESCE(revealed_at, now())
+		WHERE `+column+` = $1
+	`, value, ck.KeyPrefix)
+	if err != nil {
+		return ck, err
+	}
+
+	return ck, tx.Commit(ctx)
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stripe/stripe-go/v81"
+	"github.com/stripe/stripe-go/v81/webhook"
+)
+
+const testWebhookSecret = "whsec_test"
+
+func TestStripeWebhookSignature(t *testing.T) {
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	payload := []byte(`{"id":"evt_test","object":"event","type":"customer.created","data":{"object":{}}}`)
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  testWebhookSecret,
+	})
+
+	tests := []struct {
+		name      string
+		signature string
+		wantCode  int
+	}{
+		{"Valid signature", signed.Header, http.StatusOK},
+		{"Missing signature", "", http.StatusBadRequest},
+		{"Wrong secret", webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+			Payload: payload,
+			Secret:  "whsec_other",
+		}).Header, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/webhooks/stripe", strings.NewReader(string(payload)))
+			if tt.signature != "" {
+				req.Header.Set("Stripe-Signature", tt.signature)
+			}
+			w := httptest.NewRecorder()
+
+			server.router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Expected status %d, got %d", tt.wantCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestStripeWebhookNotConfigured(t *testing.T) {
+	t.Setenv("STRIPE_WEBHOOK_SECRET", "")
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("POST", "/webhooks/stripe", strings.NewReader("{}"))
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+// fakeStripe sends the Stripe client's API calls to handler for the rest of the test
+func fakeStripe(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	key := stripe.Key
+	stripe.Key = "sk_test_fake"
+	stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(srv.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+	}))
+	t.Cleanup(func() {
+		stripe.Key = key
+		stripe.SetBackend(stripe.APIBackend, nil)
+	})
+}
+
+// postStripeEvent delivers a signed Stripe event about object to server
+func postStripeEvent(t *testing.T, server *Server, eventType string, created time.Time, object map[string]any) *httptest.ResponseRecorder {
+	t.Helper()
+	t.Setenv("STRIPE_WEBHOOK_SECRET", testWebhookSecret)
+
+	payload, err := json.Marshal(map[string]any{
+		"id":      "evt_" + eventType,
+		"object":  "event",
+		"type":    eventType,
+		"created": created.Unix(),
+		"data":    map[string]any{"object": object},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  testWebhookSecret,
+	})
+
+	req := httptest.NewRequest("POST", "/webhooks/stripe", strings.NewReader(string(payload)))
+	req.Header.Set("Stripe-Signature", signed.Header)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCheckoutEmailMatchesSignIn(t *testing.T) {
+	t.Setenv("STRIPE_PRICE_STARTER", "price_starter")
+	fakeStripe(t, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":     "cs_test_1",
+			"object": "checkout.session",
+			"line_items": map[string]any{"object": "list", "data": []map[string]any{{
+				"id":    "li_1",
+				"price": map[string]any{"id": "price_starter"},
+			}}},
+		})
+	})
+
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	w := postStripeEvent(t, server, "checkout.session.completed", time.Now(), map[string]any{
+		"id":               "cs_test_1",
+		"object":           "checkout.session",
+		"payment_status":   "paid",
+		"customer_details": map[string]any{"email": "Buyer@Example.com"},
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	// Sign-in lowercases whatever the customer types
+	email, err := normalizeEmail("Buyer@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/account", nil)
+	req.AddCookie(signIn(t, server, email))
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	prefix := store.checkouts["cs_test_1"].KeyPrefix
+	if !strings.Contains(w.Body.String(), prefix) {
+		t.Errorf("Expected the account page to list key %s", prefix)
+	}
+}
+
+func TestPlanForPrice(t *testing.T) {
+	t.Setenv("STRIPE_PRICE_STARTER", "price_starter")
+	t.Setenv("STRIPE_PRICE_GROWTH", "price_growth")
+	t.Setenv("STRIPE_PRICE_PRO", "price_pro")
+
+	tests := []struct {
+		name     string
+		price    *stripe.Price
+		wantTier string
+		wantErr  bool
+	}{
+		{"Starter price", &stripe.Price{ID: "price_starter"}, "Starter", false},
+		{"Growth price", &stripe.Price{ID: "price_growth"}, "Growth", false},
+		{"Professional price", &stripe.Price{ID: "price_pro"}, "Professional", false},
+		{"Metadata fallback", &stripe.Price{ID: "price_other", Metadata: map[string]string{"tier": "growth"}}, "Growth", false},
+		{"Unknown price", &stripe.Price{ID: "price_other"}, "", true},
+		{"Unknown metadata", &stripe.Price{ID: "price_other", Metadata: map[string]string{"tier": "enterprise"}}, "", true},
+		{"Free plan metadata", &stripe.Price{ID: "price_other", Metadata: map[string]string{"tier": "free"}}, "", true},
+		{"Missing price", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := planForPrice(tt.price)
+			if tt.wantErr {
+				if !errors.Is(err, errUnknownPrice) {
+					t.Errorf("Expected errUnknownPrice, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if plan.Name != tt.wantTier {
+				t.Errorf("Expected tier %s, got %s", tt.wantTier, plan.Name)
+			}
+		})
+	}
+}
+
+func TestCheckoutRejectsUnknownTier(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("POST", "/checkout", strings.NewReader("tier=enterprise"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestSuccessRequiresSessionID(t *testing.T) {
+	server := NewServer(":8080", WithStore(newMemoryStore()))
+
+	req := httptest.NewRequest("GET", "/compress/success", nil)
+	w := httptest.NewRecorder()
+
+	server.router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+// shownKey returns the API key shown on a page, or ""
+func shownKey(body string) string {
+	return regexp.MustCompile(`ic_[0-9a-f]{64}`).FindString(body)
+}
+
+func TestSuccessRevealsKeyOnce(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	// The buyer can land on the success page before the webhook arrives
+	req := httptest.NewRequest("GET", "/compress/success?session_id=cs_test_1", nil)
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+
+	if w.Header().Get("Refresh") == "" {
+		t.Error("Expected the pending page to refresh itself")
+	}
+
+	starter, _ := planByID("starter")
+	if _, err := store.ProvisionCheckoutKey(context.Background(), "cs_test_1", "buyer@example.com", starter, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/compress/success?session_id=cs_test_1", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	key := shownKey(w.Body.String())
+	if key == "" {
+		t.Fatal("Expected the success page to show the API key")
+	}
+	if _, err := store.LoadAPIKey(context.Background(), hashToken(key)); err != nil {
+		t.Errorf("Expected the shown key to work, got %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/compress/success?session_id=cs_test_1", nil))
+
+	if shownKey(w.Body.String()) != "" {
+		t.Error("Expected the API key to be shown only once")
+	}
+}
+
+// postClaim submits the claim confirmation form
+func postClaim(server *Server, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/compress/claim", strings.NewReader(url.Values{"token": {token}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestClaimLinkRevealsKeyOnce(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	starter, _ := planByID("starter")
+	claim, err := store.ProvisionCheckoutKey(context.Background(), "cs_test_1", "buyer@example.com", starter, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := postClaim(server, claim)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if shownKey(w.Body.String()) == "" {
+		t.Error("Expected the claim link to show the API key")
+	}
+
+	// The success page and the claim link share the one reveal
+	w = httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/compress/success?session_id=cs_test_1", nil))
+
+	if shownKey(w.Body.String()) != "" {
+		t.Error("Expected the API key to be shown only once")
+	}
+
+	if w := postClaim(server, "wrong"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown token, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestClaimLinkDoesNotRevealKey(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	starter, _ := planByID("starter")
+	claim, err := store.ProvisionCheckoutKey(context.Background(), "cs_test_1", "buyer@example.com", starter, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A mail scanner opening the link only sees the confirmation form
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/compress/claim?token="+claim, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if shownKey(w.Body.String()) != "" {
+		t.Error("Expected opening the link not to show the API key")
+	}
+	if !strings.Contains(w.Body.String(), `value="`+claim+`"`) {
+		t.Error("Expected the page to post the token")
+	}
+	if c := store.checkouts["cs_test_1"]; c.keyHash == "" {
+		t.Error("Expected the key to be left unrevealed")
+	}
+
+	if shownKey(postClaim(server, claim).Body.String()) == "" {
+		t.Error("Expected confirming to show the API key")
+	}
+}
+
+func TestCheckoutKeyRevealExpires(t *testing.T) {
+	store := newMemoryStore()
+	server := NewServer(":8080", WithStore(store))
+
+	starter, _ := planByID("starter")
+	if _, err := store.ProvisionCheckoutKey(context.Background(), "cs_old", "buyer@example.com", starter, ""); err != nil {
+		t.Fatal(err)
+	}
+	store.checkouts["cs_old"].createdAt = time.Now().Add(-checkoutKeyTTL - time.Minute)
+
+	w := httptest.NewRecorder()
+	server.router.ServeHTTP(w, httptest.NewRequest("GET", "/compress/success?session_id=cs_old", nil))
+
+	if shownKey(w.Body.String()) != "" {
+		t.Error("Expected no key to be issued after the reveal window")
+	}
+	if !strings.Contains(w.Body.String(), "rotate it") {
+		t.Error("Expected the page to explain how to get a new key")
+	}
+}
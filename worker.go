@@ -0,0 +1,655 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/devrewoh/devrewoh-portfolio/internal/fetch"
+	"github.com/devrewoh/devrewoh-portfolio/internal/imaging"
+)
+
+const (
+	defaultWorkerCount = 4
+	maxJobAttempts     = 3
+	jobTimeout         = 2 * time.Minute
+	workerPollInterval = time.Second
+
+	// janitorInterval is how often expired outputs are deleted from storage
+	janitorInterval = 10 * time.Minute
+
+	// staleJobTimeout is how long a job can stay processing before another
+	// worker assumes its instance died and takes it over
+	staleJobTimeout = 10 * time.Minute
+
+	// abandonedJobError is recorded on an image whose worker died on every attempt
+	abandonedJobError = "processing was interrupted too many times"
+
+	// decodeBudgetPixels is how many decoded pixels batch workers and direct
+	// uploads may hold between them: two maximum-size images, about 420 MB of
+	// the VM's 1 GB
+	decodeBudgetPixels = 2 * imaging.MaxPixels
+
+	maxSourceImageBytes = 25 << 20
+	sourceUserAgent     = "GoTiny/1.0 (+https://devrewoh.com/compress)"
+)
+
+// errLostClaim is returned when a job's result is recorded by a worker that
+// no longer holds it: the job went stale and was claimed again, or abandoned
+var errLostClaim = errors.New("image job claimed by another worker")
+
+// Compressor re-encodes an image according to the batch settings
+type Compressor func(data []byte, settings BatchSettings) ([]byte, error)
+
+// imageJob is one batch image claimed by a worker
+type imageJob struct {
+	ID        string
+	BatchID   string
+	SourceURL string
+	Attempts  int
+	Settings  BatchSettings
+
+	// Abandoned is set when the job went stale on its last attempt. The
+	// claim has already failed and refunded it, so it must not run again.
+	Abandoned bool
+}
+
+// permanentError marks a failure that retrying won't fix, such as a 404 or a
+// file that isn't an image
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// WorkerPool compresses batch images in the background and saves the
+// results to storage. Jobs are rows in batch_images, claimed with SELECT ...
+// FOR UPDATE SKIP LOCKED so any number of workers across instances can share
+// the queue. The pool also deletes outputs once their retention ends.
+type WorkerPool struct {
+	logger    *slog.Logger
+	workers   int
+	fetcher   *fetch.Fetcher
+	compress  Compressor
+	store     Store
+	storage   Storage
+	retention time.Duration
+	webhooks  *fetch.Fetcher
+	pixels    *pixelBudget
+
+	stopClaiming context.CancelFunc
+	abortJobs    context.CancelFunc
+	wg           sync.WaitGroup
+}
+
+// newWorkerPool sizes the pool from WORKER_COUNT and keeps outputs for
+// OUTPUT_RETENTION
+func newWorkerPool(logger *slog.Logger, store Store, storage Storage) *WorkerPool {
+	workers := defaultWorkerCount
+	if n, err := strconv.Atoi(os.Getenv("WORKER_COUNT")); err == nil && n >= 0 {
+		workers = n
+	}
+
+	return &WorkerPool{
+		logger:    logger,
+		workers:   workers,
+		fetcher:   newSourceFetcher(),
+		compress:  imageCompressor,
+		store:     store,
+		storage:   storage,
+		retention: outputRetention(logger),
+		webhooks:  newWebhookFetcher(),
+		pixels:    newPixelBudget(decodeBudgetPixels),
+	}
+}
+
+// Start launches the workers
+func (p *WorkerPool) Start() {
+	claimCtx, stopClaiming := context.WithCancel(context.Background())
+	jobCtx, abortJobs := context.WithCancel(context.Background())
+	p.stopClaiming, p.abortJobs = stopClaiming, abortJobs
+
+	for range p.workers {
+		p.wg.Add(1)
+		go p.run(claimCtx, jobCtx)
+	}
+	for range webhookWorkers {
+		p.wg.Add(1)
+		go p.runWebhooks(claimCtx, jobCtx)
+	}
+	p.wg.Add(1)
+	go p.runJanitor(claimCtx)
+	p.logger.Info("workers started", "count", p.workers, "retention", p.retention.String())
+}
+
+// Stop stops claiming jobs and waits for in-flight jobs to finish. If ctx ends
+// first, the remaining jobs are cancelled and released back to the queue.
+func (p *WorkerPool) Stop(ctx context.Context) error {
+	if p.stopClaiming == nil {
+		return nil
+	}
+	p.stopClaiming()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.logger.Info("workers stopped")
+		return nil
+	case <-ctx.Done():
+		p.abortJobs()
+		<-done
+		p.logger.Warn("workers stopped before in-flight jobs finished; jobs released")
+		return ctx.Err()
+	}
+}
+
+func (p *WorkerPool) run(claimCtx, jobCtx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		job, err := p.store.ClaimImageJob(claimCtx)
+		if claimCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.logger.Error("failed to claim image job", "error", err)
+		}
+		if job == nil {
+			select {
+			case <-claimCtx.Done():
+				return
+			case <-time.After(workerPollInterval):
+			}
+			continue
+		}
+
+		if job.Abandoned {
+			p.logger.Error("image job abandoned after repeated interruptions", "image_id", job.ID, "attempts", job.Attempts)
+			p.finishBatch(context.WithoutCancel(claimCtx), job.BatchID)
+			continue
+		}
+		p.process(jobCtx, job)
+	}
+}
+
+// process runs one job and records the outcome
+func (p *WorkerPool) process(ctx context.Context, job *imageJob) {
+	// An image that crashes the decoder would otherwise take the instance
+	// down with it, and then every instance that claims it after that
+	defer func() {
+		if v := recover(); v != nil {
+			p.logger.Error("image job panicked", "image_id", job.ID, "panic", v, "stack", string(debug.Stack()))
+
+			dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+			defer cancel()
+			if err := p.store.FailImageJob(dbCtx, job.ID, job.Attempts, "image could not be processed", false, 0); err != nil {
+				p.logResultError(job, err)
+				return
+			}
+			p.finishBatch(dbCtx, job.BatchID)
+		}
+	}()
+
+	jobCtx, cancel := context.WithTimeout(ctx, jobTimeout)
+	defer cancel()
+
+	original, compressed, key, err := p.compressJob(jobCtx, job)
+
+	// Record the outcome even when shutdown cancelled the job
+	dbCtx, dbCancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer dbCancel()
+
+	// settled is set once the image has reached a final status
+	var settled bool
+	switch {
+	case err == nil:
+		err = p.store.CompleteImageJob(dbCtx, job.ID, job.Attempts, len(original), len(compressed), key, p.retention)
+		if err == nil {
+			settled = true
+			p.logger.Info("image compressed", "image_id", job.ID, "batch_id", job.BatchID,
+				"original_size", len(original), "compressed_size", len(compressed))
+		}
+	case ctx.Err() != nil:
+		err = p.store.ReleaseImageJob(dbCtx, job.ID, job.Attempts)
+	default:
+		retry := job.Attempts < maxJobAttempts && !errors.As(err, new(*permanentError))
+		p.logger.Warn("image job failed", "image_id", job.ID, "attempt", job.Attempts, "retry", retry, "error", err)
+		err = p.store.FailImageJob(dbCtx, job.ID, job.Attempts, err.Error(), retry, retryBackoff(job.Attempts))
+		settled = err == nil && !retry
+	}
+	if err != nil {
+		p.logResultError(job, err)
+	}
+	if settled {
+		p.finishBatch(dbCtx, job.BatchID)
+	}
+}
+
+// logResultError reports a job outcome that couldn't be recorded. Losing the
+// claim is expected when a slow job went stale: the worker holding it now
+// records the result, and settles the batch.
+func (p *WorkerPool) logResultError(job *imageJob, err error) {
+	if errors.Is(err, errLostClaim) {
+		p.logger.Warn("image job result discarded; another worker holds the job", "image_id", job.ID, "attempt", job.Attempts)
+		return
+	}
+	p.logger.Error("failed to record image job result", "image_id", job.ID, "error", err)
+}
+
+// finishBatch marks a batch finished once its last image has settled
+func (p *WorkerPool) finishBatch(ctx context.Context, batchID string) {
+	finished, err := p.store.FinishBatch(ctx, batchID)
+	if err != nil {
+		p.logger.Error("failed to finish batch", "batch_id", batchID, "error", err)
+	} else if finished {
+		p.logger.Info("batch finished", "batch_id", batchID)
+	}
+}
+
+// compressJob downloads, compresses and stores one image, returning both
+// versions and the storage key of the output
+func (p *WorkerPool) compressJob(ctx context.Context, job *imageJob) ([]byte, []byte, string, error) {
+	original, err := downloadImage(ctx, p.fetcher, job.SourceURL)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	compressed, err := p.compressImage(ctx, original, job.Settings)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	key := outputKey(job.BatchID, job.ID, job.Settings.Format)
+	if err := p.storage.Put(ctx, key, compressed, outputContentType(job.Settings.Format)); err != nil {
+		return nil, nil, "", fmt.Errorf("store output: %w", err)
+	}
+	return original, compressed, key, nil
+}
+
+// compressImage waits until the pixel budget has room for data's decoded
+// size, then compresses it. Images whose header can't be read are passed
+// straight to the compressor to report the error.
+func (p *WorkerPool) compressImage(ctx context.Context, data []byte, settings BatchSettings) ([]byte, error) {
+	if pixels, err := imaging.Pixels(data); err == nil {
+		// Anything over the cap is refused before it is decoded
+		n := min(pixels, imaging.MaxPixels)
+		if err := p.pixels.acquire(ctx, n); err != nil {
+			return nil, err
+		}
+		defer p.pixels.release(n)
+	}
+	return p.compress(data, settings)
+}
+
+// pixelBudget shares a fixed number of decoded pixels between everything that
+// compresses images, so batch workers and direct uploads together stay within
+// the VM's memory however large their images are
+type pixelBudget struct {
+	mu      sync.Mutex
+	free    int
+	changed chan struct{}
+}
+
+func newPixelBudget(pixels int) *pixelBudget {
+	return &pixelBudget{free: pixels, changed: make(chan struct{})}
+}
+
+// acquire waits until n pixels are free and takes them
+func (b *pixelBudget) acquire(ctx context.Context, n int) error {
+	for {
+		b.mu.Lock()
+		if n <= b.free {
+			b.free -= n
+			b.mu.Unlock()
+			return nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// release returns n pixels and wakes everything waiting for them
+func (b *pixelBudget) release(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.free += n
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// runJanitor deletes expired outputs until ctx is cancelled
+func (p *WorkerPool) runJanitor(ctx context.Context) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		n, err := p.deleteExpiredOutputs(ctx)
+		if err != nil && ctx.Err() == nil {
+			p.logger.Error("failed to delete expired outputs", "error", err)
+		}
+		if n > 0 {
+			p.logger.Info("deleted expired outputs", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deleteExpiredOutputs removes outputs past their expiry from storage and
+// forgets their keys, a page at a time
+func (p *WorkerPool) deleteExpiredOutputs(ctx context.Context) (int, error) {
+	deleted := 0
+	for {
+		outputs, err := p.store.ExpiredOutputs(ctx, 100)
+		if err != nil || len(outputs) == 0 {
+			return deleted, err
+		}
+		for _, o := range outputs {
+			if err := p.storage.Delete(ctx, o.Key); err != nil {
+				return deleted, err
+			}
+			if err := p.store.ClearOutputKey(ctx, o.ImageID); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+	}
+}
+
+// outputKey is where a batch image's output is stored
+func outputKey(batchID, imageID, format string) string {
+	return batchID + "/" + imageID + outputExtension(format)
+}
+
+// outputContentType is the MIME type of an output format
+func outputContentType(format string) string {
+	if format == "jpeg" {
+		return "image/jpeg"
+	}
+	return "image/webp"
+}
+
+// outputExtension is the file extension of an output format
+func outputExtension(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return ".webp"
+}
+
+// retryBackoff is the delay before retrying a job that failed on the given attempt
+func retryBackoff(attempt int) time.Duration {
+	d := 10 * time.Second << (attempt - 1)
+	return min(d, 5*time.Minute)
+}
+
+// newSourceFetcher returns the fetcher for user-supplied image URLs, which
+// refuses to reach internal addresses
+func newSourceFetcher(opts ...fetch.Option) *fetch.Fetcher {
+	return fetch.New(append([]fetch.Option{
+		fetch.WithMaxBytes(maxSourceImageBytes),
+		fetch.WithTimeout(time.Minute),
+		fetch.WithUserAgent(sourceUserAgent),
+	}, opts...)...)
+}
+
+// downloadImage fetches a source image. Failures that a retry can't fix, such
+// as a 404, a blocked address or a file that isn't an image, are permanent.
+func downloadImage(ctx context.Context, fetcher *fetch.Fetcher, url string) ([]byte, error) {
+	data, _, err := fetcher.Get(ctx, url)
+	if err == nil {
+		return data, nil
+	}
+
+	var statusErr *fetch.StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		err = fmt.Errorf("download image: %s", statusErr.Status)
+		if !statusErr.Temporary() {
+			return nil, permanent(err)
+		}
+		return nil, err
+	case errors.Is(err, fetch.ErrTooLarge):
+		return nil, permanent(fmt.Errorf("image is larger than %d MB", maxSourceImageBytes>>20))
+	case errors.Is(err, fetch.ErrScheme), errors.Is(err, fetch.ErrBlockedAddress),
+		errors.Is(err, fetch.ErrTooManyRedirects), errors.Is(err, fetch.ErrContentType):
+		return nil, permanent(fmt.Errorf("download image: %w", err))
+	}
+	return nil, fmt.Errorf("download image: %w", err)
+}
+
+// imageCompressor resizes and re-encodes an image with the imaging package.
+// Failures come from the input itself, so they are never retried.
+func imageCompressor(data []byte, settings BatchSettings) ([]byte, error) {
+	out, err := imaging.Process(data, imaging.Options{
+		Format:    settings.Format,
+		Quality:   settings.Quality,
+		Lossless:  settings.Lossless,
+		MaxWidth:  settings.MaxWidth,
+		MaxHeight: settings.MaxHeight,
+	})
+	if err != nil {
+		return nil, permanent(err)
+	}
+	return out, nil
+}
+
+// ClaimImageJob marks the next due image as processing and returns it, or nil
+// when the queue is empty. Jobs left processing by a crashed instance are
+// picked up again once they go stale, unless that was their last attempt:
+// those are failed and refunded instead, and returned as Abandoned, so an
+// image that kills its worker can't take down one instance after another.
+func (pg *pgStore) ClaimImageJob(ctx context.Context) (*imageJob, error) {
+	query := `
+		WITH next AS (
+			SELECT id, status = 'processing' AND attempts >= $2 AS abandoned
+			FROM batch_images
+			WHERE (status = 'pending' AND next_attempt_at <= now())
+				OR (status = 'processing' AND claimed_at < now() - $1::interval)
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		), claimed AS (
+			UPDATE batch_images AS i
+			SET status = CASE WHEN next.abandoned THEN 'failed' ELSE 'processing' END,
+				attempts = CASE WHEN next.abandoned THEN i.attempts ELSE i.attempts + 1 END,
+				claimed_at = CASE WHEN next.abandoned THEN NULL ELSE now() END,
+				error = CASE WHEN next.abandoned THEN $3 ELSE i.error END,
+				updated_at = now()
+			FROM next, batches AS b
+			WHERE i.id = next.id AND b.id = i.batch_id
+			RETURNING i.id, i.batch_id, i.source_url, i.attempts, b.quality, b.format, b.lossless,
+				b.max_width, b.max_height, next.abandoned
+		), refunded AS (
+			UPDATE usage_ledger SET refunded_at = now()
+			WHERE refunded_at IS NULL AND image_id IN (SELECT id FROM claimed WHERE abandoned)
+		)
+		SELECT * FROM claimed
+	`
+
+	var job imageJob
+	s := &job.Settings
+	err := pg.pool.QueryRow(ctx, query, staleJobTimeout.String(), maxJobAttempts, abandonedJobError).Scan(
+		&job.ID, &job.BatchID, &job.SourceURL, &job.Attempts,
+		&s.Quality, &s.Format, &s.Lossless, &s.MaxWidth, &s.MaxHeight, &job.Abandoned,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// CompleteImageJob records a successfully compressed image and when its
+// stored output expires. It returns errLostClaim unless the job is still
+// processing the given attempt.
+func (pg *pgStore) CompleteImageJob(ctx context.Context, id string, attempt, originalSize, compressedSize int, outputKey string, retention time.Duration) error {
+	query := `
+		UPDATE batch_images
+		SET status = 'completed', original_size = $3, compressed_size = $4, error = NULL,
+			output_key = $5, expires_at = now() + $6::interval,
+			claimed_at = NULL, updated_at = now()
+		WHERE id = $1 AND status = 'processing' AND attempts = $2
+	`
+
+	tag, err := pg.pool.Exec(ctx, query, id, attempt, originalSize, compressedSize, outputKey, retention.String())
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errLostClaim
+	}
+	return nil
+}
+
+// expiredOutput is a stored output whose retention has ended
+type expiredOutput struct {
+	ImageID string
+	Key     string
+}
+
+// ExpiredOutputs returns up to limit outputs that are past their expiry
+func (pg *pgStore) ExpiredOutputs(ctx context.Context, limit int) ([]expiredOutput, error) {
+	rows, err := pg.pool.Query(ctx, `
+		SELECT id, output_key FROM batch_images
+		WHERE output_key IS NOT NULL AND expires_at <= now()
+		ORDER BY expires_at
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var outputs []expiredOutput
+	for rows.Next() {
+		var o expiredOutput
+		if err := rows.Scan(&o.ImageID, &o.Key); err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, o)
+	}
+	return outputs, rows.Err()
+}
+
+// queueBacklog is the images waiting for a worker
+type queueBacklog struct {
+	Due       int        // Pending images whose next attempt is due
+	OldestDue *time.Time // When the longest-waiting of them became due
+}
+
+// QueueBacklog counts the images that are due but not yet claimed
+func (pg *pgStore) QueueBacklog(ctx context.Context) (queueBacklog, error) {
+	query := `
+		SELECT count(*), min(next_attempt_at) FROM batch_images
+		WHERE status = 'pending' AND next_attempt_at <= now()
+	`
+
+	var b queueBacklog
+	err := pg.pool.QueryRow(ctx, query).Scan(&b.Due, &b.OldestDue)
+	return b, err
+}
+
+// ClearOutputKey records that an image's output has been deleted
+func (pg *pgStore) ClearOutputKey(ctx context.Context, id string) error {
+	_, err := pg.pool.Exec(ctx, `UPDATE batch_images SET output_key = NULL, updated_at = now() WHERE id = $1`, id)
+	return err
+}
+
+// ReleaseImageJob returns an interrupted job to the queue without counting the
+// attempt. It returns errLostClaim unless the job is still processing the
+// given attempt.
+func (pg *pgStore) ReleaseImageJob(ctx context.Context, id string, attempt int) error {
+	query := `
+		UPDATE batch_images
+		SET status = 'pending', attempts = attempts - 1, next_attempt_at = now(),
+			claimed_at = NULL, updated_at = now()
+		WHERE id = $1 AND status = 'processing' AND attempts = $2
+	`
+
+	tag, err := pg.pool.Exec(ctx, query, id, attempt)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errLostClaim
+	}
+	return nil
+}
+
+// FailImageJob schedules a retry, or marks the image failed and refunds its
+// credit. It returns errLostClaim unless the job is still processing the
+// given attempt, so a worker that lost its claim can't refund a credit twice.
+func (pg *pgStore) FailImageJob(ctx context.Context, id string, attempt int, message string, retry bool, backoff time.Duration) error {
+	if retry {
+		query := `
+			UPDATE batch_images
+			SET status = 'pending', error = $3, next_attempt_at = now() + $4::interval,
+				claimed_at = NULL, updated_at = now()
+			WHERE id = $1 AND status = 'processing' AND attempts = $2
+		`
+		tag, err := pg.pool.Exec(ctx, query, id, attempt, message, backoff.String())
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errLostClaim
+		}
+		return nil
+	}
+
+	tx, err := pg.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `
+		UPDATE batch_images
+		SET status = 'failed', error = $3, claimed_at = NULL, updated_at = now()
+		WHERE id = $1 AND status = 'processing' AND attempts = $2
+	`, id, attempt, message)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errLostClaim
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE usage_ledger SET refunded_at = now() WHERE image_id = $1 AND refunded_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
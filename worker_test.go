@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/image/webp"
+
+	"github.com/devrewoh/devrewoh-portfolio/internal/fetch"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{10, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := retryBackoff(tt.attempt); got != tt.want {
+			t.Errorf("retryBackoff(%d): expected %v, got %v", tt.attempt, tt.want, got)
+		}
+	}
+}
+
+func TestDownloadImage(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok.png":
+			w.Write(img.Bytes())
+		case "/page.png":
+			w.Write([]byte("<html>not an image</html>"))
+		case "/busy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/throttled":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		path      string
+		wantErr   bool
+		permanent bool
+	}{
+		{"/ok.png", false, false},
+		{"/missing.png", true, true},
+		{"/page.png", true, true},
+		{"/busy", true, false},
+		{"/throttled", true, false},
+	}
+
+	fetcher := newSourceFetcher(fetch.AllowLoopback())
+	for _, tt := range tests {
+		data, err := downloadImage(context.Background(), fetcher, srv.URL+tt.path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: expected error %v, got %v", tt.path, tt.wantErr, err)
+			continue
+		}
+		if err == nil && !bytes.Equal(data, img.Bytes()) {
+			t.Errorf("%s: unexpected body %q", tt.path, data)
+		}
+		if got := errors.As(err, new(*permanentError)); got != tt.permanent {
+			t.Errorf("%s: expected permanent %v, got %v", tt.path, tt.permanent, got)
+		}
+	}
+}
+
+func TestDownloadImageRejectsLargeFiles(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No Content-Length, so the limit has to be enforced while reading
+		w.(http.Flusher).Flush()
+		io.Copy(w, io.LimitReader(zeroReader{}, maxSourceImageBytes+1))
+	}))
+	defer srv.Close()
+
+	_, err := downloadImage(context.Background(), newSourceFetcher(fetch.AllowLoopback()), srv.URL)
+	if err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("Expected a size error, got %v", err)
+	}
+	if !errors.As(err, new(*permanentError)) {
+		t.Errorf("Expected a permanent error, got %v", err)
+	}
+}
+
+func TestDownloadImageBlocksInternalAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected the loopback server never to be reached")
+	}))
+	defer srv.Close()
+
+	for _, url := range []string{srv.URL, "http://169.254.169.254/latest/meta-data/"} {
+		_, err := downloadImage(context.Background(), newSourceFetcher(), url)
+		if !errors.Is(err, fetch.ErrBlockedAddress) || !errors.As(err, new(*permanentError)) {
+			t.Errorf("%s: expected a permanent blocked address error, got %v", url, err)
+		}
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestImageCompressor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 48))
+	for y := range 48 {
+		for x := range 64 {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 5), 128, 255})
+		}
+	}
+	var src bytes.Buffer
+	png.Encode(&src, img)
+
+	out, err := imageCompressor(src.Bytes(), BatchSettings{Quality: 80, Format: "jpeg", MaxWidth: 32})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Expected JPEG output, got %v", err)
+	}
+	if want := image.Rect(0, 0, 32, 24); decoded.Bounds() != want {
+		t.Errorf("Expected bounds %v, got %v", want, decoded.Bounds())
+	}
+
+	out, err = imageCompressor(src.Bytes(), BatchSettings{Quality: 80, Format: "webp"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cfg, err := webp.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Expected WebP output, got %v", err)
+	}
+	if cfg.Width != 64 || cfg.Height != 48 {
+		t.Errorf("Expected 64x48, got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	_, err = imageCompressor([]byte("not an image"), BatchSettings{Quality: 80})
+	if !errors.As(err, new(*permanentError)) {
+		t.Errorf("Expected a permanent decode error, got %v", err)
+	}
+}
+
+func TestCompressJobStoresOutput(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 16, 16)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(img.Bytes())
+	}))
+	defer srv.Close()
+
+	storage := localStorage{dir: t.TempDir()}
+	pool := &WorkerPool{
+		fetcher:  newSourceFetcher(fetch.AllowLoopback()),
+		compress: imageCompressor,
+		storage:  storage,
+		pixels:   newPixelBudget(decodeBudgetPixels),
+	}
+	job := &imageJob{ID: "image", BatchID: "batch", SourceURL: srv.URL, Settings: BatchSettings{Quality: 80, Format: "jpeg"}}
+
+	_, compressed, key, err := pool.compressJob(context.Background(), job)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if key != "batch/image.jpg" {
+		t.Errorf("Expected key batch/image.jpg, got %q", key)
+	}
+	rc, err := storage.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Expected the output in storage, got %v", err)
+	}
+	defer rc.Close()
+	stored, _ := io.ReadAll(rc)
+	if !bytes.Equal(stored, compressed) {
+		t.Error("Expected the stored output to match the compressed image")
+	}
+}
+
+func TestWorkerPoolStopWithoutStart(t *testing.T) {
+	pool := newWorkerPool(slog.New(slog.NewTextHandler(io.Discard, nil)), nil, localStorage{dir: t.TempDir()})
+	if err := pool.Stop(context.Background()); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+// queueTestImage creates a one-image batch on a fresh key and returns the
+// store, the batch ID and the key
+func queueTestImage(t *testing.T, sourceURL string) (*memoryStore, string, *APIKey) {
+	t.Helper()
+
+	store := newMemoryStore()
+	ctx := context.Background()
+	key, err := store.LoadAPIKey(ctx, hashToken(storeAPIKey(t, store, "chris@example.com", "starter")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	batchID, err := store.CreateBatch(ctx, key, []string{sourceURL}, BatchSettings{Quality: 80, Format: "jpeg"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, batchID, key
+}
+
+func TestProcessFailsJobThatPanics(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 16, 16)))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(img.Bytes())
+	}))
+	defer srv.Close()
+
+	store, batchID, key := queueTestImage(t, srv.URL)
+	pool := &WorkerPool{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		fetcher:  newSourceFetcher(fetch.AllowLoopback()),
+		compress: func([]byte, BatchSettings) ([]byte, error) { panic("decoder bug") },
+		store:    store,
+		storage:  localStorage{dir: t.TempDir()},
+		pixels:   newPixelBudget(decodeBudgetPixels),
+	}
+
+	job, err := store.ClaimImageJob(context.Background())
+	if err != nil || job == nil {
+		t.Fatalf("Expected a job, got %v, %v", job, err)
+	}
+	pool.process(context.Background(), job)
+
+	if status := store.batchStatus(batchID); status.Failed != 1 || !store.batches[batchID].finished {
+		t.Errorf("Expected the image failed and the batch finished, got %+v", status)
+	}
+	if usage, _ := store.GetUsage(context.Background(), key.KeyHash); usage.Used != 0 {
+		t.Errorf("Expected the credit refunded, got %d used", usage.Used)
+	}
+}
+
+func TestProcessDiscardsResultAfterLosingClaim(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not an image"))
+	}))
+	defer srv.Close()
+
+	store, batchID, key := queueTestImage(t, srv.URL)
+	pool := &WorkerPool{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		fetcher:  newSourceFetcher(fetch.AllowLoopback()),
+		compress: imageCompressor,
+		store:    store,
+		storage:  localStorage{dir: t.TempDir()},
+		pixels:   newPixelBudget(decodeBudgetPixels),
+	}
+	ctx := context.Background()
+
+	// The job goes stale while its worker is still running, and another claims it
+	stalled, err := store.ClaimImageJob(ctx)
+	if err != nil || stalled == nil {
+		t.Fatalf("Expected a job, got %v, %v", stalled, err)
+	}
+	store.images[0].claimedAt = time.Now().Add(-staleJobTimeout - time.Minute)
+	if job, err := store.ClaimImageJob(ctx); err != nil || job == nil || job.Attempts != 2 {
+		t.Fatalf("Expected the second attempt, got %+v, %v", job, err)
+	}
+	pool.process(ctx, stalled)
+
+	if img := store.images[0]; img.Status != statusProcessing || store.batches[batchID].finished {
+		t.Errorf("Expected the image still processing and the batch unfinished, got %+v", img.batchImage)
+	}
+	if usage, _ := store.GetUsage(ctx, key.KeyHash); usage.Used != 1 {
+		t.Errorf("Expected the credit kept, got %d used", usage.Used)
+	}
+}
+
+func TestClaimImageJobAbandonsStaleLastAttempt(t *testing.T) {
+	store, batchID, key := queueTestImage(t, "https://example.com/a.jpg")
+	ctx := context.Background()
+
+	// Each attempt's worker dies, leaving the job processing until it goes stale
+	for attempt := 1; attempt <= maxJobAttempts; attempt++ {
+		job, err := store.ClaimImageJob(ctx)
+		if err != nil || job == nil || job.Abandoned {
+			t.Fatalf("Attempt %d: expected a job to run, got %+v, %v", attempt, job, err)
+		}
+		store.images[0].claimedAt = time.Now().Add(-staleJobTimeout - time.Minute)
+	}
+
+	job, err := store.ClaimImageJob(ctx)
+	if err != nil || job == nil {
+		t.Fatalf("Expected the stale job, got %v, %v", job, err)
+	}
+	if !job.Abandoned {
+		t.Fatal("Expected the job to be abandoned after its last attempt")
+	}
+	if status := store.batchStatus(batchID); status.Failed != 1 {
+		t.Errorf("Expected the image failed, got %+v", status)
+	}
+	if usage, _ := store.GetUsage(context.Background(), key.KeyHash); usage.Used != 0 {
+		t.Errorf("Expected the credit refunded, got %d used", usage.Used)
+	}
+	if job, _ := store.ClaimImageJob(ctx); job != nil {
+		t.Errorf("Expected nothing left to claim, got %+v", job)
+	}
+}
+
+func TestPixelBudget(t *testing.T) {
+	budget := newPixelBudget(100)
+	ctx := context.Background()
+
+	if err := budget.acquire(ctx, 60); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not enough left: the wait ends with the context
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := budget.acquire(short, 60); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected to wait until the deadline, got %v", err)
+	}
+
+	// A release wakes a waiter that now fits
+	acquired := make(chan error, 1)
+	go func() { acquired <- budget.acquire(ctx, 60) }()
+	budget.release(60)
+	select {
+	case err := <-acquired:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the waiter to acquire the released pixels")
+	}
+}
+
+func TestCompressImageSharesPixelBudget(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 16, 16)))
+
+	pool := &WorkerPool{compress: imageCompressor, pixels: newPixelBudget(16 * 16)}
+
+	// Another image holds part of the budget
+	if err := pool.pixels.acquire(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := pool.compressImage(ctx, img.Bytes(), BatchSettings{Quality: 80, Format: "jpeg"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected to wait for the budget, got %v", err)
+	}
+
+	pool.pixels.release(1)
+	if _, err := pool.compressImage(context.Background(), img.Bytes(), BatchSettings{Quality: 80, Format: "jpeg"}); err != nil {
+		t.Fatalf("Expected the image to compress once the budget is free, got %v", err)
+	}
+	if pool.pixels.free != 16*16 {
+		t.Errorf("Expected the pixels returned after compressing, got %d free", pool.pixels.free)
+	}
+}